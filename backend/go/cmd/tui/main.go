@@ -4,18 +4,38 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 	"log"
 	"os"
+	"path/filepath"
 
 	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
 	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiconsumer/tui"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/bash"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/fish"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/nvim"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/python"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/wrap"
 	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/zsh"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// providers are the shells CLUI_SHELL can choose from
+var providers = map[string]func() clui.Provider{
+	"zsh":    func() clui.Provider { return zsh.NewProvider() },
+	"bash":   func() clui.Provider { return bash.NewProvider() },
+	"fish":   func() clui.Provider { return fish.NewProvider() },
+	"nvim":   func() clui.Provider { return nvim.NewProvider() },
+	"python": func() clui.Provider { return python.NewProvider() },
+	"wrap":   func() clui.Provider { return wrap.NewProvider() },
+}
+
 func main() {
 	viper.AutomaticEnv()
 
+	viper.SetDefault(
+		"CLUI_SHELL",
+		"zsh",
+	)
 	viper.SetDefault(
 		"ZSH_COMPLETER_SCRIPT_PATH",
 		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/capture.zsh",
@@ -24,6 +44,104 @@ func main() {
 		"ZSH_PATH",
 		"/bin/zsh",
 	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_WORKERS",
+		2,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_WHATIS_PATH",
+		"whatis",
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_EXEC_HELP",
+		false,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_CACHE_PATH",
+		"",
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_DESCRIBE_WORKERS",
+		4,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_DESCRIBE_DEADLINE",
+		"50ms",
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_INITIAL_ENTRIES",
+		30,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_ENTRIES_CHUNK",
+		500,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_FUZZY",
+		false,
+	)
+	viper.SetDefault(
+		"ZSH_HISTFILE",
+		filepath.Join(os.Getenv("HOME"), ".zsh_history"),
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_RANKING_PATH",
+		filepath.Join(os.Getenv("HOME"), ".cache", "clui", "ranking.json"),
+	)
+	viper.SetDefault(
+		"BASH_COMPLETER_SCRIPT_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/capture.bash",
+	)
+	viper.SetDefault(
+		"BASH_PATH",
+		"/bin/bash",
+	)
+	viper.SetDefault(
+		"FISH_COMPLETER_SCRIPT_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/capture.fish",
+	)
+	viper.SetDefault(
+		"FISH_PATH",
+		"/usr/bin/fish",
+	)
+	viper.SetDefault(
+		"NVIM_PLUGIN_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/clui.lua",
+	)
+	viper.SetDefault(
+		"NVIM_PATH",
+		"/usr/bin/nvim",
+	)
+	viper.SetDefault(
+		"NVIM_COMPLETER_LSP_TIMEOUT",
+		"200ms",
+	)
+	viper.SetDefault(
+		"PYTHON_STARTUP_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/clui_startup.py",
+	)
+	viper.SetDefault(
+		"PYTHON_PATH",
+		"/usr/bin/python3",
+	)
+	// WRAP_COMMAND is the command line of the program wrapped by
+	// CLUI_SHELL=wrap, split at whitespace
+	viper.SetDefault(
+		"WRAP_COMMAND",
+		"",
+	)
+	viper.SetDefault(
+		"WRAP_COMPLETIONS_PATH",
+		filepath.Join(os.Getenv("HOME"), ".config", "clui", "wrap"),
+	)
+	viper.SetDefault(
+		"WRAP_HISTORY_SIZE",
+		1000,
+	)
+	viper.SetDefault(
+		"WRAP_ECHO_DELAY",
+		"20ms",
+	)
 	viper.SetDefault(
 		"CLUI_TMP_PATH",
 		"/tmp/clui-tui",
@@ -40,7 +158,13 @@ func main() {
 	}
 	logrus.SetLevel(logLevel)
 
-	zshProvider := zsh.NewProvider()
+	newProvider, ok := providers[viper.GetString("CLUI_SHELL")]
+	if !ok {
+		logrus.Fatalln("unknown CLUI_SHELL: ", viper.GetString("CLUI_SHELL"))
+		return
+	}
+
+	provider := newProvider()
 	tuiConsumer := tui.Consumer{}
 	if err := tuiConsumer.Init(); err != nil {
 		log.Fatalln("cannot init tuiconsumer: ", err)
@@ -58,7 +182,7 @@ func main() {
 		}
 	}()
 
-	if err := clui.Connect(zshProvider, &tuiConsumer); err != nil {
+	if err := clui.Connect(provider, &tuiConsumer); err != nil {
 		log.Fatalln("cannot connect: ", err)
 	}
 }
@@ -1,17 +1,40 @@
 package main
 
 import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
 	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
 	wsconsumer "github.com/michaellee8/clui-nix/backend/go/pkg/cluiconsumer/websocket"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/bash"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/fish"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/nvim"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/python"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/wrap"
 	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/zsh"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// providers are the shells CLUI_SHELL can choose from
+var providers = map[string]func() clui.Provider{
+	"zsh":    func() clui.Provider { return zsh.NewProvider() },
+	"bash":   func() clui.Provider { return bash.NewProvider() },
+	"fish":   func() clui.Provider { return fish.NewProvider() },
+	"nvim":   func() clui.Provider { return nvim.NewProvider() },
+	"python": func() clui.Provider { return python.NewProvider() },
+	"wrap":   func() clui.Provider { return wrap.NewProvider() },
+}
+
 func main() {
 	viper.AutomaticEnv()
 
+	viper.SetDefault(
+		"CLUI_SHELL",
+		"zsh",
+	)
 	viper.SetDefault(
 		"ZSH_COMPLETER_SCRIPT_PATH",
 		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/capture.zsh",
@@ -20,6 +43,104 @@ func main() {
 		"ZSH_PATH",
 		"/bin/zsh",
 	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_WORKERS",
+		2,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_WHATIS_PATH",
+		"whatis",
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_EXEC_HELP",
+		false,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_CACHE_PATH",
+		"",
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_DESCRIBE_WORKERS",
+		4,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_DESCRIBE_DEADLINE",
+		"50ms",
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_INITIAL_ENTRIES",
+		30,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_ENTRIES_CHUNK",
+		500,
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_FUZZY",
+		false,
+	)
+	viper.SetDefault(
+		"ZSH_HISTFILE",
+		filepath.Join(os.Getenv("HOME"), ".zsh_history"),
+	)
+	viper.SetDefault(
+		"ZSH_COMPLETER_RANKING_PATH",
+		filepath.Join(os.Getenv("HOME"), ".cache", "clui", "ranking.json"),
+	)
+	viper.SetDefault(
+		"BASH_COMPLETER_SCRIPT_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/capture.bash",
+	)
+	viper.SetDefault(
+		"BASH_PATH",
+		"/bin/bash",
+	)
+	viper.SetDefault(
+		"FISH_COMPLETER_SCRIPT_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/capture.fish",
+	)
+	viper.SetDefault(
+		"FISH_PATH",
+		"/usr/bin/fish",
+	)
+	viper.SetDefault(
+		"NVIM_PLUGIN_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/clui.lua",
+	)
+	viper.SetDefault(
+		"NVIM_PATH",
+		"/usr/bin/nvim",
+	)
+	viper.SetDefault(
+		"NVIM_COMPLETER_LSP_TIMEOUT",
+		"200ms",
+	)
+	viper.SetDefault(
+		"PYTHON_STARTUP_PATH",
+		"/home/michaellee8/personal-projects/clui-nix/backend/scripts/clui_startup.py",
+	)
+	viper.SetDefault(
+		"PYTHON_PATH",
+		"/usr/bin/python3",
+	)
+	// WRAP_COMMAND is the command line of the program wrapped by
+	// CLUI_SHELL=wrap, split at whitespace
+	viper.SetDefault(
+		"WRAP_COMMAND",
+		"",
+	)
+	viper.SetDefault(
+		"WRAP_COMPLETIONS_PATH",
+		filepath.Join(os.Getenv("HOME"), ".config", "clui", "wrap"),
+	)
+	viper.SetDefault(
+		"WRAP_HISTORY_SIZE",
+		1000,
+	)
+	viper.SetDefault(
+		"WRAP_ECHO_DELAY",
+		"20ms",
+	)
 	viper.SetDefault(
 		"CLUI_TMP_PATH",
 		"/tmp/ws",
@@ -32,6 +153,26 @@ func main() {
 		"PORT",
 		"8080",
 	)
+	viper.SetDefault(
+		"SCROLLBACK_SIZE",
+		64*1024,
+	)
+	viper.SetDefault(
+		"DETACH_TIMEOUT",
+		"1h",
+	)
+	viper.SetDefault(
+		"MAX_SESSIONS",
+		16,
+	)
+	viper.SetDefault(
+		"AUTH_TOKEN_TTL",
+		"5m",
+	)
+	viper.SetDefault(
+		"AUTH_DISABLE",
+		false,
+	)
 	logLevel, err := logrus.ParseLevel(viper.GetString("GOLOG"))
 	if err != nil {
 		logrus.Fatalln(errors.Wrap(err, "cannot parse log level"))
@@ -39,16 +180,53 @@ func main() {
 	}
 	logrus.SetLevel(logLevel)
 
-	zshProvider := zsh.NewProvider()
-	wsConsumer := wsconsumer.Consumer{
-		Port: viper.GetInt("PORT"),
+	newProvider, ok := providers[viper.GetString("CLUI_SHELL")]
+	if !ok {
+		logrus.Fatalln("unknown CLUI_SHELL: ", viper.GetString("CLUI_SHELL"))
+		return
+	}
+
+	wsServer := wsconsumer.Server{
+		Port:           viper.GetInt("PORT"),
+		ScrollbackSize: viper.GetInt("SCROLLBACK_SIZE"),
+		DetachTimeout:  viper.GetDuration("DETACH_TIMEOUT"),
+		MaxSessions:    viper.GetInt("MAX_SESSIONS"),
+		// TLS is enabled by setting TLS_CERT_PATH and TLS_KEY_PATH, and
+		// mutual TLS additionally by TLS_CLIENT_CA_PATH
+		TLSCertFile:     viper.GetString("TLS_CERT_PATH"),
+		TLSKeyFile:      viper.GetString("TLS_KEY_PATH"),
+		TLSClientCAFile: viper.GetString("TLS_CLIENT_CA_PATH"),
+		NewProvider:     newProvider,
+	}
+
+	// AUTH_SECRET is a shared secret presented as a bearer token in the
+	// Authorization header, and can be exchanged for tokens signed with
+	// AUTH_TOKEN_KEY that expire after AUTH_TOKEN_TTL. Browsers cannot set
+	// headers on websockets and only tokens are accepted in urls, so a random
+	// key is used if AUTH_TOKEN_KEY is not set, invalidating tokens on restart.
+	if secret := viper.GetString("AUTH_SECRET"); secret != "" {
+		wsServer.Auth = &wsconsumer.SharedSecretAuthenticator{Secret: secret}
+		key := []byte(viper.GetString("AUTH_TOKEN_KEY"))
+		if len(key) == 0 {
+			key = make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				logrus.Fatalln(errors.Wrap(err, "cannot generate token key"))
+				return
+			}
+		}
+		wsServer.Tokens = &wsconsumer.SignedTokens{
+			Key: key,
+			TTL: viper.GetDuration("AUTH_TOKEN_TTL"),
+		}
+	} else if !viper.GetBool("AUTH_DISABLE") {
+		logrus.Fatalln("AUTH_SECRET must be set, or AUTH_DISABLE=true to serve shells without authentication")
 	}
 
-	if err := wsConsumer.Init(); err != nil {
+	if err := wsServer.Init(); err != nil {
 
 		logrus.Fatalln("cannot init wsconsumer: ", err)
 	}
-	if err := clui.Connect(zshProvider, &wsConsumer); err != nil {
-		logrus.Fatalln("cannot connect: ", err)
+	if err := wsServer.ListenAndServe(); err != nil {
+		logrus.Fatalln("cannot serve: ", err)
 	}
 }
@@ -29,6 +29,8 @@ func debugPrintf(f string, s ...interface{}) {
 func main() {
 	var pos, dir, buffer, lbuffer, rbuffer string
 	var urlstr string
+	var id uint64
+	var executing bool
 	var help bool
 
 	flag.StringVar(&pos, "pos", "", "postion of current cursor in line;col form")
@@ -37,6 +39,8 @@ func main() {
 	flag.StringVar(&lbuffer, "lbuffer", "", "zsh lbuffer")
 	flag.StringVar(&rbuffer, "rbuffer", "", "zsh rbuffer")
 	flag.StringVar(&urlstr, "url", "", "url of the listening server")
+	flag.Uint64Var(&id, "id", 0, "monotonically increasing request id")
+	flag.BoolVar(&executing, "exec", false, "the shell leaves its prompt to run the line, pos is not needed")
 	flag.BoolVar(&help, "help", false, "show help message")
 	flag.Parse()
 
@@ -51,33 +55,42 @@ func main() {
 	}
 
 	debugPrintf(
-		"zkeylis debug: pos: %s, dir: %s, buffer: %s, lbuffer: %s, rbuffer: %s, url: %s\n",
-		pos, dir, buffer, lbuffer, rbuffer, urlstr,
+		"zkeylis debug: id: %d, pos: %s, dir: %s, buffer: %s, lbuffer: %s, rbuffer: %s, url: %s\n",
+		id, pos, dir, buffer, lbuffer, rbuffer, urlstr,
 	)
 
 	var line, col int
 
 	var err error
 
-	possp := strings.Split(pos, ";")
+	if !executing {
+		possp := strings.SplitN(pos, ";", 2)
 
-	if line, err = strconv.Atoi(possp[0]); err != nil {
-		debugPrintln(err)
-		return
-	}
+		if line, err = strconv.Atoi(possp[0]); err != nil {
+			debugPrintln(err)
+			return
+		}
 
-	if col, err = strconv.Atoi(possp[1]); err != nil {
-		debugPrintln(err)
-		return
+		if len(possp) < 2 {
+			debugPrintln("pos must be in line;col form")
+			return
+		}
+
+		if col, err = strconv.Atoi(possp[1]); err != nil {
+			debugPrintln(err)
+			return
+		}
 	}
 
 	csi := clui.CompletionSourceInfo{
-		Line:    int64(line),
-		Col:     int64(col),
-		Dir:     dir,
-		Buffer:  buffer,
-		LBuffer: lbuffer,
-		RBuffer: rbuffer,
+		Line:      int32(line),
+		Col:       int32(col),
+		Dir:       dir,
+		Buffer:    buffer,
+		LBuffer:   lbuffer,
+		RBuffer:   rbuffer,
+		RequestId: id,
+		Executing: executing,
 	}
 
 	u, err := url.Parse(urlstr)
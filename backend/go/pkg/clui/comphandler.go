@@ -11,3 +11,27 @@ type StringSliceHandler interface {
 type CompletionInfoHandler interface {
 	Handle(ci *protoclui.CompletionInfo)
 }
+
+// IsFollowUp reports whether ci only updates the earlier CompletionInfos with
+// the same request id instead of replacing them
+func IsFollowUp(ci *protoclui.CompletionInfo) bool {
+	return ci.Sequence > 0
+}
+
+// ApplyFollowUp applies the follow-up ci to base, the CompletionInfo it
+// updates, it reports whether ci belongs to base at all. Follow-ups must be
+// applied in sequence order.
+func ApplyFollowUp(base *protoclui.CompletionInfo, ci *protoclui.CompletionInfo) bool {
+	if base == nil || base.RequestId != ci.RequestId {
+		return false
+	}
+	base.Entries = append(base.Entries, ci.Entries...)
+	base.Groups = append(base.Groups, ci.Groups...)
+	for _, ld := range ci.LateDescriptions {
+		if int(ld.EntryIndex) < len(base.Entries) {
+			base.Entries[ld.EntryIndex].Description = ld.Description
+		}
+	}
+	base.Done = ci.Done
+	return true
+}
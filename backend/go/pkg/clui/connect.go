@@ -11,6 +11,7 @@ func Connect(p Provider, c Consumer) (err error) {
 	p.SetOutput(c.Output())
 	p.SetCompOptHandler(c.CompOptHandler())
 	p.SetWinsizeChan(c.WinsizeChan())
+	p.SetAcceptChan(c.AcceptChan())
 	go c.OnStart()
 
 	return errors.Wrap(p.Start(), "clui connect failed")
@@ -3,6 +3,8 @@ package clui
 import (
 	"github.com/kr/pty"
 	"io"
+
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
 )
 
 // Consumer represents any frontend that would like to consume the clui interface
@@ -31,6 +33,11 @@ type Consumer interface {
 	// be a buffered channel
 	WinsizeChan() chan pty.Winsize
 
+	// AcceptChan should return a chan that consumer will send all completion
+	// entries accepted by the user to, which will be applied to the command
+	// line by the provider, it should not be a buffered channel
+	AcceptChan() chan *protoclui.AcceptCompletion
+
 	// OnStart is a callback that will be called right before the Provider starts
 	// the backing process and have all preparation done successfully. It should
 	// only be called once
@@ -3,6 +3,8 @@ package clui
 import (
 	"github.com/kr/pty"
 	"io"
+
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
 )
 
 // Provider represents an interface that each clui backend should provide
@@ -24,8 +26,16 @@ type Provider interface {
 	// for changes of frontend terminal window size.
 	SetWinsizeChan(chan pty.Winsize)
 
+	// SetAcceptChan sets the channel that provider will be listening for
+	// completion entries accepted on the frontend.
+	SetAcceptChan(chan *protoclui.AcceptCompletion)
+
 	// Start starts the backend for user input, will return error only
 	// if the starting process failed. Should not return until the underlying
 	// process exited.
 	Start() error
+
+	// Stop terminates the underlying process, which makes Start return. It
+	// must be safe to be called before Start or more than once.
+	Stop() error
 }
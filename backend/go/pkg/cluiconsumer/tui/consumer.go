@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
@@ -36,6 +37,7 @@ type Consumer struct {
 	output       io.Writer
 	handler      clui.CompletionInfoHandler
 	winsizeChan  chan pty.Winsize
+	acceptChan   chan *protoclui.AcceptCompletion
 	osSignalChan chan os.Signal
 }
 
@@ -52,6 +54,9 @@ func (c *Consumer) Init() (err error) {
 
 	c.winsizeChan = make(chan pty.Winsize)
 
+	// the tui has no way to pick an entry, nothing is ever accepted
+	c.acceptChan = make(chan *protoclui.AcceptCompletion)
+
 	go func() {
 		for range c.osSignalChan {
 			if winsize, err := pty.GetsizeFull(os.Stdin); err != nil {
@@ -71,6 +76,10 @@ func (c *Consumer) Init() (err error) {
 func (c *Consumer) Handle(ci *protoclui.CompletionInfo) {
 
 	logrus.Tracef("tui handling completion on bufl %d, count %d", ci.BufferLength, len(ci.Entries))
+	if clui.IsFollowUp(ci) {
+		// only the first entry is shown, which is never in a follow-up
+		return
+	}
 	if len(ci.Entries) == 0 {
 		// ignore if no entries
 		return
@@ -82,11 +91,10 @@ func (c *Consumer) Handle(ci *protoclui.CompletionInfo) {
 	// move to our place to write first completion result
 	printEscCode(-1, "H")
 	printEscCode(-1, "K")
-	printEscCode(1, "m")
 	printEscCode(37, "m")
 	printEscCode(44, "m")
 
-	fmt.Printf("%s %s %d %d", ci.Entries[0].Suggestion, ci.Entries[0].Description, ci.Line, ci.Col)
+	fmt.Printf("%s %s %d %d", highlight(ci.Entries[0], getEscCode(1, "m"), getEscCode(22, "m")), ci.Entries[0].Description, ci.Line, ci.Col)
 
 	// restore cursor pos
 	printEscCode(-1, "u")
@@ -94,6 +102,27 @@ func (c *Consumer) Handle(ci *protoclui.CompletionInfo) {
 	printEscCode(0, "m")
 }
 
+// highlight returns the suggestion of e with its matched parts wrapped in on
+// and off, ranges beyond the suggestion are ignored
+func highlight(e *protoclui.CompletionEntry, on string, off string) string {
+	runes := []rune(e.Suggestion)
+	var sb strings.Builder
+	pos := 0
+	for _, r := range e.MatchRanges {
+		start, end := int(r.Start), int(r.End)
+		if start < pos || end > len(runes) || start >= end {
+			continue
+		}
+		sb.WriteString(string(runes[pos:start]))
+		sb.WriteString(on)
+		sb.WriteString(string(runes[start:end]))
+		sb.WriteString(off)
+		pos = end
+	}
+	sb.WriteString(string(runes[pos:]))
+	return sb.String()
+}
+
 func (c *Consumer) Dir() string {
 	return c.dir
 }
@@ -114,5 +143,9 @@ func (c *Consumer) WinsizeChan() chan pty.Winsize {
 	return c.winsizeChan
 }
 
+func (c *Consumer) AcceptChan() chan *protoclui.AcceptCompletion {
+	return c.acceptChan
+}
+
 func (c *Consumer) OnStart() {
 }
@@ -0,0 +1,148 @@
+package wsconsumer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Authenticator decides whether a request may use the Server, it returns a
+// non-nil error describing why a request is rejected
+type Authenticator interface {
+	Authenticate(r *http.Request) error
+}
+
+// bearerCredential returns the bearer token in the Authorization header of r
+func bearerCredential(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+// credential returns the credential presented by r, either as a bearer token
+// in the Authorization header or, since browsers cannot set headers on
+// websocket upgrades, as the access_token query parameter. Query parameters
+// end up in logs and browser history, so only credentials that expire soon
+// may be presented this way.
+func credential(r *http.Request) string {
+	if c := bearerCredential(r); c != "" {
+		return c
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// SharedSecretAuthenticator accepts requests presenting Secret as a bearer
+// token in the Authorization header, it is never accepted in the url
+type SharedSecretAuthenticator struct {
+	Secret string
+}
+
+// Authenticate implements the Authenticator interface
+func (a *SharedSecretAuthenticator) Authenticate(r *http.Request) error {
+	if a.Secret == "" {
+		return errors.New("no shared secret configured")
+	}
+	c := bearerCredential(r)
+	if c == "" {
+		return errors.New("no credential presented")
+	}
+	if subtle.ConstantTimeCompare([]byte(c), []byte(a.Secret)) != 1 {
+		return errors.New("wrong shared secret")
+	}
+	return nil
+}
+
+// SignedTokens issues and accepts short-lived tokens signed with Key, so that
+// clients can put a token that expires soon into websocket urls instead of a
+// long-lived secret. A token is <expiry>.<signature>, both base64url encoded.
+type SignedTokens struct {
+	Key []byte
+
+	// TTL indicates how long an issued token stays valid, defaults to 5
+	// minutes if not set
+	TTL time.Duration
+}
+
+// Issue returns a new token that expires after TTL
+func (t *SignedTokens) Issue() (token string, expiry time.Time, err error) {
+	if len(t.Key) == 0 {
+		return "", time.Time{}, errors.New("no token key configured")
+	}
+	ttl := t.TTL
+	if ttl == 0 {
+		ttl = 5 * time.Minute
+	}
+	expiry = time.Now().Add(ttl)
+	payload := []byte(strconv.FormatInt(expiry.Unix(), 10))
+	token = base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload))
+	return token, expiry, nil
+}
+
+// Authenticate implements the Authenticator interface
+func (t *SignedTokens) Authenticate(r *http.Request) error {
+	if len(t.Key) == 0 {
+		return errors.New("no token key configured")
+	}
+	c := credential(r)
+	if c == "" {
+		return errors.New("no credential presented")
+	}
+
+	parts := strings.Split(c, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return errors.Wrap(err, "malformed token payload")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return errors.Wrap(err, "malformed token signature")
+	}
+	if !hmac.Equal(sig, t.sign(payload)) {
+		return errors.New("bad token signature")
+	}
+
+	expiry, err := strconv.ParseInt(string(payload), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "malformed token expiry")
+	}
+	if time.Now().Unix() > expiry {
+		return errors.New("token expired")
+	}
+	return nil
+}
+
+func (t *SignedTokens) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, t.Key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// AnyAuthenticator accepts requests accepted by any of its Authenticators
+type AnyAuthenticator []Authenticator
+
+// Authenticate implements the Authenticator interface
+func (as AnyAuthenticator) Authenticate(r *http.Request) error {
+	if len(as) == 0 {
+		return errors.New("no authenticator configured")
+	}
+	var reasons []string
+	for _, a := range as {
+		err := a.Authenticate(r)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return errors.New(strings.Join(reasons, "; "))
+}
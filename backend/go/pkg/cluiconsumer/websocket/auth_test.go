@@ -0,0 +1,95 @@
+package wsconsumer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requestWithToken(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestSharedSecretAuthenticator(t *testing.T) {
+	require := require.New(t)
+
+	a := &SharedSecretAuthenticator{Secret: "s3cret"}
+
+	require.Nil(a.Authenticate(requestWithToken("s3cret")))
+	// the secret is long-lived, so it must not be put in urls
+	require.NotNil(a.Authenticate(httptest.NewRequest(http.MethodGet, "/sessions/x/io?access_token=s3cret", nil)))
+	require.NotNil(a.Authenticate(requestWithToken("wrong")))
+	require.NotNil(a.Authenticate(requestWithToken("")))
+	require.NotNil((&SharedSecretAuthenticator{}).Authenticate(requestWithToken("")))
+}
+
+func TestSignedTokens(t *testing.T) {
+	require := require.New(t)
+
+	tokens := &SignedTokens{Key: []byte("key"), TTL: time.Minute}
+
+	token, expiry, err := tokens.Issue()
+	require.Nil(err)
+	require.True(expiry.After(time.Now()))
+	require.Nil(tokens.Authenticate(requestWithToken(token)))
+	require.Nil(tokens.Authenticate(httptest.NewRequest(http.MethodGet, "/sessions/x/io?access_token="+token, nil)))
+
+	// a token signed with another key is rejected
+	other := &SignedTokens{Key: []byte("other")}
+	require.NotNil(other.Authenticate(requestWithToken(token)))
+
+	// so is a tampered one
+	require.NotNil(tokens.Authenticate(requestWithToken("A" + token)))
+	require.NotNil(tokens.Authenticate(requestWithToken("garbage")))
+
+	// and an expired one
+	expired := &SignedTokens{Key: []byte("key"), TTL: -time.Minute}
+	token, _, err = expired.Issue()
+	require.Nil(err)
+	require.NotNil(tokens.Authenticate(requestWithToken(token)))
+}
+
+func TestServerAuthentication(t *testing.T) {
+	require := require.New(t)
+
+	s := &Server{
+		Port:        8080,
+		NewProvider: newEchoProvider,
+		Auth:        &SharedSecretAuthenticator{Secret: "s3cret"},
+		Tokens:      &SignedTokens{Key: []byte("key")},
+	}
+	require.Nil(s.Init())
+
+	do := func(method string, path string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.ser.Handler.ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(http.StatusUnauthorized, do(http.MethodGet, "/sessions", "").Code)
+	require.Equal(http.StatusUnauthorized, do(http.MethodGet, "/sessions", "wrong").Code)
+	require.Equal(http.StatusOK, do(http.MethodGet, "/sessions", "s3cret").Code)
+
+	w := do(http.MethodPost, "/tokens", "s3cret")
+	require.Equal(http.StatusCreated, w.Code)
+	var info TokenInfo
+	require.Nil(json.NewDecoder(w.Body).Decode(&info))
+
+	require.Equal(http.StatusOK, do(http.MethodGet, "/sessions", info.Token).Code)
+	require.Equal(http.StatusOK, do(http.MethodGet, "/sessions?access_token="+info.Token, "").Code)
+	require.Equal(http.StatusUnauthorized, do(http.MethodGet, "/sessions?access_token=s3cret", "").Code)
+	// a token cannot be exchanged for a new one
+	require.Equal(http.StatusUnauthorized, do(http.MethodPost, "/tokens", info.Token).Code)
+}
@@ -1,16 +1,16 @@
 package wsconsumer
 
 import (
+	"crypto/subtle"
 	"io"
-	"net"
 	"net/http"
 	"os"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/gorilla/websocket"
+	"github.com/kr/pty"
 	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
 	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
 	"github.com/pkg/errors"
@@ -19,79 +19,197 @@ import (
 
 // reference: https://github.com/gorilla/websocket/blob/master/examples/echo/server.go
 
-// Consumer implements clui.Consumer for a websocket-based interface.
-// It is expected to be used in real-world scenarios.
+// writeWait bounds the time a single websocket write may take, a client that
+// cannot keep up is detached
+const writeWait = 10 * time.Second
+
+// ioQueueSize bounds the number of output writes queued for an io websocket,
+// a client that falls further behind is detached and has to reattach
+const ioQueueSize = 256
+
+// Consumer implements clui.Consumer for a single websocket session, it owns
+// the io, completer and control websockets of one client. Consumers are
+// created and served by Server.
+//
+// The session outlives its websockets, tmux-style: while no io websocket is
+// attached the shell keeps running and its output is kept in a bounded
+// scrollback, which is replayed when a client attaches again with the
+// session token. Attaching replaces any connection that is still attached.
 type Consumer struct {
 
-	// BindIP indicates the ip for the websokcet listener to bind to,
-	// defaults to 0.0.0.0
-	BindIP string
+	// ID identifies the session this Consumer belongs to
+	ID string
 
-	// Port indicates the port to be listening for websocket connection.
-	Port int
+	// token must be presented to attach to the session
+	token string
 
-	// IOPath indicates the url path for exposing websocket for IO,
-	// defaults to /io if not set.
-	IOPath string
+	// ioMut guards ioConn, ioQueue, ioChanged, scrollback and detachedAt
+	ioMut sync.Mutex
 
-	// CompleterPath indicates the url path for exposing websocket for completer,
-	// defaults to /completer if not set
-	CompleterPath string
+	ioConn *websocket.Conn
 
-	mux *http.ServeMux
+	// ioQueue holds the output waiting to be written to ioConn by writeIO, so
+	// that a slow client never blocks the shell
+	ioQueue chan []byte
 
-	ser *http.Server
+	// ioChanged is closed and replaced whenever ioConn changes
+	ioChanged chan struct{}
 
-	ioConn *websocket.Conn
+	scrollback *ringBuffer
 
-	completerConn *websocket.Conn
+	// detachedAt is the time the last io websocket went away, it is zero
+	// while one is attached
+	detachedAt time.Time
+
+	// ioReaderConn is the connection ioConnReader belongs to, both are only
+	// used by Read
+	ioReaderConn *websocket.Conn
+	ioConnReader io.Reader
 
+	// completerMut guards completerConn and lastCompletion, and serialises
+	// writes to completerConn
 	completerMut sync.Mutex
 
-	ioMut sync.RWMutex
+	completerConn *websocket.Conn
 
-	upgrader websocket.Upgrader
+	// lastCompletion is resent to a reattached completer, with the follow-ups
+	// received since applied to it
+	lastCompletion *protoclui.CompletionInfo
 
-	ioReadWait  chan struct{}
-	ioWriteWait chan struct{}
+	// closed is closed when the session is destroyed
+	closed    chan struct{}
+	closeOnce sync.Once
 
-	ioConnReader io.Reader
+	upgrader *websocket.Upgrader
+
+	winsizeChan chan pty.Winsize
+	acceptChan  chan *protoclui.AcceptCompletion
 }
 
-// Read implements io.Reader for terminal io
-func (c *Consumer) Read(p []byte) (n int, err error) {
-	c.ioMut.RLock()
-	if c.ioConn == nil {
-		// wait for an connection
-		<-c.ioReadWait
-		if c.ioConn == nil {
-			// if this assertion failed, next steps will be a null pointer panic anyway, so we do the panic ourselves
-			logrus.Panic("fatal: assert failed: c.ioConn must be populated when c.ioReadWait is received, terminating program.")
-			return 0, errors.New("fatal: assert failed: c.ioConn is still nil")
+func newConsumer(id string, token string, scrollbackSize int, upgrader *websocket.Upgrader) *Consumer {
+	return &Consumer{
+		ID:          id,
+		token:       token,
+		ioChanged:   make(chan struct{}),
+		scrollback:  newRingBuffer(scrollbackSize),
+		detachedAt:  time.Now(),
+		closed:      make(chan struct{}),
+		upgrader:    upgrader,
+		winsizeChan: make(chan pty.Winsize),
+		acceptChan:  make(chan *protoclui.AcceptCompletion),
+	}
+}
+
+// checkToken reports whether r presents the session token in its token query
+// parameter
+func (c *Consumer) checkToken(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(c.token)) == 1
+}
+
+// detachedSince returns the time the session has been detached since, ok is
+// false if an io websocket is attached
+func (c *Consumer) detachedSince() (t time.Time, ok bool) {
+	c.ioMut.Lock()
+	defer c.ioMut.Unlock()
+
+	return c.detachedAt, c.ioConn == nil
+}
+
+// currentIO returns the attached io websocket, waiting for one if the session
+// is detached. It returns an error if the session is destroyed first.
+func (c *Consumer) currentIO() (*websocket.Conn, error) {
+	for {
+		c.ioMut.Lock()
+		conn, changed := c.ioConn, c.ioChanged
+		c.ioMut.Unlock()
+
+		if conn != nil {
+			return conn, nil
 		}
+
+		select {
+		case <-changed:
+		case <-c.closed:
+			return nil, errors.New("ws consumer: session closed")
+		}
+	}
+}
+
+// setIOLocked replaces the attached io websocket along with its writer,
+// c.ioMut must be held
+func (c *Consumer) setIOLocked(conn *websocket.Conn) {
+	if c.ioQueue != nil {
+		close(c.ioQueue)
+		c.ioQueue = nil
+	}
+	c.ioConn = conn
+	if conn == nil {
+		c.detachedAt = time.Now()
+	} else {
+		c.detachedAt = time.Time{}
+		c.ioQueue = make(chan []byte, ioQueueSize)
+		go c.writeIO(conn, c.ioQueue)
+	}
+	close(c.ioChanged)
+	c.ioChanged = make(chan struct{})
+}
+
+// detachIO detaches conn if it is still the attached io websocket
+func (c *Consumer) detachIO(conn *websocket.Conn, reason error) {
+	c.ioMut.Lock()
+	if c.ioConn == conn {
+		logrus.Infof("session %s: io: detaching %s: %v", c.ID, conn.RemoteAddr(), reason)
+		c.setIOLocked(nil)
 	}
-	c.ioMut.RUnlock()
+	c.ioMut.Unlock()
+
+	if err := conn.Close(); err != nil {
+		logrus.Debug(errors.Wrap(err, "cannot close io conn"))
+	}
+}
+
+// writeIO writes the output queued for conn until the queue is closed
+func (c *Consumer) writeIO(conn *websocket.Conn, queue chan []byte) {
+	for p := range queue {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+			c.detachIO(conn, err)
+			return
+		}
+	}
+}
+
+// Read implements io.Reader for terminal io, it keeps blocking across detaches
+// until the session is destroyed
+func (c *Consumer) Read(p []byte) (n int, err error) {
 
 	// reference on converting ReadMessage into Read
 	// https://github.com/gorilla/websocket/issues/282
 
 	for {
 		if c.ioConnReader == nil {
-			// Advance to next message.
-			var err error
+			conn, err := c.currentIO()
+			if err != nil {
+				return 0, err
+			}
 
-			var mt int
-			mt, c.ioConnReader, err = c.ioConn.NextReader()
+			// Advance to next message.
+			mt, r, err := conn.NextReader()
 			if err != nil {
-				return 0, errors.Wrap(err, "ws consumer read: ")
+				c.detachIO(conn, err)
+				continue
 			}
 			if mt != websocket.BinaryMessage {
 				logrus.Infof("assert failed: mt must be BinaryMessage, got %d instead", mt)
 			}
+			c.ioReaderConn, c.ioConnReader = conn, r
 
 		}
 		n, err := c.ioConnReader.Read(p)
-		if err == io.EOF {
+		if err != nil {
+			if err != io.EOF {
+				c.detachIO(c.ioReaderConn, err)
+			}
 			// At end of message.
 			c.ioConnReader = nil
 			if n > 0 {
@@ -101,188 +219,262 @@ func (c *Consumer) Read(p []byte) (n int, err error) {
 				continue
 			}
 		}
-		return n, errors.Wrap(err, "ws consumer read: cannot read message: ")
+		return n, nil
 	}
 
 }
 
-// Write implements io.Writer for terminal io
+// Write implements io.Writer for terminal io, output is kept in the scrollback
+// and also sent to the io websocket if one is attached
 func (c *Consumer) Write(p []byte) (n int, err error) {
-	c.ioMut.RLock()
-	if c.ioConn == nil {
-		// wait for an connection
-		<-c.ioWriteWait
-		if c.ioConn == nil {
-			logrus.Panic("fatal: assert failed: c.ioConn must be populated when c.ioWriteWait is received, terminating program.")
-			return 0, errors.New("fatal: assert failed: c.ioConn is still nil")
-		}
+	select {
+	case <-c.closed:
+		return 0, errors.New("ws consumer: session closed")
+	default:
 	}
-	c.ioMut.RUnlock()
 
-	err = c.ioConn.WriteMessage(websocket.BinaryMessage, p)
-	if err != nil {
-		return 0, err
+	c.ioMut.Lock()
+	defer c.ioMut.Unlock()
+
+	c.scrollback.Write(p)
+
+	if conn := c.ioConn; conn != nil {
+		select {
+		case c.ioQueue <- append([]byte(nil), p...):
+		default:
+			logrus.Infof("session %s: io: detaching %s: too far behind", c.ID, conn.RemoteAddr())
+			c.setIOLocked(nil)
+			conn.Close()
+		}
 	}
 	return len(p), nil
 }
 
-// Init initiates the Consumer for consumption, it must be called before calling
-// clui.Connect
-func (c *Consumer) Init() (err error) {
-	if c.BindIP == "" {
-		c.BindIP = "0.0.0.0"
-	}
-	if c.IOPath == "" {
-		c.IOPath = "/io"
-	}
-	if c.CompleterPath == "" {
-		c.CompleterPath = "/completer"
+func (c *Consumer) handleCompleter(w http.ResponseWriter, r *http.Request) {
+
+	if !c.checkToken(r) {
+		logrus.Infof("session %s: completer: rejected attach with bad token from %s", c.ID, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
 	}
-	if c.Port == 0 {
-		return errors.New("Port must be set")
+
+	conn, err := c.upgrader.Upgrade(w, r, nil)
+
+	if err != nil {
+		logrus.Infof("unable to upgrade websocket connection: %v", errors.Wrap(err, "completer ws upgrade"))
+		return
 	}
 
-	c.mux = http.NewServeMux()
+	c.completerMut.Lock()
+
+	old := c.completerConn
+	c.completerConn = conn
 
-	c.mux.HandleFunc(c.CompleterPath, c.handleCompleter)
-	c.mux.HandleFunc(c.IOPath, c.handleIO)
+	// resume where the previous completer left off
+	if c.lastCompletion != nil {
+		rb, err := proto.Marshal(c.lastCompletion)
+		if err != nil {
+			logrus.Error(errors.Wrap(err, "cannot marshal last completion info"))
+		} else {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.BinaryMessage, rb); err != nil {
+				logrus.Info(errors.Wrap(err, "cannot resend last completion info"))
+			}
+		}
+	}
 
-	c.ser = &http.Server{
-		Addr:    net.JoinHostPort(c.BindIP, strconv.Itoa(c.Port)),
-		Handler: c.mux,
+	c.completerMut.Unlock()
+
+	if old != nil {
+		logrus.Infof("session %s: completer: %s takes over from %s", c.ID, conn.RemoteAddr(), old.RemoteAddr())
+		old.Close()
 	}
 
+	// the completer stream is write-only, but the connection must still be
+	// read for control frames such as close to be processed
 	go func() {
-		if err := c.ser.ListenAndServe(); err != nil {
-			if err == http.ErrServerClosed {
-				logrus.Infof("ws consumer server closed or shutdown: %+v", errors.Wrap(err, "server shutdown or closed"))
-			} else {
-				logrus.Fatalf("ws consumer server cannot start: %+v", errors.Wrap(err, "server cannot start"))
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				c.resetCompleter(conn)
+				return
 			}
 		}
 	}()
 
-	return
-
 }
 
-func (c *Consumer) handleCompleter(w http.ResponseWriter, r *http.Request) {
-
-	// Prevent conflict when accessed by multiple clients simulatenously
-
-	c.completerMut.Lock()
-
-	defer c.completerMut.Unlock()
+func (c *Consumer) handleIO(w http.ResponseWriter, r *http.Request) {
 
-	if c.completerConn != nil {
-		// drop the connection if there are already a connection
-		logrus.Infof("non-first ws connection to completer attempted by %s", r.RemoteAddr)
-		w.WriteHeader(http.StatusConflict)
+	if !c.checkToken(r) {
+		logrus.Infof("session %s: io: rejected attach with bad token from %s", c.ID, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	conn, err := c.upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		logrus.Infof("unable to upgrade websocket connection: ", errors.Wrap(err, "completer ws upgrade"))
-		w.WriteHeader(http.StatusUpgradeRequired)
+		logrus.Infof("unable to upgrade websocket connection: %v", errors.Wrap(err, "io ws upgrade"))
 		return
 	}
 
-	c.completerConn = conn
+	c.ioMut.Lock()
 
-	conn.SetCloseHandler(func(code int, text string) error {
-		logrus.Infof("completer: received close message from %s", conn.RemoteAddr)
-		message := websocket.FormatCloseMessage(code, "")
-		c.completerConn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
-		c.resetCompleter()
-		return nil
-	})
+	old := c.ioConn
+	c.setIOLocked(conn)
 
-}
+	// queue the scrollback for replay before any live output, holding ioMut
+	// keeps Write from interleaving
+	if replay := replayable(c.scrollback.Bytes(), c.scrollback.Truncated()); len(replay) > 0 {
+		c.ioQueue <- replay
+	}
 
-func (c *Consumer) handleIO(w http.ResponseWriter, r *http.Request) {
+	c.ioMut.Unlock()
 
-	// Prevent conflict when accessed by multiple clients simulatenously
+	if old != nil {
+		logrus.Infof("session %s: io: %s takes over from %s", c.ID, conn.RemoteAddr(), old.RemoteAddr())
+		old.Close()
+	} else {
+		logrus.Infof("session %s: io: attached %s", c.ID, conn.RemoteAddr())
+	}
+}
 
-	c.ioMut.Lock()
+func (c *Consumer) handleControl(w http.ResponseWriter, r *http.Request) {
 
-	defer c.ioMut.Unlock()
+	// Unlike io and completer, control messages are stateless, so any number
+	// of control connections are accepted
 
-	if c.ioConn != nil {
-		// drop the connection if there are already a connection
-		logrus.Infof("non-first ws connection to io attempted by %s", r.RemoteAddr)
-		w.WriteHeader(http.StatusConflict)
+	if !c.checkToken(r) {
+		logrus.Infof("session %s: control: rejected attach with bad token from %s", c.ID, r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
 	conn, err := c.upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		logrus.Infof("unable to upgrade websocket connection: ", errors.Wrap(err, "io ws upgrade"))
-		w.WriteHeader(http.StatusUpgradeRequired)
+		logrus.Infof("unable to upgrade websocket connection: %v", errors.Wrap(err, "control ws upgrade"))
 		return
 	}
 
-	c.ioConn = conn
+	defer func() {
+		if err := conn.Close(); err != nil {
+			logrus.Debug(errors.Wrap(err, "cannot close control conn"))
+		}
+	}()
 
-	conn.SetCloseHandler(func(code int, text string) error {
-		logrus.Infof("io: received close message from %s", conn.RemoteAddr)
-		message := websocket.FormatCloseMessage(code, "")
-		c.ioConn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
-		c.resetCompleter()
-		return nil
-	})
+	for {
+		mt, rm, err := conn.ReadMessage()
+		if err != nil {
+			logrus.Infof("session %s: control: connection from %s closed: %v", c.ID, conn.RemoteAddr(), err)
+			return
+		}
+		if mt != websocket.BinaryMessage {
+			logrus.Infof("assert failed: mt must be BinaryMessage, got %d instead", mt)
+			continue
+		}
 
-	c.ioReadWait <- struct{}{}
-	c.ioWriteWait <- struct{}{}
-}
+		cm := protoclui.ControlMessage{}
+		if err := proto.Unmarshal(rm, &cm); err != nil {
+			logrus.Info(errors.Wrap(err, "cannot unmarshal control message"))
+			continue
+		}
 
-func (c *Consumer) resetCompleter() {
+		switch m := cm.Message.(type) {
+		case *protoclui.ControlMessage_Resize:
+			select {
+			case c.winsizeChan <- pty.Winsize{
+				Rows: uint16(m.Resize.Rows),
+				Cols: uint16(m.Resize.Cols),
+				X:    uint16(m.Resize.X),
+				Y:    uint16(m.Resize.Y),
+			}:
+			case <-c.closed:
+				return
+			}
+		case *protoclui.ControlMessage_Accept:
+			select {
+			case c.acceptChan <- m.Accept:
+			case <-c.closed:
+				return
+			}
+		default:
+			logrus.Infof("session %s: control: ignoring unknown message from %s", c.ID, conn.RemoteAddr())
+		}
+	}
+}
 
-	// Here we need to deals with both graceful shutdown on close based on error
-	// handling, so we just remove the current connection to allow another client
-	// to connect
+// resetCompleter detaches conn if it is still the attached completer, so that
+// completions are dropped until a client attaches again
+func (c *Consumer) resetCompleter(conn *websocket.Conn) {
 
 	c.completerMut.Lock()
 
 	defer c.completerMut.Unlock()
 
-	logrus.Infof("completer: resetting connection from %s", c.completerConn.RemoteAddr)
+	if c.completerConn != conn {
+		return
+	}
+
+	logrus.Infof("session %s: completer: resetting connection from %s", c.ID, conn.RemoteAddr())
 
 	c.completerConn = nil
+	conn.Close()
 }
-func (c *Consumer) resetIO() {
-
-	// Here we need to deals with both graceful shutdown on close based on error
-	// handling, so we just remove the current connection to allow another client
-	// to connect
-
-	c.ioMut.Lock()
 
-	defer c.ioMut.Unlock()
+// close closes all connections of the session, pending Read and Write calls
+// return an error afterwards
+func (c *Consumer) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
 
-	logrus.Infof("io: resetting connection from %s", c.ioConn.RemoteAddr)
+		c.ioMut.Lock()
+		if conn := c.ioConn; conn != nil {
+			c.setIOLocked(nil)
+			conn.Close()
+		}
+		c.ioMut.Unlock()
 
-	c.ioConn = nil
+		c.completerMut.Lock()
+		if c.completerConn != nil {
+			c.completerConn.Close()
+		}
+		c.completerMut.Unlock()
+	})
 }
 
 // Handle implements the clui.CompletionInfoHandler interface
 func (c *Consumer) Handle(ci *protoclui.CompletionInfo) {
 	logrus.Trace("handling completion info")
-	if c.completerConn == nil {
-		logrus.Info("assert failed: c.completerConn should be non-nil when handling a completion")
-		return
-	}
+
 	rb, err := proto.Marshal(ci)
 	if err != nil {
 		logrus.Error(errors.Wrap(err, "cannot marshal completion info"))
 		return
 	}
-	err = c.completerConn.WriteMessage(websocket.BinaryMessage, rb)
+
+	// gorilla websocket connections support only one concurrent writer
+	c.completerMut.Lock()
+	defer c.completerMut.Unlock()
+
+	if clui.IsFollowUp(ci) {
+		clui.ApplyFollowUp(c.lastCompletion, ci)
+	} else {
+		c.lastCompletion = proto.Clone(ci).(*protoclui.CompletionInfo)
+	}
+
+	conn := c.completerConn
+	if conn == nil {
+		logrus.Debugf("session %s: no completer attached, keeping completion info for reattach", c.ID)
+		return
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	err = conn.WriteMessage(websocket.BinaryMessage, rb)
 	if err != nil {
 		logrus.Error(errors.Wrap(err, "cannot write raw completion info, resetting completerConn"))
-		c.resetCompleter()
+		c.completerConn = nil
+		conn.Close()
 		return
 	}
 }
@@ -307,6 +499,18 @@ func (c *Consumer) CompOptHandler() clui.CompletionInfoHandler {
 	return c
 }
 
+// WinsizeChan implements the clui.Consumer interface, it receives resizes
+// sent over the control websocket
+func (c *Consumer) WinsizeChan() chan pty.Winsize {
+	return c.winsizeChan
+}
+
+// AcceptChan implements the clui.Consumer interface, it receives completion
+// entries accepted over the control websocket
+func (c *Consumer) AcceptChan() chan *protoclui.AcceptCompletion {
+	return c.acceptChan
+}
+
 // OnStart implements the clui.Consumer interface
 func (c *Consumer) OnStart() {
 }
@@ -0,0 +1,138 @@
+package wsconsumer
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// replayable prepares scrollback for replay to a newly attached client.
+//
+// If the scrollback is truncated it is cut at a safe boundary, after the first
+// newline if there is one, or else at the first escape sequence or rune, so
+// that the client never sees the tail of a sequence as text. Queries such as
+// DSR or DA are then removed, as the terminal would answer them as input to
+// whatever program is running now, long after the one asking has stopped
+// waiting. An incomplete sequence at the end is kept, the live output that
+// follows completes it.
+func replayable(b []byte, truncated bool) []byte {
+	if truncated {
+		b = safeStart(b)
+	}
+
+	res := make([]byte, 0, len(b))
+	for i := 0; i < len(b); {
+		// ENQ asks for the answerback message
+		if b[i] == 0x05 {
+			i++
+			continue
+		}
+		if b[i] != 0x1b {
+			res = append(res, b[i])
+			i++
+			continue
+		}
+		n, query := escapeSequence(b[i:])
+		if !query {
+			res = append(res, b[i:i+n]...)
+		}
+		i += n
+	}
+	return res
+}
+
+// safeStart returns b from its first safe boundary on
+func safeStart(b []byte) []byte {
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		return b[i+1:]
+	}
+	if i := bytes.IndexByte(b, 0x1b); i >= 0 {
+		return b[i:]
+	}
+	for len(b) > 0 && !utf8.RuneStart(b[0]) {
+		b = b[1:]
+	}
+	return b
+}
+
+// escapeSequence returns the length of the escape sequence b starts with and
+// whether it is a query the terminal would answer. An incomplete sequence
+// spans the rest of b.
+func escapeSequence(b []byte) (n int, query bool) {
+	if len(b) < 2 {
+		return len(b), false
+	}
+
+	switch b[1] {
+	case '[':
+		// CSI: parameters, intermediates, then a final byte
+		i := 2
+		for i < len(b) && b[i] >= 0x30 && b[i] <= 0x3f {
+			i++
+		}
+		params := b[2:i]
+		for i < len(b) && b[i] >= 0x20 && b[i] <= 0x2f {
+			i++
+		}
+		intermediates := b[2+len(params) : i]
+		if i == len(b) {
+			return len(b), false
+		}
+		return i + 1, csiQuery(params, intermediates, b[i])
+
+	case ']', 'P', '_', '^':
+		// OSC, DCS, APC and PM are strings terminated by ST, OSC also by BEL
+		for i := 2; i < len(b); i++ {
+			if b[i] == 0x07 && b[1] == ']' {
+				return i + 1, oscQuery(b[2:i])
+			}
+			if b[i] == 0x1b && i+1 < len(b) && b[i+1] == '\\' {
+				if b[1] == ']' {
+					return i + 2, oscQuery(b[2:i])
+				}
+				return i + 2, b[1] == 'P' && dcsQuery(b[2:i])
+			}
+		}
+		return len(b), false
+
+	case 'Z':
+		// DECID
+		return 2, true
+	}
+	return 2, false
+}
+
+// csiQuery reports whether a CSI sequence asks the terminal for a reply
+func csiQuery(params, intermediates []byte, final byte) bool {
+	switch final {
+	case 'n', 'c', 'x':
+		// DSR, DA and DECREQTPARM
+		return true
+	case 't':
+		// window operations, both reports and resizes of a window the
+		// client arranged for itself
+		return true
+	case 'p':
+		// DECRQM
+		return bytes.Equal(intermediates, []byte("$"))
+	case 'u':
+		// progressive keyboard enhancement flags query
+		return bytes.HasPrefix(params, []byte("?"))
+	}
+	return false
+}
+
+// oscQuery reports whether an OSC string asks for a value, such as the
+// colours queried by OSC 10;? or the clipboard by OSC 52;c;?
+func oscQuery(s []byte) bool {
+	for _, f := range bytes.Split(s, []byte(";")) {
+		if bytes.Equal(f, []byte("?")) {
+			return true
+		}
+	}
+	return false
+}
+
+// dcsQuery reports whether a DCS string is a request, DECRQSS or XTGETTCAP
+func dcsQuery(s []byte) bool {
+	return bytes.HasPrefix(s, []byte("$q")) || bytes.HasPrefix(s, []byte("+q"))
+}
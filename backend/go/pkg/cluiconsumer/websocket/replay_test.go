@@ -0,0 +1,43 @@
+package wsconsumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayable(t *testing.T) {
+	require := require.New(t)
+
+	// complete scrollback is replayed from its start
+	require.Equal("\x1b[31mred\x1b[0m\r\n$ ", string(replayable([]byte("\x1b[31mred\x1b[0m\r\n$ "), false)))
+
+	// truncated scrollback is cut after the first newline, dropping the tail
+	// of an escape sequence
+	require.Equal("$ ls\r\n", string(replayable([]byte("1mbold\x1b[0m\r\n$ ls\r\n"), true)))
+	// or at the first escape sequence
+	require.Equal("\x1b[1mbold", string(replayable([]byte("1mtext\x1b[1mbold"), true)))
+	// or at the first rune
+	require.Equal("é", string(replayable([]byte("\xa9é"), true)))
+
+	// queries are dropped, everything else is kept
+	for _, query := range []string{
+		"\x1b[6n", "\x1b[5n", "\x1b[?6n", "\x1b[c", "\x1b[>c", "\x1b[=c", "\x1b[0c",
+		"\x1b[14t", "\x1b[18t", "\x1b[?1049$p", "\x1b[?u", "\x1b[1x", "\x1bZ", "\x05",
+		"\x1b]11;?\x07", "\x1b]10;?\x1b\\", "\x1b]4;1;?\x07", "\x1b]52;c;?\x07",
+		"\x1bP$qm\x1b\\", "\x1bP+q544e\x1b\\",
+	} {
+		require.Equal("ab", string(replayable([]byte("a"+query+"b"), false)), "%q", query)
+	}
+	for _, kept := range []string{
+		"\x1b[31m", "\x1b[2J", "\x1b[?1049h", "\x1b[1;1H", "\x1b]0;title\x07",
+		"\x1b]8;;http://example.com\x1b\\", "\x1b(B", "\x1b7", "\x1b[>1u",
+	} {
+		require.Equal("a"+kept+"b", string(replayable([]byte("a"+kept+"b"), false)), "%q", kept)
+	}
+
+	// an incomplete sequence at the end is left for the live output
+	require.Equal("a\x1b[", string(replayable([]byte("a\x1b["), false)))
+	require.Equal("a\x1b]0;ti", string(replayable([]byte("a\x1b]0;ti"), false)))
+	require.Equal("a\x1b", string(replayable([]byte("a\x1b"), false)))
+}
@@ -0,0 +1,70 @@
+package wsconsumer
+
+// ringBuffer keeps the last size bytes written to it, it is used as the
+// scrollback of a session that is replayed on reattach. It is not safe for
+// concurrent use.
+type ringBuffer struct {
+	buf []byte
+	// start is the index of the oldest byte once the buffer is full
+	start int
+	full  bool
+	// truncated is set once bytes have been discarded
+	truncated bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, 0, size)}
+}
+
+// Write implements io.Writer, it never fails
+func (r *ringBuffer) Write(p []byte) (n int, err error) {
+	n = len(p)
+	size := cap(r.buf)
+	if size == 0 {
+		return
+	}
+
+	if len(r.buf)+len(p) > size {
+		r.truncated = true
+	}
+
+	// only the tail of p can survive
+	if len(p) >= size {
+		r.buf = r.buf[:size]
+		copy(r.buf, p[len(p)-size:])
+		r.start = 0
+		r.full = true
+		return
+	}
+
+	if !r.full {
+		free := size - len(r.buf)
+		if len(p) <= free {
+			r.buf = append(r.buf, p...)
+			return
+		}
+		r.buf = append(r.buf, p[:free]...)
+		p = p[free:]
+		r.full = true
+	}
+
+	for len(p) > 0 {
+		c := copy(r.buf[r.start:], p)
+		p = p[c:]
+		r.start = (r.start + c) % size
+	}
+	return
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first
+func (r *ringBuffer) Bytes() []byte {
+	res := make([]byte, 0, len(r.buf))
+	res = append(res, r.buf[r.start:]...)
+	return append(res, r.buf[:r.start]...)
+}
+
+// Truncated reports whether older bytes have been discarded, in which case
+// Bytes may begin in the middle of an escape sequence or a UTF-8 rune
+func (r *ringBuffer) Truncated() bool {
+	return r.truncated
+}
@@ -0,0 +1,34 @@
+package wsconsumer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingBuffer(t *testing.T) {
+	require := require.New(t)
+
+	r := newRingBuffer(8)
+	require.Equal([]byte{}, r.Bytes())
+
+	r.Write([]byte("abc"))
+	require.Equal([]byte("abc"), r.Bytes())
+	require.False(r.Truncated())
+
+	// wrapping around keeps the newest bytes in order
+	r.Write([]byte("defgh"))
+	require.Equal([]byte("abcdefgh"), r.Bytes())
+	require.False(r.Truncated())
+	r.Write([]byte("ij"))
+	require.Equal([]byte("cdefghij"), r.Bytes())
+	require.True(r.Truncated())
+	r.Write([]byte("klmnop"))
+	require.Equal([]byte("ijklmnop"), r.Bytes())
+
+	// a write larger than the buffer only keeps its tail
+	n, err := r.Write([]byte("0123456789"))
+	require.Nil(err)
+	require.Equal(10, n)
+	require.Equal([]byte("23456789"), r.Bytes())
+}
@@ -0,0 +1,517 @@
+package wsconsumer
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Server serves any number of sessions over websocket, each session is a
+// Consumer connected to its own Provider, so every client gets its own shell
+// and completer stream.
+//
+// Sessions are managed through SessionsPath:
+//
+//	POST   /sessions                 creates a session and returns its id and token
+//	GET    /sessions                 lists all sessions
+//	DELETE /sessions/<id>            destroys a session and its shell
+//	GET    /sessions/<id>/io         websocket for terminal io
+//	GET    /sessions/<id>/completer  websocket for completion info
+//	GET    /sessions/<id>/control    websocket for control messages
+//
+// The websockets require the session token returned on creation as the token
+// query parameter. A session survives its websockets closing and can be
+// attached to again with the same token.
+//
+// At most MaxSessions sessions exist at once, creating another one is
+// answered with 503 Service Unavailable until a session is destroyed.
+//
+// If Auth or Tokens is set, every request must also be authenticated, see
+// Authenticator for how credentials are presented. Short-lived tokens are
+// issued through TokensPath:
+//
+//	POST   /tokens                   issues a signed token, requires Auth
+type Server struct {
+
+	// BindIP indicates the ip for the websokcet listener to bind to,
+	// defaults to 0.0.0.0
+	BindIP string
+
+	// Port indicates the port to be listening for websocket connection.
+	Port int
+
+	// SessionsPath indicates the url path under which sessions are managed
+	// and exposed, defaults to /sessions if not set
+	SessionsPath string
+
+	// NewProvider returns the Provider backing a new session, it is called
+	// once for every session created
+	NewProvider func() clui.Provider
+
+	// ScrollbackSize indicates the number of bytes of output kept for replay
+	// while a session is detached, defaults to 64KiB if not set
+	ScrollbackSize int
+
+	// DetachTimeout indicates how long a session may stay detached before it
+	// is destroyed, sessions are kept forever if not set
+	DetachTimeout time.Duration
+
+	// MaxSessions indicates the number of sessions that may exist at once,
+	// creating more is refused, defaults to 16 if not set
+	MaxSessions int
+
+	// Auth authenticates every request, including token issuance
+	Auth Authenticator
+
+	// Tokens issues short-lived tokens to requests accepted by Auth, which
+	// are then accepted on every path but TokensPath
+	Tokens *SignedTokens
+
+	// TokensPath indicates the url path for issuing tokens, defaults to
+	// /tokens if not set
+	TokensPath string
+
+	// TLSCertFile and TLSKeyFile are the paths of the PEM encoded certificate
+	// chain and private key to serve with, the server serves plaintext if
+	// they are not set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientCAFile is the path of the PEM encoded CA certificates that
+	// client certificates must be signed by, setting it enables mutual TLS
+	TLSClientCAFile string
+
+	mux *http.ServeMux
+
+	ser *http.Server
+
+	upgrader websocket.Upgrader
+
+	sessionsMut sync.RWMutex
+
+	sessions map[string]*session
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// errTooManySessions is returned by createSession when MaxSessions is reached
+var errTooManySessions = errors.New("too many sessions")
+
+type session struct {
+	consumer *Consumer
+	provider clui.Provider
+	created  time.Time
+}
+
+// SessionInfo describes a session in the responses of the sessions api
+type SessionInfo struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	// Attached reports whether an io websocket is attached to the session
+	Attached bool `json:"attached"`
+	// Token is only returned when the session is created
+	Token string `json:"token,omitempty"`
+}
+
+// TokenInfo is the response of token issuance
+type TokenInfo struct {
+	Token  string    `json:"token"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// Init initiates the Server, it must be called before calling ListenAndServe
+func (s *Server) Init() (err error) {
+	if s.BindIP == "" {
+		s.BindIP = "0.0.0.0"
+	}
+	if s.SessionsPath == "" {
+		s.SessionsPath = "/sessions"
+	}
+	s.SessionsPath = strings.TrimSuffix(s.SessionsPath, "/")
+	if s.Port == 0 {
+		return errors.New("Port must be set")
+	}
+	if s.NewProvider == nil {
+		return errors.New("NewProvider must be set")
+	}
+	if s.ScrollbackSize == 0 {
+		s.ScrollbackSize = 64 * 1024
+	}
+	if s.MaxSessions == 0 {
+		s.MaxSessions = 16
+	}
+	if s.TokensPath == "" {
+		s.TokensPath = "/tokens"
+	}
+	if s.Auth == nil && s.Tokens == nil {
+		logrus.Warn("ws server: no authentication configured, anyone who can reach the port gets a shell")
+	}
+	if s.Auth == nil && s.Tokens != nil {
+		return errors.New("Auth must be set to issue Tokens")
+	}
+
+	s.sessions = make(map[string]*session)
+	s.closed = make(chan struct{})
+
+	if s.DetachTimeout > 0 {
+		go s.reapDetached()
+	}
+
+	s.mux = http.NewServeMux()
+
+	s.mux.HandleFunc(s.SessionsPath, s.handleSessions)
+	s.mux.HandleFunc(s.SessionsPath+"/", s.handleSession)
+	if s.Tokens != nil {
+		s.mux.HandleFunc(s.TokensPath, s.handleTokens)
+	}
+
+	s.ser = &http.Server{
+		Addr:    net.JoinHostPort(s.BindIP, strconv.Itoa(s.Port)),
+		Handler: http.HandlerFunc(s.authenticate),
+	}
+
+	if s.ser.TLSConfig, err = s.tlsConfig(); err != nil {
+		return errors.Wrap(err, "cannot configure tls")
+	}
+
+	return
+}
+
+// tlsConfig returns the tls.Config described by the TLS fields, or nil if TLS
+// is not enabled
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	if s.TLSCertFile == "" && s.TLSKeyFile == "" {
+		if s.TLSClientCAFile != "" {
+			return nil, errors.New("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+		}
+		return nil, nil
+	}
+	if s.TLSCertFile == "" || s.TLSKeyFile == "" {
+		return nil, errors.New("TLSCertFile and TLSKeyFile must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot load server certificate")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(s.TLSClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read client ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in client ca")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// ListenAndServe starts serving sessions on BindIP and Port, it blocks until
+// the server is closed
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.ser.Addr)
+	if err != nil {
+		return errors.Wrap(err, "ws server cannot listen")
+	}
+	return s.Serve(l)
+}
+
+// Serve starts serving sessions on l, over TLS if it is configured, it blocks
+// until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	var err error
+	if s.ser.TLSConfig != nil {
+		// certificates are already loaded into TLSConfig
+		err = s.ser.ServeTLS(l, "", "")
+	} else {
+		err = s.ser.Serve(l)
+	}
+	if err != nil {
+		if err == http.ErrServerClosed {
+			logrus.Infof("ws server closed or shutdown: %+v", errors.Wrap(err, "server shutdown or closed"))
+			return nil
+		}
+		return errors.Wrap(err, "ws server cannot start")
+	}
+	return nil
+}
+
+// Close destroys all sessions and stops the server
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+
+	s.sessionsMut.RLock()
+	ids := make([]string, 0, len(s.sessions))
+	for id := range s.sessions {
+		ids = append(ids, id)
+	}
+	s.sessionsMut.RUnlock()
+
+	for _, id := range ids {
+		s.destroySession(id)
+	}
+	return errors.Wrap(s.ser.Close(), "cannot close ws server")
+}
+
+// authenticate rejects unauthenticated requests before they reach the mux,
+// the websocket upgrades included
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) {
+	if s.Auth == nil && s.Tokens == nil {
+		s.mux.ServeHTTP(w, r)
+		return
+	}
+
+	var auth Authenticator = s.Auth
+	if s.Tokens != nil && r.URL.Path != s.TokensPath {
+		// a token must not be able to renew itself
+		auth = AnyAuthenticator{s.Auth, s.Tokens}
+	}
+
+	if err := auth.Authenticate(r); err != nil {
+		logrus.Warnf("ws server: rejected %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleTokens issues short-lived tokens
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token, expiry, err := s.Tokens.Issue()
+	if err != nil {
+		logrus.Error(errors.Wrap(err, "cannot issue token"))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusCreated, TokenInfo{Token: token, Expiry: expiry})
+}
+
+// handleSessions serves the collection of sessions
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.listSessions())
+	case http.MethodPost:
+		info, err := s.createSession()
+		if err == errTooManySessions {
+			logrus.Infof("ws server: refused session for %s: %d sessions exist", r.RemoteAddr, s.MaxSessions)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			logrus.Error(errors.Wrap(err, "cannot create session"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logrus.Infof("session %s: created by %s", info.ID, r.RemoteAddr)
+		writeJSON(w, http.StatusCreated, info)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSession serves a single session and its websockets
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+
+	// the path is either <SessionsPath>/<id> or <SessionsPath>/<id>/<stream>
+	rest := strings.TrimPrefix(r.URL.Path, s.SessionsPath+"/")
+	parts := strings.SplitN(rest, "/", 2)
+	id := parts[0]
+
+	s.sessionsMut.RLock()
+	sess, ok := s.sessions[id]
+	s.sessionsMut.RUnlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, sess.info())
+		case http.MethodDelete:
+			s.destroySession(id)
+			logrus.Infof("session %s: destroyed by %s", id, r.RemoteAddr)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	switch parts[1] {
+	case "io":
+		sess.consumer.handleIO(w, r)
+	case "completer":
+		sess.consumer.handleCompleter(w, r)
+	case "control":
+		sess.consumer.handleControl(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// createSession creates a session and starts its provider in the background,
+// the session is removed once the provider exits
+func (s *Server) createSession() (info SessionInfo, err error) {
+
+	id, err := newRandomHex()
+	if err != nil {
+		return
+	}
+	token, err := newRandomHex()
+	if err != nil {
+		return
+	}
+
+	sess := &session{
+		consumer: newConsumer(id, token, s.ScrollbackSize, &s.upgrader),
+		provider: s.NewProvider(),
+		created:  time.Now(),
+	}
+
+	s.sessionsMut.Lock()
+	if len(s.sessions) >= s.MaxSessions {
+		s.sessionsMut.Unlock()
+		return info, errTooManySessions
+	}
+	s.sessions[id] = sess
+	s.sessionsMut.Unlock()
+
+	go func() {
+		if err := clui.Connect(sess.provider, sess.consumer); err != nil {
+			logrus.Infof("session %s: provider exited: %+v", id, err)
+		}
+		s.removeSession(id)
+		sess.consumer.close()
+	}()
+
+	info = sess.info()
+	info.Token = token
+	return info, nil
+}
+
+// destroySession stops the provider of a session and closes its connections
+func (s *Server) destroySession(id string) {
+	sess := s.removeSession(id)
+	if sess == nil {
+		return
+	}
+	if err := sess.provider.Stop(); err != nil {
+		logrus.Errorf("session %s: cannot stop provider: %+v", id, err)
+	}
+	sess.consumer.close()
+}
+
+// removeSession removes a session from the server without stopping it, it
+// returns nil if there is no such session
+func (s *Server) removeSession(id string) *session {
+	s.sessionsMut.Lock()
+	defer s.sessionsMut.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	delete(s.sessions, id)
+	return sess
+}
+
+func (s *Server) listSessions() []SessionInfo {
+	s.sessionsMut.RLock()
+	defer s.sessionsMut.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		infos = append(infos, sess.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.Before(infos[j].Created)
+	})
+	return infos
+}
+
+// reapDetached destroys sessions that have been detached for longer than
+// DetachTimeout, until the server is closed
+func (s *Server) reapDetached() {
+	ticker := time.NewTicker(s.DetachTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closed:
+			return
+		}
+
+		var expired []string
+		s.sessionsMut.RLock()
+		for id, sess := range s.sessions {
+			if since, detached := sess.consumer.detachedSince(); detached && time.Since(since) > s.DetachTimeout {
+				expired = append(expired, id)
+			}
+		}
+		s.sessionsMut.RUnlock()
+
+		for _, id := range expired {
+			logrus.Infof("session %s: destroyed after being detached for %s", id, s.DetachTimeout)
+			s.destroySession(id)
+		}
+	}
+}
+
+func (sess *session) info() SessionInfo {
+	_, detached := sess.consumer.detachedSince()
+	return SessionInfo{ID: sess.consumer.ID, Created: sess.created, Attached: !detached}
+}
+
+func newRandomHex() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "cannot generate random id")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.Debug(errors.Wrap(err, "cannot write json response"))
+	}
+}
@@ -0,0 +1,317 @@
+package wsconsumer
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"github.com/kr/pty"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/stretchr/testify/require"
+)
+
+// echoProvider is a clui.Provider that echoes its input back
+type echoProvider struct {
+	input  io.Reader
+	output io.Writer
+	stop   chan struct{}
+}
+
+func newEchoProvider() clui.Provider {
+	return &echoProvider{stop: make(chan struct{})}
+}
+
+func (p *echoProvider) SetDir(string)                                  {}
+func (p *echoProvider) SetInput(r io.Reader)                           { p.input = r }
+func (p *echoProvider) SetOutput(w io.Writer)                          { p.output = w }
+func (p *echoProvider) SetCompOptHandler(clui.CompletionInfoHandler)   {}
+func (p *echoProvider) SetWinsizeChan(chan pty.Winsize)                {}
+func (p *echoProvider) SetAcceptChan(chan *protoclui.AcceptCompletion) {}
+
+func (p *echoProvider) Start() error {
+	go io.Copy(p.output, p.input)
+	<-p.stop
+	return nil
+}
+
+func (p *echoProvider) Stop() error {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	return nil
+}
+
+func TestSessionReattach(t *testing.T) {
+	require := require.New(t)
+
+	var provider *echoProvider
+	s := &Server{
+		Port:           8080,
+		ScrollbackSize: 8,
+		NewProvider: func() clui.Provider {
+			provider = newEchoProvider().(*echoProvider)
+			return provider
+		},
+	}
+	require.Nil(s.Init())
+	ts := httptest.NewServer(s.ser.Handler)
+	defer ts.Close()
+	defer s.Close()
+
+	resp, err := http.Post(ts.URL+"/sessions", "", nil)
+	require.Nil(err)
+	require.Equal(http.StatusCreated, resp.StatusCode)
+	var info SessionInfo
+	require.Nil(json.NewDecoder(resp.Body).Decode(&info))
+	require.NotEmpty(info.Token)
+
+	ioURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/sessions/" + info.ID + "/io?token="
+
+	_, resp, err = websocket.DefaultDialer.Dial(ioURL+"wrong", nil)
+	require.NotNil(err)
+	require.Equal(http.StatusForbidden, resp.StatusCode)
+
+	conn, _, err := websocket.DefaultDialer.Dial(ioURL+info.Token, nil)
+	require.Nil(err)
+	require.Nil(conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	_, m, err := conn.ReadMessage()
+	require.Nil(err)
+	require.Equal("hello", string(m))
+	conn.Close()
+
+	// output produced while detached is replayed, bounded by the scrollback
+	_, err = provider.output.Write([]byte("detached"))
+	require.Nil(err)
+
+	conn, _, err = websocket.DefaultDialer.Dial(ioURL+info.Token, nil)
+	require.Nil(err)
+	defer conn.Close()
+	_, m, err = conn.ReadMessage()
+	require.Nil(err)
+	require.Equal("detached", string(m))
+
+	// and the session is live again
+	require.Nil(conn.WriteMessage(websocket.BinaryMessage, []byte("again")))
+	_, m, err = conn.ReadMessage()
+	require.Nil(err)
+	require.Equal("again", string(m))
+
+	resp, err = http.Get(ts.URL + "/sessions")
+	require.Nil(err)
+	var infos []SessionInfo
+	require.Nil(json.NewDecoder(resp.Body).Decode(&infos))
+	require.Len(infos, 1)
+	require.True(infos[0].Attached)
+	require.Empty(infos[0].Token)
+}
+
+func TestSessions(t *testing.T) {
+	require := require.New(t)
+
+	var providers []*echoProvider
+	s := &Server{
+		Port:        8080,
+		MaxSessions: 2,
+		NewProvider: func() clui.Provider {
+			p := newEchoProvider().(*echoProvider)
+			providers = append(providers, p)
+			return p
+		},
+	}
+	require.Nil(s.Init())
+	ts := httptest.NewServer(s.ser.Handler)
+	defer ts.Close()
+	defer s.Close()
+
+	create := func() (SessionInfo, int) {
+		resp, err := http.Post(ts.URL+"/sessions", "", nil)
+		require.Nil(err)
+		defer resp.Body.Close()
+		var info SessionInfo
+		if resp.StatusCode == http.StatusCreated {
+			require.Nil(json.NewDecoder(resp.Body).Decode(&info))
+		}
+		return info, resp.StatusCode
+	}
+	list := func() []SessionInfo {
+		resp, err := http.Get(ts.URL + "/sessions")
+		require.Nil(err)
+		defer resp.Body.Close()
+		var infos []SessionInfo
+		require.Nil(json.NewDecoder(resp.Body).Decode(&infos))
+		return infos
+	}
+	do := func(method, path string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		require.Nil(err)
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(err)
+		return resp
+	}
+
+	require.Empty(list())
+
+	first, status := create()
+	require.Equal(http.StatusCreated, status)
+	second, status := create()
+	require.Equal(http.StatusCreated, status)
+	require.NotEqual(first.ID, second.ID)
+	require.NotEqual(first.Token, second.Token)
+
+	// creating beyond MaxSessions is refused
+	_, status = create()
+	require.Equal(http.StatusServiceUnavailable, status)
+
+	infos := list()
+	require.Len(infos, 2)
+	require.Equal(first.ID, infos[0].ID)
+	require.Equal(second.ID, infos[1].ID)
+	require.False(infos[0].Attached)
+
+	resp := do(http.MethodGet, "/sessions/"+first.ID)
+	var info SessionInfo
+	require.Nil(json.NewDecoder(resp.Body).Decode(&info))
+	resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal(first.ID, info.ID)
+	require.Empty(info.Token)
+
+	// unknown sessions, streams and methods
+	require.Equal(http.StatusNotFound, do(http.MethodGet, "/sessions/nosuchsession").StatusCode)
+	require.Equal(http.StatusNotFound, do(http.MethodGet, "/sessions/nosuchsession/io").StatusCode)
+	require.Equal(http.StatusNotFound, do(http.MethodGet, "/sessions/"+first.ID+"/nosuchstream").StatusCode)
+	require.Equal(http.StatusMethodNotAllowed, do(http.MethodPut, "/sessions").StatusCode)
+	require.Equal(http.StatusMethodNotAllowed, do(http.MethodPost, "/sessions/"+first.ID).StatusCode)
+
+	// each session is routed to its own provider
+	for i, sess := range []SessionInfo{first, second} {
+		url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/sessions/" + sess.ID + "/io?token=" + sess.Token
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.Nil(err)
+		_, err = providers[i].output.Write([]byte(sess.ID))
+		require.Nil(err)
+		_, m, err := conn.ReadMessage()
+		require.Nil(err)
+		require.Equal(sess.ID, string(m))
+		conn.Close()
+	}
+
+	// the token of one session does not attach to another
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/sessions/" + first.ID + "/io?token=" + second.Token
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NotNil(err)
+	require.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// destroying a session stops its provider and frees its slot
+	require.Equal(http.StatusNoContent, do(http.MethodDelete, "/sessions/"+first.ID).StatusCode)
+	select {
+	case <-providers[0].stop:
+	case <-time.After(5 * time.Second):
+		require.Fail("provider was not stopped")
+	}
+	require.Equal(http.StatusNotFound, do(http.MethodDelete, "/sessions/"+first.ID).StatusCode)
+	infos = list()
+	require.Len(infos, 1)
+	require.Equal(second.ID, infos[0].ID)
+
+	_, status = create()
+	require.Equal(http.StatusCreated, status)
+}
+
+func TestFollowUpReplay(t *testing.T) {
+	require := require.New(t)
+
+	c := newConsumer("id", "token", 16, &websocket.Upgrader{})
+	ci := &protoclui.CompletionInfo{
+		RequestId: 7,
+		Entries:   []*protoclui.CompletionEntry{{Suggestion: "ls"}, {Suggestion: "lsblk"}},
+	}
+	c.Handle(ci)
+	c.Handle(&protoclui.CompletionInfo{
+		RequestId:        7,
+		Sequence:         1,
+		LateDescriptions: []*protoclui.EntryDescription{{EntryIndex: 1, Description: "list block devices"}},
+	})
+
+	// a reattached completer gets the entries along with the late descriptions,
+	// without the handled CompletionInfo being changed behind the caller's back
+	require.Equal("", c.lastCompletion.Entries[0].Description)
+	require.Equal("list block devices", c.lastCompletion.Entries[1].Description)
+	require.Equal("", ci.Entries[1].Description)
+
+	// follow-ups of other requests leave it alone
+	c.Handle(&protoclui.CompletionInfo{
+		RequestId:        6,
+		Sequence:         1,
+		LateDescriptions: []*protoclui.EntryDescription{{EntryIndex: 0, Description: "stale"}},
+	})
+	require.Equal("", c.lastCompletion.Entries[0].Description)
+}
+
+func TestControlResize(t *testing.T) {
+	require := require.New(t)
+
+	c := newConsumer("id", "token", 16, &websocket.Upgrader{})
+	ts := httptest.NewServer(http.HandlerFunc(c.handleControl))
+	defer ts.Close()
+	defer c.close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?token=token", nil)
+	require.Nil(err)
+	defer conn.Close()
+
+	m, err := proto.Marshal(&protoclui.ControlMessage{
+		Message: &protoclui.ControlMessage_Resize{
+			Resize: &protoclui.Resize{Rows: 24, Cols: 80, X: 640, Y: 480},
+		},
+	})
+	require.Nil(err)
+	require.Nil(conn.WriteMessage(websocket.BinaryMessage, m))
+
+	select {
+	case ws := <-c.WinsizeChan():
+		require.Equal(pty.Winsize{Rows: 24, Cols: 80, X: 640, Y: 480}, ws)
+	case <-time.After(5 * time.Second):
+		require.Fail("resize was not received on WinsizeChan")
+	}
+}
+
+func TestSlowClientDetached(t *testing.T) {
+	require := require.New(t)
+
+	c := newConsumer("id", "token", 16, &websocket.Upgrader{})
+	ts := httptest.NewServer(http.HandlerFunc(c.handleIO))
+	defer ts.Close()
+	defer c.close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"?token=token", nil)
+	require.Nil(err)
+	defer conn.Close()
+
+	// the client never reads, yet the shell's output is never held up by it
+	p := make([]byte, 64*1024)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*ioQueueSize; i++ {
+			c.Write(p)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		require.Fail("Write blocked on a client that does not read")
+	}
+
+	_, detached := c.detachedSince()
+	require.True(detached)
+}
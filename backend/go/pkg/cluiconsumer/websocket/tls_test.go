@@ -0,0 +1,193 @@
+package wsconsumer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate generated for a test, signed by parent or self
+// signed if parent is nil
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certPath string
+	keyPath  string
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	require := require.New(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.Nil(err)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.Nil(err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(err)
+
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certPath: filepath.Join(dir, name+".crt"),
+		keyPath:  filepath.Join(dir, name+".key"),
+	}
+	require.Nil(os.WriteFile(tc.certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(os.WriteFile(tc.keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return tc
+}
+
+func (tc *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{tc.cert.Raw}, PrivateKey: tc.key}
+}
+
+// startTLSServer serves s on a random port and returns its address
+func startTLSServer(t *testing.T, s *Server) string {
+	require := require.New(t)
+
+	require.Nil(s.Init())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(err)
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String()
+}
+
+func TestTLS(t *testing.T) {
+	require := require.New(t)
+
+	serverCert := newTestCert(t, "server", nil, true, x509.ExtKeyUsageServerAuth)
+	addr := startTLSServer(t, &Server{
+		Port:        8080,
+		NewProvider: newEchoProvider,
+		TLSCertFile: serverCert.certPath,
+		TLSKeyFile:  serverCert.keyPath,
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+	clientTLS := &tls.Config{RootCAs: roots}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+
+	resp, err := client.Post("https://"+addr+"/sessions", "", nil)
+	require.Nil(err)
+	require.Equal(http.StatusCreated, resp.StatusCode)
+
+	// plaintext is refused
+	resp, err = http.Get("http://" + addr + "/sessions")
+	if err == nil {
+		require.Equal(http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// so is a client that does not trust the certificate
+	_, err = http.Get("https://" + addr + "/sessions")
+	require.NotNil(err)
+}
+
+func TestMutualTLS(t *testing.T) {
+	require := require.New(t)
+
+	serverCert := newTestCert(t, "server", nil, true, x509.ExtKeyUsageServerAuth)
+	clientCA := newTestCert(t, "client-ca", nil, true, x509.ExtKeyUsageClientAuth)
+	clientCert := newTestCert(t, "client", clientCA, false, x509.ExtKeyUsageClientAuth)
+	strangerCert := newTestCert(t, "stranger", nil, false, x509.ExtKeyUsageClientAuth)
+
+	addr := startTLSServer(t, &Server{
+		Port:            8080,
+		NewProvider:     newEchoProvider,
+		TLSCertFile:     serverCert.certPath,
+		TLSKeyFile:      serverCert.keyPath,
+		TLSClientCAFile: clientCA.certPath,
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+
+	get := func(certs ...tls.Certificate) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+		}}}
+		return client.Get("https://" + addr + "/sessions")
+	}
+
+	_, err := get()
+	require.NotNil(err)
+
+	_, err = get(strangerCert.tlsCertificate())
+	require.NotNil(err)
+
+	resp, err := get(clientCert.tlsCertificate())
+	require.Nil(err)
+	require.Equal(http.StatusOK, resp.StatusCode)
+
+	// websockets go through the same handshake
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{clientCert.tlsCertificate()},
+	}}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: dialer.TLSClientConfig}}
+	resp, err = client.Post("https://"+addr+"/sessions", "", nil)
+	require.Nil(err)
+	var info SessionInfo
+	require.Nil(json.NewDecoder(resp.Body).Decode(&info))
+
+	conn, _, err := dialer.Dial("wss://"+addr+"/sessions/"+info.ID+"/io?token="+info.Token, nil)
+	require.Nil(err)
+	defer conn.Close()
+	require.Nil(conn.WriteMessage(websocket.BinaryMessage, []byte("hello")))
+	_, m, err := conn.ReadMessage()
+	require.Nil(err)
+	require.Equal("hello", string(m))
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	require := require.New(t)
+
+	serverCert := newTestCert(t, "server", nil, true, x509.ExtKeyUsageServerAuth)
+
+	require.NotNil((&Server{Port: 8080, NewProvider: newEchoProvider, TLSCertFile: serverCert.certPath}).Init())
+	require.NotNil((&Server{Port: 8080, NewProvider: newEchoProvider, TLSClientCAFile: serverCert.certPath}).Init())
+	err := (&Server{Port: 8080, NewProvider: newEchoProvider, TLSCertFile: serverCert.certPath, TLSKeyFile: serverCert.certPath}).Init()
+	require.NotNil(err)
+	require.True(strings.Contains(err.Error(), "tls"))
+}
@@ -0,0 +1,118 @@
+package bash
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/sirupsen/logrus"
+)
+
+type completer struct {
+	completerScriptPath string
+	bashPath            string
+}
+
+// capture returns the completions printed by capture.bash for csi, one per
+// line
+func (co *completer) capture(ctx context.Context, csi cmdline.Source) (cts []string, err error) {
+	lbuffer, rbuffer := csi.Cursor()
+
+	// the buffer is passed as arguments of its own, it must never be parsed
+	// by a shell. The rc files are left out, capture.bash loads the
+	// completion specs on its own.
+	cmd := exec.CommandContext(ctx, co.bashPath, "--norc", "--noprofile", co.completerScriptPath, lbuffer, rbuffer)
+	cmd.Dir = csi.Dir
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	return strings.Split(string(out), "\n"), nil
+}
+
+// getCompletion returns the completions bash-completion offers for the word
+// under the cursor of csi, bash has no descriptions for them so the result is
+// complete at once
+func (co *completer) getCompletion(ctx context.Context, csi cmdline.Source) (ci *protoclui.CompletionInfo, err error) {
+
+	logrus.Tracef("completing request %d for %s at cwd %s", csi.RequestID, csi.Buffer, csi.Dir)
+
+	ci = &protoclui.CompletionInfo{RequestId: csi.RequestID, Done: true}
+
+	ci.Col = int32(csi.Col)
+	ci.Line = int32(csi.Line)
+	ci.IsEmpty = csi.IsEmpty()
+	ci.IsFirst = csi.IsFirstWord()
+	ci.BufferLength = int32(len(csi.Buffer))
+
+	if ci.IsEmpty {
+		return
+	}
+
+	cts, err := co.capture(ctx, csi)
+	if err != nil {
+		return
+	}
+
+	// completion functions and the default spec may both offer a candidate,
+	// each is only offered once
+	seen := map[string]bool{}
+	var compopts []string
+	for _, ct := range cts {
+		if ct == "" || seen[ct] {
+			continue
+		}
+		seen[ct] = true
+		compopts = append(compopts, ct)
+	}
+	sort.Strings(compopts)
+
+	left, right := csi.CurrentWord()
+	for _, compopt := range compopts {
+		// actualInput is what has to be typed at the cursor to get compopt,
+		// if compopt does not start with left and end with right the
+		// frontend is told to leave typing it to the user
+		var actualInput string
+		var shouldInput bool
+		if strings.HasPrefix(compopt, left) && strings.HasSuffix(compopt[len(left):], right) {
+			actualInput = compopt[len(left) : len(compopt)-len(right)]
+			shouldInput = true
+		} else {
+			actualInput = compopt
+			shouldInput = false
+		}
+
+		ci.Entries = append(ci.Entries, &protoclui.CompletionEntry{
+			ActualInput: actualInput,
+			ShouldInput: shouldInput,
+			Suggestion:  compopt,
+			Level:       0,
+			MatchRanges: matchRanges(left, right, compopt),
+		})
+	}
+	return
+}
+
+// matchRanges returns the ranges of the characters of candidate that match
+// the parts of the word before and after the cursor, left as a prefix and
+// right as a suffix
+func matchRanges(left string, right string, candidate string) (ranges []*protoclui.MatchRange) {
+	if left != "" && strings.HasPrefix(candidate, left) {
+		ranges = append(ranges, &protoclui.MatchRange{Start: 0, End: uint32(len([]rune(left)))})
+	} else {
+		left = ""
+	}
+	if right != "" && len(left)+len(right) <= len(candidate) && strings.HasSuffix(candidate, right) {
+		start := uint32(len([]rune(candidate[:len(candidate)-len(right)])))
+		end := start + uint32(len([]rune(right)))
+		if len(ranges) > 0 && ranges[0].End == start {
+			ranges[0].End = end
+		} else {
+			ranges = append(ranges, &protoclui.MatchRange{Start: start, End: end})
+		}
+	}
+	return
+}
@@ -0,0 +1,184 @@
+package bash
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptDir is backend/scripts, tests run in the directory of their package
+var scriptDir, _ = filepath.Abs(filepath.Join("..", "..", "..", "..", "scripts"))
+
+var testCompleter = &completer{bashPath: "/bin/bash", completerScriptPath: filepath.Join(scriptDir, "capture.bash")}
+
+func suggestions(ci *protoclui.CompletionInfo) (res []string) {
+	for _, e := range ci.Entries {
+		res = append(res, e.Suggestion)
+	}
+	return
+}
+
+func TestCompletion(t *testing.T) {
+	require := require.New(t)
+	csi := cmdline.Source{
+		Dir:     t.TempDir(),
+		Col:     15,
+		Line:    20,
+		LBuffer: "ech",
+		RBuffer: "",
+		Buffer:  "ech",
+	}
+
+	ci, err := testCompleter.getCompletion(context.Background(), csi)
+	require.Nil(err)
+
+	require.Equal(ci.Col, int32(csi.Col))
+	require.Equal(ci.Line, int32(csi.Line))
+	require.Equal(ci.IsEmpty, false)
+	require.Equal(ci.IsFirst, true)
+	require.Equal(ci.BufferLength, int32(3))
+	require.True(ci.Done)
+	require.Contains(suggestions(ci), "echo")
+
+	for _, e := range ci.Entries {
+		if e.Suggestion == "echo" {
+			require.True(e.ShouldInput)
+			require.Equal("o", e.ActualInput)
+			require.Equal([]*protoclui.MatchRange{{Start: 0, End: 3}}, e.MatchRanges)
+		}
+	}
+}
+
+// writeTestSpecs registers completion specs for the test commands in a user
+// completion file, which capture.bash sources like bash-completion would
+func writeTestSpecs(t *testing.T) {
+	specs := `
+_clui_test_tool() {
+    COMPREPLY=( $(compgen -W "checkout cherry-pick commit" -- "$2") )
+}
+complete -F _clui_test_tool clui-test-tool
+complete -o default -W "start stop status" clui-test-svc
+complete -C "echo fromcmd; :" clui-test-cmd
+`
+	path := filepath.Join(t.TempDir(), "bash_completion")
+	require.Nil(t, os.WriteFile(path, []byte(specs), 0666))
+	t.Setenv("BASH_COMPLETION_USER_FILE", path)
+}
+
+func TestCompletionSpecs(t *testing.T) {
+	require := require.New(t)
+	writeTestSpecs(t)
+
+	complete := func(lbuffer string, rbuffer string) *protoclui.CompletionInfo {
+		ci, err := testCompleter.getCompletion(context.Background(), cmdline.Source{
+			Dir:     t.TempDir(),
+			Buffer:  lbuffer + rbuffer,
+			LBuffer: lbuffer,
+			RBuffer: rbuffer,
+		})
+		require.Nil(err, "%q", lbuffer+rbuffer)
+		return ci
+	}
+
+	// completion functions, word lists and commands are all asked
+	require.Equal([]string{"checkout", "cherry-pick"}, suggestions(complete("clui-test-tool ch", "")))
+	require.Equal([]string{"start", "status", "stop"}, suggestions(complete("clui-test-svc st", "")))
+	require.Equal([]string{"fromcmd"}, suggestions(complete("clui-test-cmd ", "")))
+
+	// the rest of the line is left alone, only the word at the cursor is
+	// completed
+	ci := complete("clui-test-tool ch", "out --force")
+	require.False(ci.IsFirst)
+	require.Equal([]string{"checkout", "cherry-pick"}, suggestions(ci))
+	require.True(ci.Entries[0].ShouldInput)
+	require.Equal("eck", ci.Entries[0].ActualInput)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}, {Start: 5, End: 8}}, ci.Entries[0].MatchRanges)
+	require.False(ci.Entries[1].ShouldInput)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, ci.Entries[1].MatchRanges)
+}
+
+func TestCompletionFiles(t *testing.T) {
+	require := require.New(t)
+	writeTestSpecs(t)
+
+	dir := t.TempDir()
+	require.Nil(os.Mkdir(filepath.Join(dir, "src"), 0777))
+	require.Nil(os.WriteFile(filepath.Join(dir, "stop.txt"), nil, 0666))
+
+	// commands without spec complete files, directories end with a slash
+	ci, err := testCompleter.getCompletion(context.Background(), cmdline.Source{Dir: dir, Buffer: "clui-test-none s"})
+	require.Nil(err)
+	require.Equal([]string{"src/", "stop.txt"}, suggestions(ci))
+
+	// -o default falls back to files when the spec offers nothing
+	ci, err = testCompleter.getCompletion(context.Background(), cmdline.Source{Dir: dir, Buffer: "clui-test-svc sr"})
+	require.Nil(err)
+	require.Equal([]string{"src/"}, suggestions(ci))
+}
+
+// TestAcceptScript applies edits with __clui_accept of
+// install-key-listener.bash, outside of readline the line is only a variable
+func TestAcceptScript(t *testing.T) {
+	require := require.New(t)
+
+	accept := func(line string, point int, e cmdline.Edit) string {
+		script := `source "$CLUI_SCRIPT_DIR/install-key-listener.bash" 2>/dev/null
+READLINE_LINE=$1 READLINE_POINT=$2
+__clui_accept
+printf '%s|%s' "${READLINE_LINE:0:READLINE_POINT}" "${READLINE_LINE:READLINE_POINT}"`
+		cmd := exec.Command("/bin/bash", "--norc", "--noprofile", "-c", script, "bash", line, strconv.Itoa(point))
+		cmd.Env = append(os.Environ(), scriptDirEnvKey+"="+scriptDir)
+		cmd.Stdin = strings.NewReader(strings.TrimPrefix(e.Keys(), cmdline.AcceptKey))
+		out, err := cmd.Output()
+		require.Nil(err)
+		return string(out)
+	}
+
+	require.Equal("git checkout| --force", accept("git chekx --force", 7, cmdline.Edit{Left: "che", Right: "kx", Text: "checkout"}))
+
+	// the line is left alone if it changed since the entry was offered
+	require.Equal("git sta|", accept("git sta", 7, cmdline.Edit{Left: "che", Text: "checkout "}))
+}
+
+func TestCompletionInjection(t *testing.T) {
+	require := require.New(t)
+	writeTestSpecs(t)
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "injected")
+
+	buffers := []string{
+		"echo it's",
+		"echo 'unterminated",
+		"echo \"unterminated",
+		"echo '; touch " + marker + "; echo '",
+		"echo $(touch " + marker + ")",
+		"echo `touch " + marker + "`",
+		"echo a\ntouch " + marker + "\necho ",
+		"clui-test-tool $(touch " + marker + ")",
+		"clui-test-svc `touch " + marker + "`",
+		"clui-test-cmd $(touch " + marker + ")",
+		"echo héllo wörld 日本",
+	}
+
+	for _, buffer := range buffers {
+		_, err := testCompleter.capture(context.Background(), cmdline.Source{Dir: dir, Buffer: buffer})
+		require.Nil(err, "%q", buffer)
+
+		_, err = os.Stat(marker)
+		require.True(os.IsNotExist(err), "buffer %q executed a command", buffer)
+	}
+
+	require.Nil(os.WriteFile(filepath.Join(dir, "日本語.txt"), nil, 0666))
+	cts, err := testCompleter.capture(context.Background(), cmdline.Source{Dir: dir, Buffer: "cat 日"})
+	require.Nil(err)
+	require.Contains(strings.Join(cts, "\n"), "日本語.txt")
+}
@@ -0,0 +1,81 @@
+package bash
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/host"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// scriptDirEnvKey tells .bashrc where install-key-listener.bash and zkeylis
+// are, bash has no equivalent of ZDOTDIR
+var scriptDirEnvKey = "CLUI_SCRIPT_DIR"
+
+// Provider provides the bash implementation of clui
+type Provider struct {
+	host.Host
+	comp      *completer
+	scriptDir string
+	bashPath  string
+	tmpPath   string
+}
+
+// NewProvider returns a new instance of Provider using default options
+func NewProvider() *Provider {
+	var defaultCompleter = &completer{
+		completerScriptPath: viper.GetString("BASH_COMPLETER_SCRIPT_PATH"),
+		bashPath:            viper.GetString("BASH_PATH"),
+	}
+	return &Provider{
+		comp:      defaultCompleter,
+		scriptDir: filepath.Dir(defaultCompleter.completerScriptPath),
+		bashPath:  defaultCompleter.bashPath,
+		tmpPath:   viper.GetString("CLUI_TMP_PATH"),
+	}
+}
+
+// Start performs the required preparation and then starts the bash process,
+// as well as start providing completion results via compOptHandler
+func (p *Provider) Start() (err error) {
+	sockPath, err := host.SockPath(p.tmpPath)
+	if err != nil {
+		return err
+	}
+
+	env := os.Environ()
+	env = append(env, fmt.Sprintf("%s=%s", scriptDirEnvKey, p.scriptDir))
+
+	return p.Host.Start(host.Program{
+		Name: "bash",
+		Command: &exec.Cmd{
+			Path: p.bashPath,
+			Args: []string{p.bashPath, "--rcfile", filepath.Join(p.scriptDir, ".bashrc"), "-i"},
+			Env:  env,
+		},
+		KeyListener: sockPath,
+		Complete:    host.Get(p.comp.getCompletion),
+		Accept: func(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+			return p.accept(ptmx, ac)
+		},
+	})
+}
+
+// accept types the keys that make bash apply an accepted entry while it is at
+// its prompt, bash itself checks that the line has not changed since the entry
+// was offered
+func (p *Provider) accept(ptmx io.Writer, ac *protoclui.AcceptCompletion) error {
+	csi, entry, err := p.Accepted(ac)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(ptmx, csi.ReplaceShellWord(entry.Suggestion, cmdline.QuotePOSIX).Keys())
+	return errors.Wrap(err, "cannot write accept keys")
+}
@@ -0,0 +1,132 @@
+package fish
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/sirupsen/logrus"
+)
+
+type completer struct {
+	completerScriptPath string
+	fishPath            string
+}
+
+// capture returns the lines printed by capture.fish for csi
+func (co *completer) capture(ctx context.Context, csi cmdline.Source) (cts []string, err error) {
+	lbuffer, rbuffer := csi.Cursor()
+
+	// the buffer is passed as arguments of its own, it must never be parsed
+	// by a shell
+	cmd := exec.CommandContext(ctx, co.fishPath, co.completerScriptPath, lbuffer, rbuffer)
+	cmd.Dir = csi.Dir
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	return strings.Split(string(out), "\n"), nil
+}
+
+// captureDescriptionSep separates a match from its description in the lines
+// printed by `complete --do-complete`
+const captureDescriptionSep = "\t"
+
+// parseCaptureLine splits a line printed by capture.fish into the match and
+// the description fish gave for it, if any
+func parseCaptureLine(line string) (match string, description string) {
+	if i := strings.Index(line, captureDescriptionSep); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+len(captureDescriptionSep):])
+	}
+	return line, ""
+}
+
+// getCompletion returns the completions fish offers for the word under the
+// cursor of csi, fish knows their descriptions already so the result is
+// complete at once. The order of fish is kept, it puts the best matches
+// first.
+func (co *completer) getCompletion(ctx context.Context, csi cmdline.Source) (ci *protoclui.CompletionInfo, err error) {
+
+	logrus.Tracef("completing request %d for %s at cwd %s", csi.RequestID, csi.Buffer, csi.Dir)
+
+	ci = &protoclui.CompletionInfo{RequestId: csi.RequestID, Done: true}
+
+	ci.Col = int32(csi.Col)
+	ci.Line = int32(csi.Line)
+	ci.IsEmpty = csi.IsEmpty()
+	ci.IsFirst = csi.IsFirstWord()
+	ci.BufferLength = int32(len(csi.Buffer))
+
+	if ci.IsEmpty {
+		return
+	}
+
+	cts, err := co.capture(ctx, csi)
+	if err != nil {
+		return
+	}
+
+	left, right := csi.CurrentWord()
+	seen := map[string]bool{}
+	for _, ct := range cts {
+		compopt, description := parseCaptureLine(ct)
+		if compopt == "" || seen[compopt] {
+			continue
+		}
+		seen[compopt] = true
+
+		// actualInput is what has to be typed at the cursor to get compopt,
+		// fish also offers matches that merely contain the word, for those
+		// the frontend is told to leave typing it to the user
+		var actualInput string
+		var shouldInput bool
+		if strings.HasPrefix(compopt, left) && strings.HasSuffix(compopt[len(left):], right) {
+			actualInput = compopt[len(left) : len(compopt)-len(right)]
+			shouldInput = true
+		} else {
+			actualInput = compopt
+			shouldInput = false
+		}
+
+		ci.Entries = append(ci.Entries, &protoclui.CompletionEntry{
+			ActualInput: actualInput,
+			ShouldInput: shouldInput,
+			Description: description,
+			Suggestion:  compopt,
+			Level:       0,
+			MatchRanges: matchRanges(left, right, compopt),
+		})
+	}
+	return
+}
+
+// matchRanges returns the ranges of the characters of candidate that match
+// the parts of the word before and after the cursor. Like fish, left matches
+// as a prefix ignoring case or else anywhere in candidate, right matches as a
+// suffix.
+func matchRanges(left string, right string, candidate string) (ranges []*protoclui.MatchRange) {
+	end := 0
+	switch {
+	case left == "":
+	case len(left) <= len(candidate) && strings.EqualFold(candidate[:len(left)], left):
+		end = len(left)
+	case strings.Contains(candidate, left):
+		end = strings.Index(candidate, left) + len(left)
+	}
+	if end > 0 {
+		start := uint32(len([]rune(candidate[:end-len(left)])))
+		ranges = append(ranges, &protoclui.MatchRange{Start: start, End: start + uint32(len([]rune(left)))})
+	}
+	if right != "" && end+len(right) <= len(candidate) && strings.HasSuffix(candidate, right) {
+		start := uint32(len([]rune(candidate[:len(candidate)-len(right)])))
+		end := start + uint32(len([]rune(right)))
+		if n := len(ranges); n > 0 && ranges[n-1].End == start {
+			ranges[n-1].End = end
+		} else {
+			ranges = append(ranges, &protoclui.MatchRange{Start: start, End: end})
+		}
+	}
+	return
+}
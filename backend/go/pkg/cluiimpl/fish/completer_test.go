@@ -0,0 +1,147 @@
+package fish
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptDir is backend/scripts, tests run in the directory of their package
+var scriptDir, _ = filepath.Abs(filepath.Join("..", "..", "..", "..", "scripts"))
+
+var testCompleter = &completer{fishPath: "/usr/bin/fish", completerScriptPath: filepath.Join(scriptDir, "capture.fish")}
+
+func TestCompletion(t *testing.T) {
+	require := require.New(t)
+	csi := cmdline.Source{
+		Dir:     t.TempDir(),
+		Col:     15,
+		Line:    20,
+		LBuffer: "ech",
+		RBuffer: "",
+		Buffer:  "ech",
+	}
+
+	ci, err := testCompleter.getCompletion(context.Background(), csi)
+	require.Nil(err)
+
+	require.Equal(ci.Col, int32(csi.Col))
+	require.Equal(ci.Line, int32(csi.Line))
+	require.Equal(ci.IsEmpty, false)
+	require.Equal(ci.IsFirst, true)
+	require.Equal(ci.BufferLength, int32(3))
+	require.True(ci.Done)
+
+	// fish describes its builtins itself
+	var found bool
+	for _, e := range ci.Entries {
+		if e.Suggestion == "echo" {
+			found = true
+			require.True(e.ShouldInput)
+			require.Equal("o", e.ActualInput)
+			require.NotEmpty(e.Description)
+		}
+	}
+	require.True(found)
+}
+
+func TestCompletionInjection(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "injected")
+
+	buffers := []string{
+		"echo it's",
+		"echo 'unterminated",
+		"echo \"unterminated",
+		"echo '; touch " + marker + "; echo '",
+		"echo (touch " + marker + ")",
+		"echo $(touch " + marker + ")",
+		"echo a\ntouch " + marker + "\necho ",
+		"echo héllo wörld 日本",
+	}
+
+	for _, buffer := range buffers {
+		_, err := testCompleter.capture(context.Background(), cmdline.Source{Dir: dir, Buffer: buffer})
+		require.Nil(err, "%q", buffer)
+
+		_, err = os.Stat(marker)
+		require.True(os.IsNotExist(err), "buffer %q executed a command", buffer)
+	}
+}
+
+func TestParseCaptureLine(t *testing.T) {
+	require := require.New(t)
+
+	match, description := parseCaptureLine("checkout\tSwitch branches or restore working tree files")
+	require.Equal("checkout", match)
+	require.Equal("Switch branches or restore working tree files", description)
+
+	match, description = parseCaptureLine("src/")
+	require.Equal("src/", match)
+	require.Equal("", description)
+}
+
+func TestMatchRanges(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, matchRanges("ch", "", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, matchRanges("CH", "", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 8, End: 11}}, matchRanges("ick", "", "cherry-pick"))
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}, {Start: 5, End: 8}}, matchRanges("ch", "out", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 8}}, matchRanges("chec", "kout", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 1, End: 3}}, matchRanges("本語", "", "日本語.txt"))
+	require.Nil(matchRanges("xyz", "", "checkout"))
+}
+
+type recordingHandler struct {
+	ids []uint64
+}
+
+func (h *recordingHandler) Handle(ci *protoclui.CompletionInfo) {
+	h.ids = append(h.ids, ci.RequestId)
+}
+
+func TestAccept(t *testing.T) {
+	require := require.New(t)
+
+	p := &Provider{acceptPath: filepath.Join(t.TempDir(), "accept")}
+	p.Requests.Handler = &recordingHandler{}
+	_, ok := p.Requests.Begin(2, false)
+	require.True(ok)
+	p.Requests.Deliver(cmdline.Source{LBuffer: "git chec"}, &protoclui.CompletionInfo{
+		RequestId: 2,
+		Entries:   []*protoclui.CompletionEntry{{Suggestion: "checkout"}},
+	})
+
+	// stale entries are neither left for fish nor typed
+	var typed bytes.Buffer
+	require.Error(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 1}))
+	require.Zero(typed.Len())
+	_, err := os.Stat(p.acceptPath)
+	require.True(os.IsNotExist(err))
+
+	require.NoError(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 2}))
+	require.Equal(cmdline.AcceptKey, typed.String())
+	payload, err := os.ReadFile(p.acceptPath)
+	require.NoError(err)
+	require.Equal(cmdline.Edit{Left: "chec", Text: "checkout "}.Payload(), string(payload))
+
+	// nor are they while fish runs a line, the key would go to whatever it
+	// started
+	typed.Reset()
+	os.Remove(p.acceptPath)
+	_, ok = p.Requests.Begin(3, true)
+	require.True(ok)
+	require.Error(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 2}))
+	require.Zero(typed.Len())
+	_, err = os.Stat(p.acceptPath)
+	require.True(os.IsNotExist(err))
+}
@@ -0,0 +1,114 @@
+package fish
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/host"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// scriptDirEnvKey tells fish where install-key-listener.fish and zkeylis are
+var scriptDirEnvKey = "CLUI_SCRIPT_DIR"
+
+// acceptFileEnvKey tells install-key-listener.fish where the edit of an
+// accepted entry is left, acceptFileSuffix is appended to the socket path to
+// name it
+var acceptFileEnvKey = "CLUI_ACCEPT_FILE"
+
+const acceptFileSuffix = ".accept"
+
+// initCommand makes the interactive fish report the line after reading its
+// configuration, the path comes from the environment so that it is never
+// parsed
+const initCommand = `source "$CLUI_SCRIPT_DIR/install-key-listener.fish"`
+
+// Provider provides the fish implementation of clui
+type Provider struct {
+	host.Host
+	comp      *completer
+	scriptDir string
+	fishPath  string
+	tmpPath   string
+	// acceptPath is the file accepted edits are left in for fish
+	acceptPath string
+}
+
+// NewProvider returns a new instance of Provider using default options
+func NewProvider() *Provider {
+	var defaultCompleter = &completer{
+		completerScriptPath: viper.GetString("FISH_COMPLETER_SCRIPT_PATH"),
+		fishPath:            viper.GetString("FISH_PATH"),
+	}
+	return &Provider{
+		comp:      defaultCompleter,
+		scriptDir: filepath.Dir(defaultCompleter.completerScriptPath),
+		fishPath:  defaultCompleter.fishPath,
+		tmpPath:   viper.GetString("CLUI_TMP_PATH"),
+	}
+}
+
+// Start performs the required preparation and then starts the fish process,
+// as well as start providing completion results via compOptHandler
+func (p *Provider) Start() (err error) {
+	sockPath, err := host.SockPath(p.tmpPath)
+	if err != nil {
+		return err
+	}
+	p.acceptPath = sockPath + acceptFileSuffix
+
+	defer func() {
+		if err := os.Remove(p.acceptPath); err != nil && !os.IsNotExist(err) {
+			logrus.Error(errors.Wrap(err, "cannot remove accept file"))
+		}
+	}()
+
+	env := os.Environ()
+	env = append(env, fmt.Sprintf("%s=%s", scriptDirEnvKey, p.scriptDir))
+	env = append(env, fmt.Sprintf("%s=%s", acceptFileEnvKey, p.acceptPath))
+
+	return p.Host.Start(host.Program{
+		Name: "fish",
+		Command: &exec.Cmd{
+			Path: p.fishPath,
+			Args: []string{p.fishPath, "--interactive", "--init-command", initCommand},
+			Env:  env,
+		},
+		KeyListener: sockPath,
+		Complete:    host.Get(p.comp.getCompletion),
+		Accept: func(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+			return p.accept(ptmx, ac)
+		},
+	})
+}
+
+// accept leaves the edit of an accepted entry for fish and types the key that
+// makes it apply the edit while fish is at its prompt, fish itself checks that
+// the line has not changed since the entry was offered
+func (p *Provider) accept(ptmx io.Writer, ac *protoclui.AcceptCompletion) error {
+	csi, entry, err := p.Accepted(ac)
+	if err != nil {
+		return err
+	}
+	e := csi.ReplaceShellWord(entry.Suggestion, cmdline.QuoteFish)
+
+	// the file is replaced atomically so that fish never reads a partial
+	// edit
+	tmp := p.acceptPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(e.Payload()), 0600); err != nil {
+		return errors.Wrap(err, "cannot write accept file")
+	}
+	if err := os.Rename(tmp, p.acceptPath); err != nil {
+		return errors.Wrap(err, "cannot replace accept file")
+	}
+
+	_, err = io.WriteString(ptmx, cmdline.AcceptKey)
+	return errors.Wrap(err, "cannot write accept key")
+}
@@ -0,0 +1,253 @@
+// Package cmdline models the line being edited in a program as the program
+// reports it, and the edits that accept completion entries in it. It is
+// shared by all providers, they only tell it how their program splits words.
+package cmdline
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// Source is the line being edited in a program, the cursor is between
+// LBuffer and RBuffer
+type Source struct {
+	// RequestID increases monotonically for every line reported by the same
+	// program
+	RequestID uint64
+	// Col and Line are the position of the cursor on the screen
+	Col  int
+	Line int
+	Dir  string
+
+	LBuffer string
+	RBuffer string
+	Buffer  string
+
+	// Executing is set when the program leaves its prompt to run the line
+	Executing bool
+
+	// Split tells the word under the cursor apart from the rest of the
+	// line, words are separated by whitespace if it is nil
+	Split *Split
+}
+
+// Split tells the word under the cursor apart from the rest of the line
+type Split struct {
+	// IsBreak reports whether r separates words
+	IsBreak func(r rune) bool
+	// IsEnd reports whether r ends the word under the cursor after the
+	// cursor, IsBreak is used if it is nil
+	IsEnd func(r rune) bool
+}
+
+// Whitespace splits words at whitespace, like a shell does
+var Whitespace = &Split{IsBreak: unicode.IsSpace}
+
+// Unmarshal returns the Source of a CompletionSourceInfo the way the key
+// listeners of the programs report it
+func Unmarshal(b []byte) (s Source, err error) {
+	pcsi := protoclui.CompletionSourceInfo{}
+	if err := proto.Unmarshal(b, &pcsi); err != nil {
+		return Source{}, errors.Wrap(err, "cannot unmarshal raw CSI")
+	}
+
+	s.RequestID = pcsi.RequestId
+	s.Line = int(pcsi.Line)
+	s.Col = int(pcsi.Col)
+	s.Dir = pcsi.Dir
+	s.LBuffer = pcsi.LBuffer
+	s.RBuffer = pcsi.RBuffer
+	s.Buffer = pcsi.Buffer
+	s.Executing = pcsi.Executing
+	return
+}
+
+// Cursor returns the parts of the buffer before and after the cursor, the
+// cursor is taken to be at the end of buffer if neither is known
+func (s *Source) Cursor() (lbuffer string, rbuffer string) {
+	if s.LBuffer == "" && s.RBuffer == "" {
+		return s.Buffer, ""
+	}
+	return s.LBuffer, s.RBuffer
+}
+
+// CurrentWord returns the parts of the word under the cursor before and after
+// it
+func (s *Source) CurrentWord() (left string, right string) {
+	split := s.Split
+	if split == nil {
+		split = Whitespace
+	}
+	isEnd := split.IsEnd
+	if isEnd == nil {
+		isEnd = split.IsBreak
+	}
+
+	lbuffer, rbuffer := s.Cursor()
+	left = lbuffer[strings.LastIndexFunc(lbuffer, split.IsBreak)+1:]
+	right = rbuffer
+	if i := strings.IndexFunc(rbuffer, isEnd); i >= 0 {
+		right = rbuffer[:i]
+	}
+	return
+}
+
+// Words returns the whitespace separated words of the buffer up to and
+// including the word under the cursor
+func (s *Source) Words() []string {
+	lbuffer, _ := s.Cursor()
+	_, right := s.CurrentWord()
+	return strings.Fields(lbuffer + right)
+}
+
+// Command returns the first word of the buffer if the word under the cursor
+// is not it, that word is then completed as an argument of the command
+func (s *Source) Command() string {
+	lbuffer, _ := s.Cursor()
+	left, _ := s.CurrentWord()
+	words := strings.Fields(lbuffer[:len(lbuffer)-len(left)])
+	if len(words) == 0 {
+		return ""
+	}
+	return words[0]
+}
+
+// CountWord returns the number of words up to and including the word under
+// the cursor, the words after it count for none
+func (s *Source) CountWord() int64 {
+	return int64(len(s.Words()))
+}
+
+// IsFirstWord returns whether we are completing for the first word, which is
+// in most cases the command
+func (s *Source) IsFirstWord() bool {
+	return s.CountWord() == 1
+}
+
+// IsEmpty returns whether we are completing for no word, which means the user
+// has not typed anything before the cursor yet and the provider can suggest
+// something by itself. Like CountWord and IsFirstWord it only looks at the
+// buffer up to the end of the word under the cursor.
+func (s *Source) IsEmpty() bool {
+	return s.CountWord() == 0
+}
+
+// SpaceFollows returns whether the word under the cursor is followed by
+// whitespace
+func (s *Source) SpaceFollows() bool {
+	_, rbuffer := s.Cursor()
+	_, right := s.CurrentWord()
+	rest := strings.TrimPrefix(rbuffer, right)
+	return rest != "" && unicode.IsSpace([]rune(rest)[0])
+}
+
+// Edit replaces Left and Right around the cursor with Text, the cursor ends
+// up after Text. Programs that can check it only apply it if the line still
+// has Left right before and Right right after the cursor.
+type Edit struct {
+	Left  string
+	Right string
+	Text  string
+}
+
+// Replace returns the edit that replaces the word under the cursor with text
+func (s *Source) Replace(text string) Edit {
+	left, right := s.CurrentWord()
+	return Edit{Left: left, Right: right, Text: text}
+}
+
+// ReplaceShellWord returns the edit that replaces the word under the cursor of
+// a shell command line with text, quoted by quoteWord for the word context.
+// Directories and options taking a value continue the same word, everything
+// else is followed by a space unless there is one already.
+func (s *Source) ReplaceShellWord(text string, quoteWord func(string) string) Edit {
+	left, _ := s.CurrentWord()
+	// what the user typed of text is kept as they quoted it, a trailing slash
+	// or equals sign needs no quoting and keeps the word going
+	n := commonPrefix(left, text)
+	suffix := ""
+	if strings.HasSuffix(text, "/") || strings.HasSuffix(text, "=") {
+		text, suffix = text[:len(text)-1], text[len(text)-1:]
+	} else if !s.SpaceFollows() {
+		suffix = " "
+	}
+	if n > len(text) {
+		n = len(text)
+	}
+	return s.Replace(text[:n] + quoteWord(text[n:]) + suffix)
+}
+
+// commonPrefix returns the length of the longest common prefix of a and b
+// that ends on a rune boundary
+func commonPrefix(a string, b string) int {
+	n := 0
+	for i, r := range a {
+		if !strings.HasPrefix(b[n:], string(r)) {
+			break
+		}
+		n = i + len(string(r))
+	}
+	return n
+}
+
+// QuotePOSIX escapes s for a word of bash or zsh, control characters are
+// written as $'\xNN'
+func QuotePOSIX(s string) string {
+	return quote(s, " \\'\"`$&|;<>()[]{}*?!#^", func(b byte) string {
+		return fmt.Sprintf("$'\\x%02x'", b)
+	})
+}
+
+// QuoteFish escapes s for a word of fish, control characters are written as
+// \xNN
+func QuoteFish(s string) string {
+	return quote(s, " \\'\"$&|;<>()[]{}*?#~%", func(b byte) string {
+		return fmt.Sprintf("\\x%02x", b)
+	})
+}
+
+// quote escapes the characters of special with a backslash and writes control
+// characters with control
+func quote(s string, special string, control func(b byte) string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune(special, r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < utf8.RuneSelf && unicode.IsControl(r):
+			b.WriteString(control(byte(r)))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// AcceptKey is the key sequence bound to the accept widgets of the key
+// listener scripts, AcceptEndKey terminates the payload typed after it
+const (
+	AcceptKey    = "\x18\x01" // ^X^A
+	AcceptEndKey = ";"
+)
+
+// Keys returns the keystrokes that make the accept widget of a shell apply e
+func (e Edit) Keys() string {
+	return AcceptKey + e.Payload() + AcceptEndKey
+}
+
+// Payload returns e the way the accept widgets of the key listener scripts
+// read it, the fields are hex-encoded so that no byte of them can be taken as
+// a key binding or as the separator
+func (e Edit) Payload() string {
+	return hex.EncodeToString([]byte(e.Left)) + ":" +
+		hex.EncodeToString([]byte(e.Right)) + ":" +
+		hex.EncodeToString([]byte(e.Text))
+}
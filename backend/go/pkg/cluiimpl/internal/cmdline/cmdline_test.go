@@ -0,0 +1,92 @@
+package cmdline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWordCount(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal((&Source{Buffer: "   "}).IsEmpty(), true)
+	require.Equal((&Source{Buffer: "  \t\t\t "}).IsEmpty(), true)
+	require.Equal((&Source{Buffer: "\t word  \t "}).IsFirstWord(), true)
+	require.Equal((&Source{Buffer: "\t word  \t word2 \t  \t  "}).CountWord(), int64(2))
+}
+
+func TestCursorWords(t *testing.T) {
+	require := require.New(t)
+
+	// without lbuffer and rbuffer the cursor is at the end of buffer
+	s := Source{Buffer: "git chec"}
+	lbuffer, rbuffer := s.Cursor()
+	require.Equal("git chec", lbuffer)
+	require.Equal("", rbuffer)
+
+	s = Source{Buffer: "git checkout --force", LBuffer: "git che", RBuffer: "ckout --force"}
+	left, right := s.CurrentWord()
+	require.Equal("che", left)
+	require.Equal("ckout", right)
+	require.Equal([]string{"git", "checkout"}, s.Words())
+	require.False(s.IsFirstWord())
+	require.False(s.IsEmpty())
+	require.True(s.SpaceFollows())
+	require.Equal("git", s.Command())
+
+	// editing the command of a longer line completes the first word
+	s = Source{Buffer: "gi status", LBuffer: "gi", RBuffer: " status"}
+	require.True(s.IsFirstWord())
+	require.Equal("", s.Command())
+
+	// the words after the one under the cursor count for none of them
+	s = Source{Buffer: "  ls", LBuffer: " ", RBuffer: " ls"}
+	require.Equal(int64(0), s.CountWord())
+	require.False(s.IsFirstWord())
+	require.True(s.IsEmpty())
+
+	s = Source{Buffer: "l status", LBuffer: "", RBuffer: "l status"}
+	require.Equal(int64(1), s.CountWord())
+	require.True(s.IsFirstWord())
+	require.False(s.IsEmpty())
+}
+
+func TestSplit(t *testing.T) {
+	require := require.New(t)
+
+	// a program may end the word after the cursor elsewhere than before it
+	split := &Split{
+		IsBreak: func(r rune) bool { return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyz.", r) },
+		IsEnd:   func(r rune) bool { return r == '.' || r == '(' },
+	}
+	left, right := (&Source{LBuffer: "print(os.pa", RBuffer: "th.join)", Split: split}).CurrentWord()
+	require.Equal("os.pa", left)
+	require.Equal("th", right)
+}
+
+func TestReplace(t *testing.T) {
+	require := require.New(t)
+
+	s := Source{Buffer: "git chekx", LBuffer: "git chec", RBuffer: "kx"}
+	require.Equal(Edit{Left: "chec", Right: "kx", Text: "checkout "}, s.ReplaceShellWord("checkout", QuotePOSIX))
+	require.Equal(Edit{Left: "chec", Right: "kx", Text: "checkout"}, s.Replace("checkout"))
+
+	// directories and options taking a value continue the word, a space
+	// that is there already is not doubled
+	require.Equal("src/", s.ReplaceShellWord("src/", QuotePOSIX).Text)
+	require.Equal("--color=", s.ReplaceShellWord("--color=", QuotePOSIX).Text)
+	s = Source{Buffer: "git chec --force", LBuffer: "git chec", RBuffer: " --force"}
+	require.Equal("checkout", s.ReplaceShellWord("checkout", QuotePOSIX).Text)
+
+	// the rest of the suggestion is quoted for the word, what was typed of
+	// it is kept as it is
+	s = Source{Buffer: "cat my", LBuffer: "cat my"}
+	require.Equal(`my\ file\ \(1\).txt `, s.ReplaceShellWord("my file (1).txt", QuotePOSIX).Text)
+	require.Equal(`my\ \$dir/`, s.ReplaceShellWord("my $dir/", QuotePOSIX).Text)
+	require.Equal(`my\ \~file `, s.ReplaceShellWord("my ~file", QuoteFish).Text)
+	require.Equal(`a\'b$'\x01'\;日本 `, (&Source{Buffer: "cat "}).ReplaceShellWord("a'b\x01;日本", QuotePOSIX).Text)
+	require.Equal(`a\'b\x01\;日本 `, (&Source{Buffer: "cat "}).ReplaceShellWord("a'b\x01;日本", QuoteFish).Text)
+
+	require.Equal("6c73::6c73202d6c20", Edit{Left: "ls", Text: "ls -l "}.Payload())
+}
@@ -0,0 +1,372 @@
+// Package host runs the program of a provider in a pty and passes the lines
+// it reports on to the completer of the provider. It is shared by all
+// providers, they only supply the command they spawn, how their program
+// splits words and how they complete and accept entries.
+package host
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kr/pty"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/request"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// keyListenerOutputEnvKey tells the key listener of the program where to
+// report the line to
+var keyListenerOutputEnvKey = "KEY_LISTENER_OUTPUT"
+
+// Program is what a provider runs
+type Program struct {
+	// Name is the name of the provider, it is used in messages
+	Name string
+	// Command is the program, Host runs it in the directory set by SetDir
+	// and with the environment of clui if it has none of its own
+	Command *exec.Cmd
+	// KeyListener is the path of the socket the key listener of the
+	// program reports lines to, no lines are listened for if it is empty
+	KeyListener string
+	// Split tells the word under the cursor apart in the lines reported
+	Split *cmdline.Split
+	// Complete completes the lines reported to KeyListener, it passes its
+	// results to handle
+	Complete func(ctx context.Context, s cmdline.Source, handle func(ci *protoclui.CompletionInfo)) error
+	// Accept applies an entry accepted on the frontend, ptmx is the pty of
+	// the program
+	Accept func(ptmx *os.File, ac *protoclui.AcceptCompletion) error
+	// Attach is run along the program if it is set, done is closed once the
+	// program has exited and Start returns after Attach has
+	Attach func(done <-chan struct{})
+	// CopyInput passes input on to ptmx if it is set, input is copied as is
+	// otherwise
+	CopyInput func(ptmx *os.File, input io.Reader) error
+}
+
+// Get returns a Complete for a completer that gives a single result
+func Get(get func(ctx context.Context, s cmdline.Source) (*protoclui.CompletionInfo, error)) func(ctx context.Context, s cmdline.Source, handle func(ci *protoclui.CompletionInfo)) error {
+	return func(ctx context.Context, s cmdline.Source, handle func(ci *protoclui.CompletionInfo)) error {
+		ci, err := get(ctx, s)
+		if err != nil {
+			return err
+		}
+		handle(ci)
+		return nil
+	}
+}
+
+// SockPath returns a path in tmpPath no other provider uses, tmpPath is
+// created if needed and only accessible to the user
+func SockPath(tmpPath string) (string, error) {
+	if err := os.MkdirAll(tmpPath, 0700); err != nil {
+		return "", errors.Wrap(err, "cannot make tmp dir")
+	}
+	// no chance of collision
+	sockName := strconv.Itoa(int(time.Now().UnixNano()))
+	sockName += strconv.Itoa(rand.Int())
+	return filepath.Join(tmpPath, sockName), nil
+}
+
+// Host implements the options clui sets on a provider and the lifecycle of
+// its program, it is meant to be embedded in the provider
+type Host struct {
+	dir         string
+	input       io.Reader
+	output      io.Writer
+	winsizeChan chan pty.Winsize
+	acceptChan  chan *protoclui.AcceptCompletion
+
+	// outputMut serialises writes to output
+	outputMut sync.Mutex
+
+	// cmdMut guards cmd and stopped, cmd is the running program and is nil
+	// until Start has spawned it
+	cmdMut  sync.Mutex
+	cmd     *exec.Cmd
+	stopped bool
+
+	// Requests orders the completion requests and delivers their results
+	Requests request.Tracker
+}
+
+func (h *Host) SetWinsizeChan(winsizes chan pty.Winsize) {
+	h.winsizeChan = winsizes
+}
+
+// SetAcceptChan sets the channel of completion entries accepted on the
+// frontend
+func (h *Host) SetAcceptChan(accepts chan *protoclui.AcceptCompletion) {
+	h.acceptChan = accepts
+}
+
+// SetDir sets the current working directory of the process
+func (h *Host) SetDir(s string) {
+	h.dir = s
+}
+
+// Dir returns the current working directory of the process
+func (h *Host) Dir() string {
+	return h.dir
+}
+
+// SetInput sets the input stream used for Stdin
+func (h *Host) SetInput(r io.Reader) {
+	h.input = r
+}
+
+// SetOutput sets the output stream used for both Stdout and Stderr
+func (h *Host) SetOutput(w io.Writer) {
+	h.output = w
+}
+
+// Output returns the output stream, writes to it are never mixed with the
+// output of the program
+func (h *Host) Output() io.Writer {
+	return &lockedWriter{mut: &h.outputMut, w: h.output}
+}
+
+// SetCompOptHandler sets the completion option handler
+func (h *Host) SetCompOptHandler(j clui.CompletionInfoHandler) {
+	h.Requests.Handler = j
+}
+
+// Accepted returns the entry accepted on the frontend along with the line it
+// was offered for, see request.Tracker.Accepted
+func (h *Host) Accepted(ac *protoclui.AcceptCompletion) (cmdline.Source, *protoclui.CompletionEntry, error) {
+	source, entry, err := h.Requests.Accepted(ac)
+	if err != nil {
+		return cmdline.Source{}, nil, err
+	}
+	return source.(cmdline.Source), entry, nil
+}
+
+// Start starts prog in a pty and provides completion results for the lines
+// it reports via compOptHandler until it exits
+func (h *Host) Start(prog Program) (err error) {
+
+	// validate we have correct options set by clui first
+	if h.dir == "" {
+		return errors.Errorf("%s provider: dir is not set", prog.Name)
+	}
+	if h.input == nil {
+		return errors.Errorf("%s provider: input is not set", prog.Name)
+	}
+	if h.output == nil {
+		return errors.Errorf("%s provider: output is not set", prog.Name)
+	}
+	if h.Requests.Handler == nil {
+		return errors.Errorf("%s provider: compOptHandler is not set", prog.Name)
+	}
+	if h.winsizeChan == nil {
+		return errors.Errorf("%s provider: winsizeChan is not set", prog.Name)
+	}
+	if h.acceptChan == nil {
+		return errors.Errorf("%s provider: acceptChan is not set", prog.Name)
+	}
+
+	cmd := prog.Command
+	name := filepath.Base(cmd.Path)
+	cmd.Dir = h.dir
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+
+	if prog.KeyListener != "" {
+		sock, err := net.Listen("unixpacket", prog.KeyListener)
+		if err != nil {
+			return errors.Wrap(err, "cannot create unixpacket socket for key listener")
+		}
+
+		defer func() {
+			if err := sock.Close(); err != nil {
+				logrus.Errorln(errors.Wrap(err, "closing key listener socket failed"))
+			}
+		}()
+
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=unixpacket://%s", keyListenerOutputEnvKey, prog.KeyListener))
+
+		go h.startKeyListener(sock, prog)
+	}
+
+	h.cmdMut.Lock()
+	if h.stopped {
+		h.cmdMut.Unlock()
+		return errors.Errorf("%s provider: stopped before start", prog.Name)
+	}
+	ptmx, err := pty.Start(cmd)
+	if err == nil {
+		h.cmd = cmd
+	}
+	h.cmdMut.Unlock()
+
+	if err != nil {
+		logrus.Errorf("cannot start %s: %v", name, err)
+		return errors.Wrapf(err, "cannot start %s", name)
+	}
+
+	// the program must not outlive Start, which may return early when the
+	// output cannot be written anymore
+	defer func() {
+		if err := h.Stop(); err != nil {
+			logrus.Errorf("cannot stop %s: %v", name, err)
+		}
+		if err := cmd.Wait(); err != nil {
+			logrus.Debugf("%s exited: %v", name, err)
+		}
+	}()
+
+	defer func() {
+		if err = ptmx.Close(); err != nil {
+			logrus.Errorf("cannot close %s: %v", name, err)
+		}
+	}()
+
+	done := make(chan struct{})
+	if prog.Attach != nil {
+		attached := make(chan struct{})
+		defer func() { <-attached }()
+		go func() {
+			defer close(attached)
+			prog.Attach(done)
+		}()
+	}
+	defer close(done)
+
+	go func() {
+		var err error
+		if prog.CopyInput != nil {
+			err = prog.CopyInput(ptmx, h.input)
+		} else {
+			_, err = io.Copy(ptmx, h.input)
+		}
+		if err != nil {
+			logrus.Error("cannot copy p.input to ptmx: ", err)
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case winsize := <-h.winsizeChan:
+				if err := pty.Setsize(ptmx, &winsize); err != nil {
+					logrus.Errorf("%s provider: unable to resize pty: %v", prog.Name, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case ac := <-h.acceptChan:
+				if err := prog.Accept(ptmx, ac); err != nil {
+					logrus.Infof("%s provider: cannot accept completion: %v", prog.Name, err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if _, err = io.Copy(h.Output(), ptmx); err != nil {
+		logrus.Error("cannot copy ptmx to p.output: ", err)
+		return errors.Wrap(err, "cannot copy")
+	}
+
+	return
+}
+
+// Stop hangs up the program like a closed terminal would, which makes Start
+// return. It is safe to be called before Start or more than once.
+func (h *Host) Stop() error {
+	h.cmdMut.Lock()
+	defer h.cmdMut.Unlock()
+
+	h.stopped = true
+	if h.cmd == nil {
+		return nil
+	}
+	if err := h.cmd.Process.Signal(syscall.SIGHUP); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return errors.Wrapf(err, "cannot hang up %s", filepath.Base(h.cmd.Path))
+	}
+	return nil
+}
+
+func (h *Host) startKeyListener(sock net.Listener, prog Program) {
+
+	logrus.Trace("starting key listener")
+
+	for {
+		conn, err := sock.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				logrus.Trace("key listener closed")
+				return
+			}
+			logrus.Errorln(errors.Wrap(err, "key listener accept failed"))
+			continue
+		}
+		go h.receiveRawCompletionSourceInfo(conn, prog)
+	}
+
+}
+
+func (h *Host) receiveRawCompletionSourceInfo(conn net.Conn, prog Program) {
+	logrus.Trace("receiving raw CSI")
+	rcsi, err := io.ReadAll(conn)
+	if err != nil {
+		logrus.Errorf("unable to read key listener socket: %+v", errors.Wrap(err, "cannot read key listener socket"))
+		return
+	}
+
+	if err := conn.Close(); err != nil {
+		logrus.Error(errors.Wrap(err, "cannot close conn"))
+	}
+
+	s, err := cmdline.Unmarshal(rcsi)
+	if err != nil {
+		logrus.Errorf("cannot translate raw CSI: %+v", errors.Wrap(err, "cannot translate raw CSI"))
+		return
+	}
+	s.Split = prog.Split
+
+	r, ok := h.Requests.Begin(s.RequestID, s.Executing)
+	if !ok {
+		logrus.Tracef("dropping stale request %d", s.RequestID)
+		return
+	}
+	defer r.End()
+	s.RequestID = r.ID
+
+	r.Run(s, func(ctx context.Context, handle func(ci *protoclui.CompletionInfo)) error {
+		return prog.Complete(ctx, s, handle)
+	})
+}
+
+// lockedWriter writes to w while holding mut
+type lockedWriter struct {
+	mut *sync.Mutex
+	w   io.Writer
+}
+
+func (lw *lockedWriter) Write(b []byte) (int, error) {
+	lw.mut.Lock()
+	defer lw.mut.Unlock()
+	return lw.w.Write(b)
+}
@@ -0,0 +1,119 @@
+package host
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kr/pty"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+type recordingHandler struct {
+	cis chan *protoclui.CompletionInfo
+}
+
+func (h *recordingHandler) Handle(ci *protoclui.CompletionInfo) {
+	h.cis <- ci
+}
+
+func TestStart(t *testing.T) {
+	require := require.New(t)
+
+	// the sockets of the providers are nobody else's business
+	sockPath, err := SockPath(filepath.Join(t.TempDir(), "tmp"))
+	require.NoError(err)
+	info, err := os.Stat(filepath.Dir(sockPath))
+	require.NoError(err)
+	require.Equal(os.ModeDir|0700, info.Mode())
+
+	h := &Host{}
+	handler := &recordingHandler{cis: make(chan *protoclui.CompletionInfo, 1)}
+	accepted := make(chan cmdline.Source, 1)
+	h.SetDir(t.TempDir())
+	h.SetInput(strings.NewReader(""))
+	h.SetOutput(io.Discard)
+	h.SetCompOptHandler(handler)
+	h.SetWinsizeChan(make(chan pty.Winsize))
+	acceptChan := make(chan *protoclui.AcceptCompletion)
+	h.SetAcceptChan(acceptChan)
+
+	split := &cmdline.Split{IsBreak: func(r rune) bool { return r == '.' }}
+	started := make(chan error, 1)
+	go func() {
+		started <- h.Start(Program{
+			Name:        "test",
+			Command:     exec.Command("/bin/sh", "-c", "sleep 10"),
+			KeyListener: sockPath,
+			Split:       split,
+			Complete: Get(func(ctx context.Context, s cmdline.Source) (*protoclui.CompletionInfo, error) {
+				left, _ := s.CurrentWord()
+				return &protoclui.CompletionInfo{
+					RequestId: s.RequestID,
+					Entries:   []*protoclui.CompletionEntry{{Suggestion: left + "path"}},
+				}, nil
+			}),
+			Accept: func(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+				s, _, err := h.Accepted(ac)
+				accepted <- s
+				return err
+			},
+		})
+	}()
+
+	// the line is reported like a key listener does
+	b, err := proto.Marshal(&protoclui.CompletionSourceInfo{RequestId: 3, LBuffer: "os.pa", Buffer: "os.pa"})
+	require.NoError(err)
+	var conn net.Conn
+	require.Eventually(func() bool {
+		conn, err = net.Dial("unixpacket", sockPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = conn.Write(b)
+	require.NoError(err)
+	require.NoError(conn.Close())
+
+	// the program splits its words itself
+	ci := <-handler.cis
+	require.Equal(uint64(3), ci.RequestId)
+	require.Equal("papath", ci.Entries[0].Suggestion)
+
+	acceptChan <- &protoclui.AcceptCompletion{RequestId: 3}
+	s := <-accepted
+	require.Equal("os.pa", s.LBuffer)
+	require.Equal(split, s.Split)
+
+	require.NoError(h.Stop())
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		require.Fail("program not stopped")
+	}
+	_, err = os.Stat(sockPath)
+	require.True(os.IsNotExist(err))
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	require := require.New(t)
+
+	h := &Host{}
+	h.SetDir(t.TempDir())
+	h.SetInput(strings.NewReader(""))
+	h.SetOutput(io.Discard)
+	h.SetCompOptHandler(&recordingHandler{})
+	h.SetWinsizeChan(make(chan pty.Winsize))
+	h.SetAcceptChan(make(chan *protoclui.AcceptCompletion))
+
+	require.NoError(h.Stop())
+	require.Error(h.Start(Program{Name: "test", Command: exec.Command("/bin/sh")}))
+	require.Error((&Host{}).Start(Program{Name: "test", Command: exec.Command("/bin/sh")}), "options not set")
+}
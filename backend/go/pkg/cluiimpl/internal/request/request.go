@@ -0,0 +1,192 @@
+// Package request orders the completion requests of a provider and delivers
+// their results, it is shared by all providers so that each of them only has
+// to spawn its program and complete a line.
+package request
+
+import (
+	"context"
+	"sync"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+)
+
+// Tracker registers the requests of a provider, the newest request cancels
+// the one in flight before it, and passes their results to Handler in request
+// order. The latest delivered result is kept, it is what accepted entries
+// refer to. The zero value is ready to use once Handler is set.
+type Tracker struct {
+	// Handler receives the results, it is never called concurrently
+	Handler clui.CompletionInfoHandler
+
+	// requestMut guards latestRequestID, cancelLatest and atPrompt
+	requestMut      sync.Mutex
+	latestRequestID uint64
+	cancelLatest    context.CancelFunc
+	// atPrompt reports whether the program was editing a line as of the
+	// latest request, nothing may be typed into it otherwise
+	atPrompt bool
+
+	// deliverMut guards deliveredRequestID, deliveredSource and delivered,
+	// and serialises calls to Handler
+	deliverMut         sync.Mutex
+	deliveredRequestID uint64
+	deliveredSource    interface{}
+	delivered          *protoclui.CompletionInfo
+}
+
+// Request is a request registered by Begin
+type Request struct {
+	// ID is the id of the request, it is assigned by Begin if the program
+	// did not give one
+	ID uint64
+	// Executing is set when the program leaves its prompt to run the line
+	// instead of editing it
+	Executing bool
+
+	t   *Tracker
+	ctx context.Context
+}
+
+// Begin registers the request id as the latest one and cancels the one in
+// flight before it. A request without an id is given the next one. It returns
+// false if a newer request has already been seen.
+func (t *Tracker) Begin(id uint64, executing bool) (r *Request, ok bool) {
+	t.requestMut.Lock()
+	defer t.requestMut.Unlock()
+
+	if id == 0 {
+		id = t.latestRequestID + 1
+	}
+	if id <= t.latestRequestID {
+		return nil, false
+	}
+
+	if t.cancelLatest != nil {
+		t.cancelLatest()
+	}
+	r = &Request{ID: id, Executing: executing, t: t}
+	r.ctx, t.cancelLatest = context.WithCancel(context.Background())
+	t.latestRequestID = id
+	t.atPrompt = !executing
+	return r, true
+}
+
+// Latest returns the id of the latest request
+func (t *Tracker) Latest() uint64 {
+	t.requestMut.Lock()
+	defer t.requestMut.Unlock()
+
+	return t.latestRequestID
+}
+
+// Context is cancelled once a newer request is registered or r has ended
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+// End releases the context of r if it is still the latest request, it is safe
+// to be called more than once
+func (r *Request) End() {
+	r.t.requestMut.Lock()
+	defer r.t.requestMut.Unlock()
+
+	if r.ID == r.t.latestRequestID && r.t.cancelLatest != nil {
+		r.t.cancelLatest()
+		r.t.cancelLatest = nil
+	}
+}
+
+// Run passes the results complete gives to handle for the line described by
+// source on to Handler. If complete fails for any other reason than r being
+// superseded, no entries are delivered for r. Nothing is completed for a line
+// that is run, whatever was offered for it is gone.
+func (r *Request) Run(source interface{}, complete func(ctx context.Context, handle func(ci *protoclui.CompletionInfo)) error) {
+	if r.Executing {
+		r.Clear(source)
+		return
+	}
+
+	err := complete(r.ctx, func(ci *protoclui.CompletionInfo) {
+		r.t.Deliver(source, ci)
+	})
+	if err != nil {
+		if r.ctx.Err() != nil {
+			logrus.Tracef("request %d superseded: %v", r.ID, err)
+			return
+		}
+		logrus.Errorf("cannot get completion: %+v", errors.Wrap(err, "cannot get completion"))
+		r.Clear(source)
+	}
+}
+
+// Get is Run for a completer that gives a single result
+func (r *Request) Get(source interface{}, get func(ctx context.Context) (*protoclui.CompletionInfo, error)) {
+	r.Run(source, func(ctx context.Context, handle func(ci *protoclui.CompletionInfo)) error {
+		ci, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		handle(ci)
+		return nil
+	})
+}
+
+// Clear delivers no entries for r, so that the frontend stops showing those of
+// an earlier line
+func (r *Request) Clear(source interface{}) {
+	r.t.Deliver(source, &protoclui.CompletionInfo{RequestId: r.ID, Done: true})
+}
+
+// Deliver passes ci, the result for the line described by source, to Handler
+// unless a newer result has been delivered already. Follow-ups are only
+// passed on as long as their request is the latest one delivered.
+func (t *Tracker) Deliver(source interface{}, ci *protoclui.CompletionInfo) {
+	t.deliverMut.Lock()
+	defer t.deliverMut.Unlock()
+
+	if clui.IsFollowUp(ci) {
+		if ci.RequestId != t.deliveredRequestID || !clui.ApplyFollowUp(t.delivered, ci) {
+			logrus.Tracef("dropping follow-up of %d, %d already delivered", ci.RequestId, t.deliveredRequestID)
+			return
+		}
+		t.Handler.Handle(ci)
+		return
+	}
+
+	if ci.RequestId <= t.deliveredRequestID {
+		logrus.Tracef("dropping out-of-order result %d, %d already delivered", ci.RequestId, t.deliveredRequestID)
+		return
+	}
+	t.deliveredRequestID = ci.RequestId
+	t.deliveredSource = source
+	// follow-ups are applied to a clone, ci belongs to Handler now
+	t.delivered = proto.Clone(ci).(*protoclui.CompletionInfo)
+	t.Handler.Handle(ci)
+}
+
+// Accepted returns the entry accepted on the frontend along with the source
+// of the line it was offered for. It fails if the entry does not belong to the
+// latest delivered result, or if the program has left its prompt since.
+func (t *Tracker) Accepted(ac *protoclui.AcceptCompletion) (source interface{}, entry *protoclui.CompletionEntry, err error) {
+	t.requestMut.Lock()
+	atPrompt := t.atPrompt
+	t.requestMut.Unlock()
+	if !atPrompt {
+		return nil, nil, errors.New("not at the prompt")
+	}
+
+	t.deliverMut.Lock()
+	defer t.deliverMut.Unlock()
+
+	if t.delivered == nil || ac.RequestId != t.delivered.RequestId {
+		return nil, nil, errors.Errorf("request %d is not the latest delivered one", ac.RequestId)
+	}
+	if int(ac.EntryIndex) >= len(t.delivered.Entries) {
+		return nil, nil, errors.Errorf("request %d has no entry %d", ac.RequestId, ac.EntryIndex)
+	}
+	return t.deliveredSource, proto.Clone(t.delivered.Entries[ac.EntryIndex]).(*protoclui.CompletionEntry), nil
+}
@@ -0,0 +1,150 @@
+package request
+
+import (
+	"context"
+	"testing"
+
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingHandler struct {
+	cis []*protoclui.CompletionInfo
+}
+
+func (h *recordingHandler) Handle(ci *protoclui.CompletionInfo) {
+	h.cis = append(h.cis, ci)
+}
+
+func (h *recordingHandler) ids() (ids []uint64) {
+	for _, ci := range h.cis {
+		ids = append(ids, ci.RequestId)
+	}
+	return
+}
+
+func TestRequestOrdering(t *testing.T) {
+	require := require.New(t)
+
+	h := &recordingHandler{}
+	tr := &Tracker{Handler: h}
+
+	r1, ok := tr.Begin(1, false)
+	require.True(ok)
+	r2, ok := tr.Begin(2, false)
+	require.True(ok)
+
+	// a newer request cancels the one in flight
+	require.NotNil(r1.Context().Err())
+	require.Nil(r2.Context().Err())
+
+	// a request arriving after a newer one is dropped
+	_, ok = tr.Begin(1, false)
+	require.False(ok)
+
+	// requests without id are numbered after the latest one
+	r3, ok := tr.Begin(0, false)
+	require.True(ok)
+	require.Equal(uint64(3), r3.ID)
+	require.Equal(uint64(3), tr.Latest())
+
+	// ending a request that is not the latest one leaves the latest alone
+	r2.End()
+	require.Nil(r3.Context().Err())
+	r3.End()
+	require.NotNil(r3.Context().Err())
+
+	tr.Deliver(nil, &protoclui.CompletionInfo{RequestId: 2})
+	tr.Deliver(nil, &protoclui.CompletionInfo{RequestId: 1})
+	handled := &protoclui.CompletionInfo{
+		RequestId: 3,
+		Entries:   []*protoclui.CompletionEntry{{Suggestion: "ls"}},
+	}
+	tr.Deliver(nil, handled)
+	require.Equal([]uint64{2, 3}, h.ids())
+
+	// follow-ups are only delivered for the latest delivered request
+	late := []*protoclui.EntryDescription{{EntryIndex: 0, Description: "list directory contents"}}
+	tr.Deliver(nil, &protoclui.CompletionInfo{RequestId: 2, Sequence: 1, LateDescriptions: late})
+	tr.Deliver(nil, &protoclui.CompletionInfo{RequestId: 3, Sequence: 1, LateDescriptions: late})
+	require.Equal([]uint64{2, 3, 3}, h.ids())
+	require.Equal("list directory contents", tr.delivered.Entries[0].Description)
+	// without changing what the handler was given behind its back
+	require.Equal("", handled.Entries[0].Description)
+}
+
+func TestRun(t *testing.T) {
+	require := require.New(t)
+
+	h := &recordingHandler{}
+	tr := &Tracker{Handler: h}
+
+	// every update is delivered
+	r, _ := tr.Begin(1, false)
+	r.Run("line", func(ctx context.Context, handle func(ci *protoclui.CompletionInfo)) error {
+		handle(&protoclui.CompletionInfo{RequestId: 1, Entries: []*protoclui.CompletionEntry{{Suggestion: "ls"}}})
+		handle(&protoclui.CompletionInfo{RequestId: 1, Sequence: 1, Done: true})
+		return nil
+	})
+	require.Len(h.cis, 2)
+	require.True(h.cis[1].Done)
+
+	// a failed completion clears the entries of the line before
+	r, _ = tr.Begin(2, false)
+	r.Get("line", func(ctx context.Context) (*protoclui.CompletionInfo, error) {
+		return nil, errors.New("no completion")
+	})
+	require.Len(h.cis, 3)
+	require.Equal(uint64(2), h.cis[2].RequestId)
+	require.Empty(h.cis[2].Entries)
+	require.True(h.cis[2].Done)
+
+	// a superseded one delivers nothing
+	r, _ = tr.Begin(3, false)
+	r.Get("line", func(ctx context.Context) (*protoclui.CompletionInfo, error) {
+		tr.Begin(4, false)
+		return nil, ctx.Err()
+	})
+	require.Len(h.cis, 3)
+
+	// and nothing is completed for a line that is run
+	r, _ = tr.Begin(5, true)
+	r.Get("line", func(ctx context.Context) (*protoclui.CompletionInfo, error) {
+		require.Fail("completed a line that is run")
+		return nil, nil
+	})
+	require.Len(h.cis, 4)
+	require.Equal(uint64(5), h.cis[3].RequestId)
+	require.Empty(h.cis[3].Entries)
+}
+
+func TestAccepted(t *testing.T) {
+	require := require.New(t)
+
+	tr := &Tracker{Handler: &recordingHandler{}}
+	_, _, err := tr.Accepted(&protoclui.AcceptCompletion{RequestId: 1})
+	require.Error(err, "nothing delivered")
+
+	tr.Begin(2, false)
+	tr.Deliver("git chec", &protoclui.CompletionInfo{
+		RequestId: 2,
+		Entries:   []*protoclui.CompletionEntry{{Suggestion: "checkout"}},
+	})
+	_, _, err = tr.Accepted(&protoclui.AcceptCompletion{RequestId: 1})
+	require.Error(err, "stale request")
+	_, _, err = tr.Accepted(&protoclui.AcceptCompletion{RequestId: 2, EntryIndex: 1})
+	require.Error(err, "entry out of range")
+	source, entry, err := tr.Accepted(&protoclui.AcceptCompletion{RequestId: 2})
+	require.NoError(err)
+	require.Equal("git chec", source)
+	require.Equal("checkout", entry.Suggestion)
+
+	// once the line is run nothing may be typed, until the next prompt
+	tr.Begin(3, true)
+	_, _, err = tr.Accepted(&protoclui.AcceptCompletion{RequestId: 2})
+	require.Error(err, "not at the prompt")
+	tr.Begin(4, false)
+	_, _, err = tr.Accepted(&protoclui.AcceptCompletion{RequestId: 2})
+	require.NoError(err)
+}
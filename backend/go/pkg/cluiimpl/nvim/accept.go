@@ -0,0 +1,35 @@
+package nvim
+
+import (
+	"context"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+)
+
+// lineEdit is an edit of the line being edited in mode
+type lineEdit struct {
+	mode string
+	cmdline.Edit
+}
+
+// acceptEdit returns the edit that accepts entry for the line described by
+// csi, the word under the cursor is replaced by the suggestion. Unlike in a
+// shell nothing is appended, what follows a word depends on the text.
+func acceptEdit(csi completionSourceInfo, entry *protoclui.CompletionEntry) lineEdit {
+	return lineEdit{mode: csi.mode, Edit: csi.Replace(entry.Suggestion)}
+}
+
+// apply makes nvim apply e, nvim itself checks that the line has not changed
+// since the entry was offered
+func (e lineEdit) apply(ctx context.Context, nvim caller) error {
+	res, err := nvim.call(ctx, "nvim_exec_lua", "return clui.accept(...)", []interface{}{e.mode, e.Left, e.Right, e.Text})
+	if err != nil {
+		return errors.Wrap(err, "cannot accept in nvim")
+	}
+	if applied, _ := res.(bool); !applied {
+		return errors.New("line changed, completion not applied")
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package nvim
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the modes clui.lua reports lines in
+const (
+	modeInsert  = "i"
+	modeCmdline = "c"
+	// modeIdle is reported when nothing is being edited anymore
+	modeIdle = "n"
+)
+
+// completionSourceInfo is the line being edited in nvim along with the mode
+// it is edited in
+type completionSourceInfo struct {
+	cmdline.Source
+	mode string
+}
+
+// isKeyword returns whether r is part of a word in insert mode, like the
+// keyword pattern of clui.lua
+func isKeyword(r rune) bool {
+	return r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+// keywordSplit makes the word under the cursor a keyword in insert mode
+var keywordSplit = &cmdline.Split{IsBreak: func(r rune) bool { return !isKeyword(r) }}
+
+// withMode returns the source of a line edited in mode. Words are separated
+// by whitespace on the command line and made of keyword characters in insert
+// mode.
+func withMode(mode string, s cmdline.Source) completionSourceInfo {
+	if mode == modeInsert {
+		s.Split = keywordSplit
+	}
+	return completionSourceInfo{Source: s, mode: mode}
+}
+
+// parseChange returns the completionSourceInfo of a clui_changed notification
+// of clui.lua, it has the line being edited and the cursor as the number of
+// bytes before it
+func parseChange(params []interface{}) (csi completionSourceInfo, err error) {
+	if len(params) != 1 {
+		return csi, errors.Errorf("clui_changed has %d params instead of 1", len(params))
+	}
+	state, ok := params[0].(map[string]interface{})
+	if !ok {
+		return csi, errors.Errorf("clui_changed has a %T instead of a state", params[0])
+	}
+
+	id, _ := state["id"].(int64)
+	col, _ := state["col"].(int64)
+	row, _ := state["screen_row"].(int64)
+	screenCol, _ := state["screen_col"].(int64)
+	mode, _ := state["mode"].(string)
+	s := cmdline.Source{RequestID: uint64(id), Line: int(row), Col: int(screenCol)}
+	s.Dir, _ = state["dir"].(string)
+	s.Buffer, _ = state["line"].(string)
+
+	if col < 0 || int(col) > len(s.Buffer) {
+		return csi, errors.Errorf("cursor %d is outside of the line", col)
+	}
+	s.LBuffer = s.Buffer[:col]
+	s.RBuffer = s.Buffer[col:]
+	return withMode(mode, s), nil
+}
+
+// isFirstWord returns whether the ex command itself is being completed
+func (csi *completionSourceInfo) isFirstWord() bool {
+	return csi.mode == modeCmdline && csi.IsFirstWord()
+}
+
+// isEmpty returns whether there is nothing to complete, like isFirstWord it
+// only looks at the line up to the end of the word under the cursor
+func (csi *completionSourceInfo) isEmpty() bool {
+	return csi.mode == modeIdle || csi.IsEmpty()
+}
+
+// caller calls the API of nvim, it is implemented by rpcClient
+type caller interface {
+	call(ctx context.Context, method string, args ...interface{}) (interface{}, error)
+}
+
+type completer struct {
+	nvim caller
+	// lspTimeout is the time the language servers are given to complete
+	// after the other candidates have been delivered
+	lspTimeout time.Duration
+
+	// lspMut guards lspWaiting, the requests waiting for the candidates of
+	// the language servers by their id
+	lspMut     sync.Mutex
+	lspWaiting map[uint64]chan []candidate
+}
+
+// candidate is a completion offered by nvim
+type candidate struct {
+	word        string
+	description string
+}
+
+// parseCandidates returns the candidates of a list of { word, description }
+// of clui.lua
+func parseCandidates(items interface{}) (candidates []candidate) {
+	list, _ := items.([]interface{})
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		var c candidate
+		c.word, _ = m["word"].(string)
+		if d, ok := m["description"]; ok && d != nil {
+			c.description = fmt.Sprint(d)
+		}
+		candidates = append(candidates, c)
+	}
+	return
+}
+
+// capture returns the candidates clui.lua offers for the word before the
+// cursor, lsp is set if the language servers have been asked as well, their
+// candidates come in a clui_lsp notification
+func (co *completer) capture(ctx context.Context, csi completionSourceInfo) (candidates []candidate, lsp bool, err error) {
+	res, err := co.nvim.call(ctx, "nvim_exec_lua", "return clui.complete(...)", []interface{}{
+		csi.mode, csi.LBuffer, csi.RBuffer, csi.RequestID,
+	})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "cannot complete in nvim")
+	}
+	m, _ := res.(map[string]interface{})
+	lsp, _ = m["lsp"].(bool)
+	return parseCandidates(m["items"]), lsp, nil
+}
+
+// cancelLSP cancels the language server request of request id in clui.lua,
+// its candidates are not waited for anymore. It is given a context of its own,
+// that of the request may be done already.
+func (co *completer) cancelLSP(id uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), attachTimeout)
+	defer cancel()
+	if _, err := co.nvim.call(ctx, "nvim_exec_lua", "clui.cancel(...)", []interface{}{id}); err != nil {
+		logrus.Errorf("cannot cancel language server request %d: %v", id, err)
+	}
+}
+
+// waitLSP registers the request id as waiting for the candidates of the
+// language servers, stop must be called once they are not waited for anymore
+func (co *completer) waitLSP(id uint64) (candidates <-chan []candidate, stop func()) {
+	co.lspMut.Lock()
+	defer co.lspMut.Unlock()
+
+	if co.lspWaiting == nil {
+		co.lspWaiting = map[uint64]chan []candidate{}
+	}
+	c := make(chan []candidate, 1)
+	co.lspWaiting[id] = c
+	return c, func() {
+		co.lspMut.Lock()
+		defer co.lspMut.Unlock()
+		delete(co.lspWaiting, id)
+	}
+}
+
+// lspCompleted passes the candidates of a clui_lsp notification of clui.lua
+// on to the request waiting for them, those of requests that are not waited
+// for anymore are dropped
+func (co *completer) lspCompleted(params []interface{}) error {
+	if len(params) != 1 {
+		return errors.Errorf("clui_lsp has %d params instead of 1", len(params))
+	}
+	result, ok := params[0].(map[string]interface{})
+	if !ok {
+		return errors.Errorf("clui_lsp has a %T instead of a result", params[0])
+	}
+	id, _ := result["id"].(int64)
+
+	co.lspMut.Lock()
+	defer co.lspMut.Unlock()
+
+	c, ok := co.lspWaiting[uint64(id)]
+	if !ok {
+		logrus.Tracef("dropping language server candidates of request %d", id)
+		return nil
+	}
+	delete(co.lspWaiting, uint64(id))
+	c <- parseCandidates(result["items"])
+	return nil
+}
+
+// streamCompletion passes the candidates nvim offers for the word under the
+// cursor of csi to handle. Those of the language servers follow in a second
+// update once they have answered, or the first is followed by an empty one
+// after lspTimeout and the language servers are told to stop.
+func (co *completer) streamCompletion(ctx context.Context, csi completionSourceInfo, handle func(ci *protoclui.CompletionInfo)) error {
+
+	logrus.Tracef("completing request %d for %s in mode %s", csi.RequestID, csi.Buffer, csi.mode)
+
+	ci := &protoclui.CompletionInfo{RequestId: csi.RequestID, Done: true}
+
+	ci.Col = int32(csi.Col)
+	ci.Line = int32(csi.Line)
+	ci.IsEmpty = csi.isEmpty()
+	ci.IsFirst = csi.isFirstWord()
+	ci.BufferLength = int32(len(csi.Buffer))
+
+	left, _ := csi.CurrentWord()
+	if ci.IsEmpty || (csi.mode == modeInsert && left == "") {
+		handle(ci)
+		return nil
+	}
+
+	// the request waits before it is made, the clui_lsp notification may be
+	// handled before the result of clui.complete is
+	lspCandidates, stop := co.waitLSP(csi.RequestID)
+	defer stop()
+
+	candidates, lsp, err := co.capture(ctx, csi)
+	if err != nil {
+		return err
+	}
+	ci.Entries = csi.entries(candidates)
+	ci.Done = !lsp
+	handle(ci)
+	if ci.Done {
+		return nil
+	}
+
+	fu := &protoclui.CompletionInfo{RequestId: csi.RequestID, Sequence: 1, Done: true}
+	select {
+	case candidates := <-lspCandidates:
+		fu.Entries = csi.entries(candidates)
+	case <-time.After(co.lspTimeout):
+		logrus.Tracef("language servers did not complete request %d in time", csi.RequestID)
+		co.cancelLSP(csi.RequestID)
+	case <-ctx.Done():
+		co.cancelLSP(csi.RequestID)
+		return ctx.Err()
+	}
+	handle(fu)
+	return nil
+}
+
+// entries returns the entries of the candidates for the word under the cursor
+// of csi
+func (csi *completionSourceInfo) entries(candidates []candidate) (entries []*protoclui.CompletionEntry) {
+	left, right := csi.CurrentWord()
+	for _, c := range candidates {
+		compopt, description := c.word, c.description
+		if compopt == "" {
+			continue
+		}
+
+		// actualInput is what has to be typed at the cursor to get compopt,
+		// if compopt does not start with left and end with right the
+		// frontend is told to leave typing it to the user
+		var actualInput string
+		var shouldInput bool
+		if strings.HasPrefix(compopt, left) && strings.HasSuffix(compopt[len(left):], right) {
+			actualInput = compopt[len(left) : len(compopt)-len(right)]
+			shouldInput = true
+		} else {
+			actualInput = compopt
+			shouldInput = false
+		}
+
+		entries = append(entries, &protoclui.CompletionEntry{
+			ActualInput: actualInput,
+			ShouldInput: shouldInput,
+			Description: description,
+			Suggestion:  compopt,
+			Level:       0,
+			MatchRanges: matchRanges(left, compopt),
+		})
+	}
+	return
+}
+
+// matchRanges returns the range of the characters of candidate that match the
+// part of the word before the cursor as a prefix
+func matchRanges(left string, candidate string) []*protoclui.MatchRange {
+	if left == "" || !strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(left)) {
+		return nil
+	}
+	return []*protoclui.MatchRange{{Start: 0, End: uint32(len([]rune(left)))}}
+}
@@ -0,0 +1,306 @@
+package nvim
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgpack(t *testing.T) {
+	require := require.New(t)
+
+	var buf bytes.Buffer
+	enc := &encoder{w: &buf}
+	require.NoError(enc.encode([]interface{}{0, uint32(7), "nvim_get_api_info", []interface{}{}}))
+	require.Equal([]byte{0x94, 0x00, 0x07, 0xb1}, buf.Bytes()[:4])
+
+	long := string(bytes.Repeat([]byte("x"), 300))
+	values := []interface{}{
+		nil, true, false,
+		int64(0), int64(127), int64(-1), int64(-32), int64(-33), int64(1 << 40), int64(-1 << 40),
+		uint64(1 << 63), 1.5,
+		"", "héllo", long,
+		[]interface{}{int64(1), "a", []interface{}{}},
+		map[string]interface{}{"word": "checkout", "description": "Switch branches"},
+	}
+	for _, v := range values {
+		buf.Reset()
+		require.NoError(enc.encode(v), "%v", v)
+		decoded, err := newDecoder(&buf).decode()
+		require.NoError(err, "%v", v)
+		require.Equal(v, decoded)
+	}
+
+	// integers and binaries in other formats, and buffers as extensions
+	dec := newDecoder(bytes.NewReader([]byte{
+		0xcc, 0xff,
+		0xd1, 0xff, 0x00,
+		0xca, 0x3f, 0xc0, 0x00, 0x00,
+		0xc4, 0x02, 'o', 'k',
+		0xd4, 0x00, 0x01,
+	}))
+	for _, want := range []interface{}{int64(255), int64(-256), 1.5, "ok", ext{typ: 0, data: []byte{1}}} {
+		v, err := dec.decode()
+		require.NoError(err)
+		require.Equal(want, v)
+	}
+
+	require.Error(enc.encode(struct{}{}))
+}
+
+// fakeNvim answers the requests of an rpcClient on the other end of a pipe
+func fakeNvim(t *testing.T, conn net.Conn, answer func(method string, args []interface{}) (interface{}, interface{})) {
+	enc := &encoder{w: conn}
+	dec := newDecoder(conn)
+	for {
+		v, err := dec.decode()
+		if err != nil {
+			return
+		}
+		msg := v.([]interface{})
+		args, _ := msg[3].([]interface{})
+		rerr, result := answer(msg[2].(string), args)
+		if err := enc.encode([]interface{}{rpcResponse, msg[1], rerr, result}); err != nil {
+			t.Log("fake nvim: ", err)
+			return
+		}
+	}
+}
+
+func TestRPC(t *testing.T) {
+	require := require.New(t)
+
+	clientConn, nvimConn := net.Pipe()
+	notifications := make(chan string, 1)
+	client := newRPCClient(clientConn, func(method string, params []interface{}) {
+		notifications <- method + ":" + params[0].(string)
+	})
+
+	go fakeNvim(t, nvimConn, func(method string, args []interface{}) (interface{}, interface{}) {
+		switch method {
+		case "nvim_get_api_info":
+			// notifications arrive in between responses
+			_ = (&encoder{w: nvimConn}).encode([]interface{}{rpcNotification, changedEvent, []interface{}{"hi"}})
+			return nil, []interface{}{int64(3), map[string]interface{}{}}
+		case "slow":
+			time.Sleep(100 * time.Millisecond)
+			return nil, nil
+		}
+		return []interface{}{int64(0), "Invalid method: " + method}, nil
+	})
+
+	res, err := client.call(context.Background(), "nvim_get_api_info")
+	require.NoError(err)
+	require.Equal(int64(3), res.([]interface{})[0])
+	require.Equal(changedEvent+":hi", <-notifications)
+
+	_, err = client.call(context.Background(), "nvim_nope")
+	require.EqualError(err, "nvim_nope failed: Invalid method: nvim_nope")
+
+	// a caller may give up waiting, the late response is dropped
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = client.call(ctx, "slow")
+	require.True(errors.Is(err, context.DeadlineExceeded))
+	_, err = client.call(context.Background(), "nvim_get_api_info")
+	require.NoError(err)
+	<-notifications
+
+	// calls fail once nvim is gone
+	require.NoError(nvimConn.Close())
+	<-client.done
+	_, err = client.call(context.Background(), "nvim_get_api_info")
+	require.Error(err)
+	require.NoError(client.close())
+}
+
+func TestParseChange(t *testing.T) {
+	require := require.New(t)
+
+	csi, err := parseChange([]interface{}{map[string]interface{}{
+		"id": int64(4), "mode": "c", "line": "e src/ma", "col": int64(5),
+		"screen_row": int64(40), "screen_col": int64(7), "dir": "/tmp",
+	}})
+	require.NoError(err)
+	require.Equal(withMode(modeCmdline, cmdline.Source{
+		RequestID: 4, Line: 40, Col: 7, Dir: "/tmp",
+		Buffer: "e src/ma", LBuffer: "e src", RBuffer: "/ma",
+	}), csi)
+
+	_, err = parseChange([]interface{}{map[string]interface{}{"line": "ab", "col": int64(3)}})
+	require.Error(err, "cursor outside of the line")
+	_, err = parseChange(nil)
+	require.Error(err)
+}
+
+func TestCurrentWord(t *testing.T) {
+	require := require.New(t)
+
+	// insert mode completes keywords, the command line whole words
+	csi := withMode(modeInsert, cmdline.Source{LBuffer: "\tfoo.ba", RBuffer: "r(x)"})
+	left, right := csi.CurrentWord()
+	require.Equal("ba", left)
+	require.Equal("r", right)
+	require.False(csi.isFirstWord())
+
+	csi = withMode(modeCmdline, cmdline.Source{LBuffer: "e src/ma", RBuffer: "in.go", Buffer: "e src/main.go"})
+	left, right = csi.CurrentWord()
+	require.Equal("src/ma", left)
+	require.Equal("in.go", right)
+	require.False(csi.isFirstWord())
+
+	csi = withMode(modeCmdline, cmdline.Source{LBuffer: "ed", Buffer: "ed"})
+	require.True(csi.isFirstWord())
+
+	for _, csi := range []completionSourceInfo{
+		withMode(modeIdle, cmdline.Source{}),
+		withMode(modeInsert, cmdline.Source{Buffer: "  "}),
+		withMode(modeCmdline, cmdline.Source{Buffer: "  ls", LBuffer: " ", RBuffer: " ls"}),
+	} {
+		require.True(csi.isEmpty())
+	}
+}
+
+// fakeCaller answers nvim_exec_lua with result and records the arguments,
+// onCall is run before it answers
+type fakeCaller struct {
+	result interface{}
+	args   []interface{}
+	onCall func()
+}
+
+func (f *fakeCaller) call(ctx context.Context, method string, args ...interface{}) (interface{}, error) {
+	f.args = args
+	if f.onCall != nil {
+		f.onCall()
+	}
+	return f.result, nil
+}
+
+// streamAll returns the updates streamCompletion passes on for csi
+func streamAll(co *completer, csi completionSourceInfo) (cis []*protoclui.CompletionInfo, err error) {
+	err = co.streamCompletion(context.Background(), csi, func(ci *protoclui.CompletionInfo) {
+		cis = append(cis, ci)
+	})
+	return
+}
+
+func TestStreamCompletion(t *testing.T) {
+	require := require.New(t)
+
+	nvim := &fakeCaller{result: map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"word": "format", "description": "func(s string)"},
+			map[string]interface{}{"word": "Formatter", "description": "buffer"},
+			map[string]interface{}{"word": ""},
+		},
+		"lsp": false,
+	}}
+	co := &completer{nvim: nvim, lspTimeout: 200 * time.Millisecond}
+
+	csi := withMode(modeInsert, cmdline.Source{RequestID: 2, Buffer: "x.for()", LBuffer: "x.for", RBuffer: "()", Line: 3, Col: 6})
+	cis, err := streamAll(co, csi)
+	require.NoError(err)
+	require.Equal([]interface{}{"return clui.complete(...)", []interface{}{"i", "x.for", "()", uint64(2)}}, nvim.args)
+
+	require.Len(cis, 1)
+	ci := cis[0]
+	require.Equal(uint64(2), ci.RequestId)
+	require.True(ci.Done)
+	require.False(ci.IsFirst)
+	require.Len(ci.Entries, 2)
+	require.Equal("mat", ci.Entries[0].ActualInput)
+	require.True(ci.Entries[0].ShouldInput)
+	require.Equal("func(s string)", ci.Entries[0].Description)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 3}}, ci.Entries[0].MatchRanges)
+	require.False(ci.Entries[1].ShouldInput)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 3}}, ci.Entries[1].MatchRanges)
+
+	// nvim is not asked without a word to complete
+	nvim.args = nil
+	cis, err = streamAll(co, withMode(modeInsert, cmdline.Source{Buffer: "x.", LBuffer: "x."}))
+	require.NoError(err)
+	require.Len(cis, 1)
+	require.Empty(cis[0].Entries)
+	cis, err = streamAll(co, withMode(modeIdle, cmdline.Source{}))
+	require.NoError(err)
+	require.Len(cis, 1)
+	require.True(cis[0].IsEmpty)
+	require.Nil(nvim.args)
+}
+
+func TestStreamCompletionLSP(t *testing.T) {
+	require := require.New(t)
+
+	nvim := &fakeCaller{result: map[string]interface{}{
+		"items": []interface{}{map[string]interface{}{"word": "format", "description": "buffer"}},
+		"lsp":   true,
+	}}
+	co := &completer{nvim: nvim, lspTimeout: time.Minute}
+	csi := withMode(modeInsert, cmdline.Source{RequestID: 3, Buffer: "x.for", LBuffer: "x.for"})
+
+	// the language servers may answer before clui.complete has returned,
+	// those of other requests are dropped
+	nvim.onCall = func() {
+		require.NoError(co.lspCompleted([]interface{}{map[string]interface{}{"id": int64(2), "items": []interface{}{
+			map[string]interface{}{"word": "forget"},
+		}}}))
+		require.NoError(co.lspCompleted([]interface{}{map[string]interface{}{"id": int64(3), "items": []interface{}{
+			map[string]interface{}{"word": "formatted", "description": "func() bool"},
+		}}}))
+	}
+	cis, err := streamAll(co, csi)
+	require.NoError(err)
+	require.Len(cis, 2)
+	require.False(cis[0].Done)
+	require.Equal("format", cis[0].Entries[0].Suggestion)
+	require.Equal(uint64(3), cis[1].RequestId)
+	require.Equal(uint32(1), cis[1].Sequence)
+	require.True(cis[1].Done)
+	require.Len(cis[1].Entries, 1)
+	require.Equal("formatted", cis[1].Entries[0].Suggestion)
+	require.Equal("func() bool", cis[1].Entries[0].Description)
+	require.Empty(co.lspWaiting)
+	require.Equal("return clui.complete(...)", nvim.args[0])
+
+	// the language servers are not waited for longer than lspTimeout
+	nvim.onCall = nil
+	co.lspTimeout = 10 * time.Millisecond
+	cis, err = streamAll(co, csi)
+	require.NoError(err)
+	require.Len(cis, 2)
+	require.True(cis[1].Done)
+	require.Empty(cis[1].Entries)
+	// and are told to stop then, or once the request is cancelled
+	require.Equal([]interface{}{"clui.cancel(...)", []interface{}{uint64(3)}}, nvim.args)
+
+	co.lspTimeout = time.Minute
+	ctx, cancel := context.WithCancel(context.Background())
+	nvim.onCall = cancel
+	err = co.streamCompletion(ctx, csi, func(ci *protoclui.CompletionInfo) {})
+	require.ErrorIs(err, context.Canceled)
+	require.Equal([]interface{}{"clui.cancel(...)", []interface{}{uint64(3)}}, nvim.args)
+	require.Empty(co.lspWaiting)
+
+	require.Error(co.lspCompleted(nil))
+}
+
+func TestAccept(t *testing.T) {
+	require := require.New(t)
+
+	e := acceptEdit(withMode(modeInsert, cmdline.Source{LBuffer: "x.for", RBuffer: "()"}), &protoclui.CompletionEntry{Suggestion: "format"})
+	require.Equal(lineEdit{mode: modeInsert, Edit: cmdline.Edit{Left: "for", Text: "format"}}, e)
+
+	nvim := &fakeCaller{result: true}
+	require.NoError(e.apply(context.Background(), nvim))
+	require.Equal([]interface{}{"return clui.accept(...)", []interface{}{"i", "for", "", "format"}}, nvim.args)
+	nvim.result = false
+	require.Error(e.apply(context.Background(), nvim), "line changed")
+}
@@ -0,0 +1,279 @@
+package nvim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// ext is a msgpack extension value, nvim sends buffers, windows and tabpages
+// as those
+type ext struct {
+	typ  int8
+	data []byte
+}
+
+// encoder writes the msgpack encoding of the values nvim RPC needs: nil,
+// booleans, integers, floats, strings, byte slices, and slices and string
+// keyed maps of them
+type encoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *encoder) encode(v interface{}) error {
+	e.buf = e.buf[:0]
+	if err := e.append(v); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.buf)
+	return errors.Wrap(err, "cannot write msgpack")
+}
+
+func (e *encoder) append(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		e.buf = append(e.buf, 0xc0)
+	case bool:
+		if v {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case int:
+		e.appendInt(int64(v))
+	case int64:
+		e.appendInt(v)
+	case uint32:
+		e.appendInt(int64(v))
+	case uint64:
+		if v > math.MaxInt64 {
+			e.appendUint(0xcf, v, 8)
+		} else {
+			e.appendInt(int64(v))
+		}
+	case float64:
+		e.appendUint(0xcb, math.Float64bits(v), 8)
+	case string:
+		e.appendLen(len(v), 0xa0, 31, 0xd9, 0xda, 0xdb)
+		e.buf = append(e.buf, v...)
+	case []byte:
+		e.appendLen(len(v), 0, -1, 0xc4, 0xc5, 0xc6)
+		e.buf = append(e.buf, v...)
+	case []string:
+		e.appendLen(len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, s := range v {
+			_ = e.append(s)
+		}
+	case []interface{}:
+		e.appendLen(len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := e.append(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		e.appendLen(len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for key, item := range v {
+			_ = e.append(key)
+			if err := e.append(item); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.Errorf("cannot encode %T as msgpack", v)
+	}
+	return nil
+}
+
+func (e *encoder) appendInt(i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		e.buf = append(e.buf, byte(i))
+	case i < 0 && i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		e.appendUint(0xd2, uint64(uint32(i)), 4)
+	default:
+		e.appendUint(0xd3, uint64(i), 8)
+	}
+}
+
+// appendUint appends format followed by the size lowest bytes of u, big
+// endian
+func (e *encoder) appendUint(format byte, u uint64, size int) {
+	e.buf = append(e.buf, format)
+	for i := size - 1; i >= 0; i-- {
+		e.buf = append(e.buf, byte(u>>(8*i)))
+	}
+}
+
+// appendLen appends the header of a value of length n, fix is the fixed size
+// format for lengths up to fixMax and the others are the 8, 16 and 32 bit
+// formats, a zero format is not available for the type
+func (e *encoder) appendLen(n int, fix byte, fixMax int, f8 byte, f16 byte, f32 byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case f8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, f8, byte(n))
+	case n <= math.MaxUint16:
+		e.appendUint(f16, uint64(n), 2)
+	default:
+		e.appendUint(f32, uint64(n), 4)
+	}
+}
+
+// decoder reads msgpack values. Integers are decoded as int64, or uint64 if
+// they do not fit, strings and binaries as string, arrays as []interface{},
+// maps as map[string]interface{} and extensions as ext.
+type decoder struct {
+	r *bufio.Reader
+}
+
+func newDecoder(r io.Reader) *decoder {
+	return &decoder{r: bufio.NewReader(r)}
+}
+
+// argSizes are the sizes of the length or value following the formats that
+// have one
+var argSizes = map[byte]int{
+	0xc4: 1, 0xc5: 2, 0xc6: 4, // bin
+	0xc7: 1, 0xc8: 2, 0xc9: 4, // ext
+	0xca: 4, 0xcb: 8, // float
+	0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, // uint
+	0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, // int
+	0xd9: 1, 0xda: 2, 0xdb: 4, // str
+	0xdc: 2, 0xdd: 4, // array
+	0xde: 2, 0xdf: 4, // map
+}
+
+func (d *decoder) decode() (v interface{}, err error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return d.decodeMap(int(b & 0x0f))
+	case b&0xf0 == 0x90:
+		return d.decodeArray(int(b & 0x0f))
+	case b&0xe0 == 0xa0:
+		return d.decodeString(int(b & 0x1f))
+	}
+
+	var n uint64
+	if size, ok := argSizes[b]; ok {
+		if n, err = d.uint(size); err != nil {
+			return nil, err
+		}
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		return d.decodeString(int(n))
+	case 0xc7, 0xc8, 0xc9:
+		return d.decodeExt(int(n))
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xca:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		return math.Float64frombits(n), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		return int64(int8(n)), nil
+	case 0xd1:
+		return int64(int16(n)), nil
+	case 0xd2:
+		return int64(int32(n)), nil
+	case 0xd3:
+		return int64(n), nil
+	case 0xdc, 0xdd:
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		return d.decodeMap(int(n))
+	}
+	return nil, errors.Errorf("invalid msgpack format 0x%02x", b)
+}
+
+// uint reads a big endian unsigned integer of size bytes
+func (d *decoder) uint(size int) (u uint64, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(d.r, b[:size]); err != nil {
+		return
+	}
+	for _, c := range b[:size] {
+		u = u<<8 | uint64(c)
+	}
+	return
+}
+
+func (d *decoder) decodeString(n int) (interface{}, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) decodeExt(n int) (interface{}, error) {
+	typ, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return nil, err
+	}
+	return ext{typ: int8(typ), data: data}, nil
+}
+
+func (d *decoder) decodeArray(n int) (interface{}, error) {
+	a := make([]interface{}, n)
+	for i := range a {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *decoder) decodeMap(n int) (interface{}, error) {
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			key = fmt.Sprint(k)
+		}
+		m[key] = v
+	}
+	return m, nil
+}
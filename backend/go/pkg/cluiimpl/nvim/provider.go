@@ -0,0 +1,231 @@
+package nvim
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/host"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// the notifications of clui.lua, changedEvent is sent for every change of the
+// line being edited and lspEvent once the language servers have completed it
+const (
+	changedEvent = "clui_changed"
+	lspEvent     = "clui_lsp"
+)
+
+// setupChunk loads clui.lua into nvim as the global clui and makes it report
+// to the channel of the provider
+const setupChunk = `local path, chan = ...
+_G.clui = dofile(path)
+clui.setup(chan)`
+
+// the time nvim is given to create its socket, and the interval it is looked
+// for in
+const (
+	attachTimeout  = 5 * time.Second
+	attachInterval = 20 * time.Millisecond
+)
+
+// Provider provides the nvim implementation of clui, nvim runs with its own
+// user interface in a pty and is driven over msgpack-RPC on a socket
+type Provider struct {
+	host.Host
+	comp       *completer
+	pluginPath string
+	nvimPath   string
+	tmpPath    string
+
+	// rpcMut guards rpc, the connection to nvim, it is nil until attach has
+	// set up clui.lua
+	rpcMut sync.Mutex
+	rpc    *rpcClient
+}
+
+// NewProvider returns a new instance of Provider using default options
+func NewProvider() *Provider {
+	return &Provider{
+		comp:       &completer{lspTimeout: viper.GetDuration("NVIM_COMPLETER_LSP_TIMEOUT")},
+		pluginPath: viper.GetString("NVIM_PLUGIN_PATH"),
+		nvimPath:   viper.GetString("NVIM_PATH"),
+		tmpPath:    viper.GetString("CLUI_TMP_PATH"),
+	}
+}
+
+// Start performs the required preparation and then starts the nvim process,
+// as well as start providing completion results via compOptHandler
+func (p *Provider) Start() (err error) {
+	// nvim listens on the socket itself
+	sockPath, err := host.SockPath(p.tmpPath)
+	if err != nil {
+		return err
+	}
+
+	return p.Host.Start(host.Program{
+		Name: "nvim",
+		Command: &exec.Cmd{
+			Path: p.nvimPath,
+			Args: []string{p.nvimPath, "--listen", sockPath},
+		},
+		Accept: func(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+			return p.accept(ac)
+		},
+		// nvim stays usable without completion if it cannot be attached
+		// to, the connection is closed once done is closed, attach does
+		// not publish one anymore by then
+		Attach: func(done <-chan struct{}) {
+			if err := p.attach(sockPath, done); err != nil {
+				logrus.Error("nvim provider: cannot attach to nvim: ", err)
+			}
+			<-done
+			p.detach()
+		},
+	})
+}
+
+// attach connects to the socket of nvim once it exists and loads clui.lua,
+// it gives up after attachTimeout or once done is closed
+func (p *Provider) attach(sockPath string, done <-chan struct{}) error {
+	deadline := time.Now().Add(attachTimeout)
+	var conn net.Conn
+	for {
+		var err error
+		if conn, err = net.Dial("unix", sockPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrap(err, "cannot connect to nvim socket")
+		}
+		select {
+		case <-time.After(attachInterval):
+		case <-done:
+			return nil
+		}
+	}
+
+	client := newRPCClient(conn, p.changed)
+	ctx, cancel := context.WithTimeout(context.Background(), attachTimeout)
+	defer cancel()
+
+	info, err := client.call(ctx, "nvim_get_api_info")
+	if err != nil {
+		_ = client.close()
+		return err
+	}
+	infos, _ := info.([]interface{})
+	if len(infos) == 0 {
+		_ = client.close()
+		return errors.New("nvim_get_api_info returned no channel id")
+	}
+	chanID, ok := infos[0].(int64)
+	if !ok {
+		_ = client.close()
+		return errors.Errorf("nvim_get_api_info returned a %T as channel id", infos[0])
+	}
+
+	// the client is published before clui.lua reports anything, its
+	// notifications need it
+	p.rpcMut.Lock()
+	select {
+	case <-done:
+		p.rpcMut.Unlock()
+		return client.close()
+	default:
+	}
+	p.rpc = client
+	p.comp.nvim = client
+	p.rpcMut.Unlock()
+
+	if _, err := client.call(ctx, "nvim_exec_lua", setupChunk, []interface{}{p.pluginPath, chanID}); err != nil {
+		return errors.Wrap(err, "cannot load clui.lua")
+	}
+	logrus.Trace("attached to nvim on channel ", chanID)
+	return nil
+}
+
+// detach closes the connection to nvim if attach made one
+func (p *Provider) detach() {
+	p.rpcMut.Lock()
+	defer p.rpcMut.Unlock()
+
+	if p.rpc == nil {
+		return
+	}
+	if err := p.rpc.close(); err != nil {
+		logrus.Debug("nvim provider: ", err)
+	}
+	p.rpc = nil
+}
+
+// client returns the connection to nvim, or nil if it is not attached
+func (p *Provider) client() *rpcClient {
+	p.rpcMut.Lock()
+	defer p.rpcMut.Unlock()
+	return p.rpc
+}
+
+// accept makes nvim apply an accepted entry, nvim itself checks that the line
+// has not changed since the entry was offered
+func (p *Provider) accept(ac *protoclui.AcceptCompletion) error {
+	source, entry, err := p.Requests.Accepted(ac)
+	if err != nil {
+		return err
+	}
+	e := acceptEdit(source.(completionSourceInfo), entry)
+
+	client := p.client()
+	if client == nil {
+		return errors.New("not attached to nvim")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), attachTimeout)
+	defer cancel()
+	return e.apply(ctx, client)
+}
+
+// changed handles the notifications of nvim. It is called by the rpc client
+// in the order they arrive, so it only registers the request and completes
+// it in the background, the completion needs the client to receive.
+func (p *Provider) changed(method string, params []interface{}) {
+	if method == lspEvent {
+		if err := p.comp.lspCompleted(params); err != nil {
+			logrus.Errorf("cannot parse language server completion: %+v", err)
+		}
+		return
+	}
+	if method != changedEvent {
+		logrus.Trace("nvim provider: ignoring notification ", method)
+		return
+	}
+	if p.client() == nil {
+		return
+	}
+
+	csi, err := parseChange(params)
+	if err != nil {
+		logrus.Errorf("cannot parse change: %+v", errors.Wrap(err, "cannot parse change"))
+		return
+	}
+
+	r, ok := p.Requests.Begin(csi.RequestID, false)
+	if !ok {
+		logrus.Tracef("dropping stale request %d", csi.RequestID)
+		return
+	}
+	csi.RequestID = r.ID
+
+	go func() {
+		defer r.End()
+
+		r.Run(csi, func(ctx context.Context, handle func(ci *protoclui.CompletionInfo)) error {
+			return p.comp.streamCompletion(ctx, csi, handle)
+		})
+	}()
+}
@@ -0,0 +1,174 @@
+package nvim
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the types of msgpack-RPC messages
+const (
+	rpcRequest      = 0
+	rpcResponse     = 1
+	rpcNotification = 2
+)
+
+// rpcResult is the response to a request
+type rpcResult struct {
+	result interface{}
+	err    error
+}
+
+// rpcClient calls the API of nvim over msgpack-RPC, notifications sent by nvim
+// are passed to notify in the order they arrive
+type rpcClient struct {
+	conn   io.ReadWriteCloser
+	notify func(method string, params []interface{})
+
+	// writeMut serialises requests, pending holds the channels waiting for
+	// their response by message id
+	writeMut sync.Mutex
+	enc      *encoder
+	mut      sync.Mutex
+	nextID   uint32
+	pending  map[uint32]chan rpcResult
+	closed   error
+
+	done chan struct{}
+}
+
+func newRPCClient(conn io.ReadWriteCloser, notify func(method string, params []interface{})) *rpcClient {
+	c := &rpcClient{
+		conn:    conn,
+		notify:  notify,
+		enc:     &encoder{w: conn},
+		pending: map[uint32]chan rpcResult{},
+		done:    make(chan struct{}),
+	}
+	go c.receive()
+	return c
+}
+
+// call calls method with args and returns its result, it gives up waiting
+// once ctx is done
+func (c *rpcClient) call(ctx context.Context, method string, args ...interface{}) (interface{}, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	res := make(chan rpcResult, 1)
+
+	c.mut.Lock()
+	if c.closed != nil {
+		c.mut.Unlock()
+		return nil, c.closed
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = res
+	c.mut.Unlock()
+
+	c.writeMut.Lock()
+	err := c.enc.encode([]interface{}{rpcRequest, id, method, args})
+	c.writeMut.Unlock()
+	if err != nil {
+		c.forget(id)
+		return nil, errors.Wrapf(err, "cannot call %s", method)
+	}
+
+	select {
+	case r := <-res:
+		return r.result, errors.Wrapf(r.err, "%s failed", method)
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+func (c *rpcClient) forget(id uint32) {
+	c.mut.Lock()
+	delete(c.pending, id)
+	c.mut.Unlock()
+}
+
+// receive reads the messages of nvim until the connection is closed, then
+// fails the calls still waiting
+func (c *rpcClient) receive() {
+	defer close(c.done)
+
+	dec := newDecoder(c.conn)
+	var err error
+	for {
+		var v interface{}
+		if v, err = dec.decode(); err != nil {
+			break
+		}
+		msg, ok := v.([]interface{})
+		if !ok || len(msg) < 3 {
+			logrus.Info("nvim provider: ignoring malformed rpc message")
+			continue
+		}
+		switch msg[0] {
+		case int64(rpcResponse):
+			if len(msg) < 4 {
+				logrus.Info("nvim provider: ignoring malformed rpc response")
+				continue
+			}
+			c.respond(msg[1], msg[2], msg[3])
+		case int64(rpcNotification):
+			method, _ := msg[1].(string)
+			params, _ := msg[2].([]interface{})
+			c.notify(method, params)
+		default:
+			// nvim only sends requests to clients that announce methods
+			logrus.Info("nvim provider: ignoring rpc message of type ", msg[0])
+		}
+	}
+
+	if err == io.EOF {
+		err = errors.New("nvim closed the rpc connection")
+	}
+	c.mut.Lock()
+	c.closed = errors.Wrap(err, "rpc connection closed")
+	for id, res := range c.pending {
+		res <- rpcResult{err: c.closed}
+		delete(c.pending, id)
+	}
+	c.mut.Unlock()
+}
+
+func (c *rpcClient) respond(msgid interface{}, rerr interface{}, result interface{}) {
+	id, ok := msgid.(int64)
+	if !ok {
+		return
+	}
+	c.mut.Lock()
+	res, ok := c.pending[uint32(id)]
+	delete(c.pending, uint32(id))
+	c.mut.Unlock()
+	if !ok {
+		// the caller gave up waiting
+		return
+	}
+
+	r := rpcResult{result: result}
+	if rerr != nil {
+		// nvim errors are [type, message]
+		if e, ok := rerr.([]interface{}); ok && len(e) == 2 {
+			r.err = errors.New(fmt.Sprint(e[1]))
+		} else {
+			r.err = errors.New(fmt.Sprint(rerr))
+		}
+	}
+	res <- r
+}
+
+// close closes the connection and waits for receive to finish
+func (c *rpcClient) close() error {
+	err := c.conn.Close()
+	<-c.done
+	return errors.Wrap(err, "cannot close rpc connection")
+}
@@ -0,0 +1,37 @@
+package python
+
+import (
+	"strings"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+)
+
+// the keys bound by install in clui_repl.py. readline cannot run code of
+// clui_repl.py on a key and Python has no way to delete text from the line,
+// so edits are typed with bindings of their own, which neither collide with
+// the bindings of the user nor report every key they insert.
+const (
+	quotedInsertKey   = "\x18\x05" // ^X^E
+	reportKey         = "\x18\x12" // ^X^R
+	backwardDeleteKey = "\x18\x08" // ^X^H
+	forwardDeleteKey  = "\x18\x04" // ^X^D
+)
+
+// keys returns the keystrokes that apply e. Every byte of its text is quoted
+// so that none of it is taken as a binding, the line is reported once it is
+// done.
+func keys(e cmdline.Edit) string {
+	var b strings.Builder
+	for range []rune(e.Left) {
+		b.WriteString(backwardDeleteKey)
+	}
+	for range []rune(e.Right) {
+		b.WriteString(forwardDeleteKey)
+	}
+	for i := 0; i < len(e.Text); i++ {
+		b.WriteString(quotedInsertKey)
+		b.WriteByte(e.Text[i])
+	}
+	b.WriteString(reportKey)
+	return b.String()
+}
@@ -0,0 +1,181 @@
+package python
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"unicode"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// isNameChar returns whether r can be part of the word completed by
+// clui_repl.py, which is a possibly dotted name
+func isNameChar(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// nameSplit makes the word under the cursor the name completed by
+// clui_repl.py, only the attribute under the cursor is replaced after it
+var nameSplit = &cmdline.Split{
+	IsBreak: func(r rune) bool { return !isNameChar(r) },
+	IsEnd:   func(r rune) bool { return !isNameChar(r) || r == '.' },
+}
+
+// candidate is a completion offered by clui_repl.py
+type candidate struct {
+	Word        string `json:"word"`
+	Description string `json:"description"`
+}
+
+// completionRequest is what clui_repl.py answers with candidates
+type completionRequest struct {
+	LBuffer string `json:"lbuffer"`
+	RBuffer string `json:"rbuffer"`
+}
+
+// promptRequest is what clui_repl.py answers with whether it is at its prompt
+type promptRequest struct {
+	Prompt bool `json:"prompt"`
+}
+
+type completer struct {
+	// sockPath is the socket clui_repl.py answers completion requests on,
+	// the candidates come from the namespace of the running interpreter
+	sockPath string
+}
+
+// ask sends req to clui_repl.py and unmarshals its answer into res
+func (co *completer) ask(ctx context.Context, req interface{}, res interface{}) error {
+	rb, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal request")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", co.sockPath)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to python")
+	}
+	defer conn.Close()
+
+	// the interpreter may be busy running code of the user, the request is
+	// given up once it is superseded
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if _, err = conn.Write(rb); err != nil {
+		return errors.Wrap(err, "cannot send request")
+	}
+	if err = conn.(*net.UnixConn).CloseWrite(); err != nil {
+		return errors.Wrap(err, "cannot finish request")
+	}
+	out, err := io.ReadAll(conn)
+	if err != nil {
+		return errors.Wrap(err, "cannot read answer")
+	}
+
+	// failures are answered with {"error": ...} instead
+	var failure struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(out, &failure) == nil && failure.Error != "" {
+		return errors.Errorf("python cannot answer: %s", failure.Error)
+	}
+	return errors.Wrap(json.Unmarshal(out, res), "cannot unmarshal answer")
+}
+
+// capture asks the interpreter for the completions of the word under the
+// cursor of csi
+func (co *completer) capture(ctx context.Context, csi cmdline.Source) (cts []candidate, err error) {
+	lbuffer, rbuffer := csi.Cursor()
+	err = co.ask(ctx, completionRequest{LBuffer: lbuffer, RBuffer: rbuffer}, &cts)
+	return
+}
+
+// atPrompt asks the interpreter whether it waits for a line at its prompt,
+// rather than running code that may read the terminal itself
+func (co *completer) atPrompt(ctx context.Context) (ok bool, err error) {
+	err = co.ask(ctx, promptRequest{Prompt: true}, &ok)
+	return
+}
+
+// getCompletion returns the completions of jedi or rlcompleter for the word
+// under the cursor of csi, along with the first line of their docstrings, the
+// result is complete at once
+func (co *completer) getCompletion(ctx context.Context, csi cmdline.Source) (ci *protoclui.CompletionInfo, err error) {
+
+	logrus.Tracef("completing request %d for %s at cwd %s", csi.RequestID, csi.Buffer, csi.Dir)
+
+	ci = &protoclui.CompletionInfo{RequestId: csi.RequestID, Done: true}
+
+	ci.Col = int32(csi.Col)
+	ci.Line = int32(csi.Line)
+	ci.IsEmpty = csi.IsEmpty()
+	ci.IsFirst = csi.IsFirstWord()
+	ci.BufferLength = int32(len(csi.Buffer))
+
+	left, right := csi.CurrentWord()
+	if ci.IsEmpty || left == "" {
+		return
+	}
+
+	cts, err := co.capture(ctx, csi)
+	if err != nil {
+		return
+	}
+
+	// jedi and rlcompleter sort the candidates already
+	seen := map[string]bool{}
+	for _, ct := range cts {
+		if ct.Word == "" || seen[ct.Word] {
+			continue
+		}
+		seen[ct.Word] = true
+
+		// actualInput is what has to be typed at the cursor to get the
+		// candidate, if it does not start with left and end with right the
+		// frontend is told to leave typing it to the user
+		var actualInput string
+		var shouldInput bool
+		if strings.HasPrefix(ct.Word, left) && strings.HasSuffix(ct.Word[len(left):], right) {
+			actualInput = ct.Word[len(left) : len(ct.Word)-len(right)]
+			shouldInput = true
+		} else {
+			actualInput = ct.Word
+			shouldInput = false
+		}
+
+		ci.Entries = append(ci.Entries, &protoclui.CompletionEntry{
+			ActualInput: actualInput,
+			ShouldInput: shouldInput,
+			Suggestion:  ct.Word,
+			Description: ct.Description,
+			Level:       0,
+			MatchRanges: matchRanges(left, ct.Word),
+		})
+	}
+	return
+}
+
+// matchRanges returns the range of the characters of candidate that match
+// the part of the word before the cursor, jedi and rlcompleter only complete
+// prefixes
+func matchRanges(left string, candidate string) (ranges []*protoclui.MatchRange) {
+	if left != "" && strings.HasPrefix(candidate, left) {
+		ranges = append(ranges, &protoclui.MatchRange{Start: 0, End: uint32(len([]rune(left)))})
+	}
+	return
+}
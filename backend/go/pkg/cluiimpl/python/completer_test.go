@@ -0,0 +1,256 @@
+package python
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+var testCompleter *completer
+
+// testInput is the input of the interactive interpreter serving testCompleter
+var testInput io.WriteCloser
+
+// scriptDir is backend/scripts, tests run in the directory of their package
+var scriptDir, _ = filepath.Abs(filepath.Join("..", "..", "..", "..", "scripts"))
+
+// runPython runs code with clui_repl importable
+func runPython(code string, args ...string) *exec.Cmd {
+	cmd := exec.Command("python3", append([]string{"-c", code}, args...)...)
+	cmd.Env = append(os.Environ(), "PYTHONPATH="+scriptDir)
+	return cmd
+}
+
+// serverCode serves completions from a namespace that has os imported, like
+// the interpreter of a user would after `import os`, it is run with -i so that
+// the interpreter goes on to read lines like it does at its prompt
+const serverCode = `import os
+import threading
+import clui_repl
+threading.Thread(target=clui_repl.serve, args=(__import__("sys").argv[1],), daemon=True).start()
+`
+
+func TestMain(m *testing.M) {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	dir, err := os.MkdirTemp("", "clui-python")
+	if err != nil {
+		log.Fatalln("unable to create tmpdir, exiting")
+	}
+	testCompleter = &completer{sockPath: filepath.Join(dir, "complete")}
+
+	server := runPython(serverCode, testCompleter.sockPath)
+	server.Args = append([]string{server.Args[0], "-q", "-i"}, server.Args[1:]...)
+	if testInput, err = server.StdinPipe(); err != nil {
+		log.Fatalln("unable to create stdin pipe, exiting: ", err)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatalln("unable to start python, exiting: ", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(testCompleter.sockPath); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	code := m.Run()
+	testInput.Close()
+	server.Process.Kill()
+	server.Wait()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func suggestions(ci *protoclui.CompletionInfo) (res []string) {
+	for _, e := range ci.Entries {
+		res = append(res, e.Suggestion)
+	}
+	return
+}
+
+func TestCompletion(t *testing.T) {
+	require := require.New(t)
+	csi := cmdline.Source{
+		Col:     15,
+		Line:    20,
+		LBuffer: "os.pa",
+		RBuffer: "",
+		Buffer:  "os.pa",
+		Split:   nameSplit,
+	}
+
+	ci, err := testCompleter.getCompletion(context.Background(), csi)
+	require.Nil(err)
+
+	require.Equal(ci.Col, int32(csi.Col))
+	require.Equal(ci.Line, int32(csi.Line))
+	require.Equal(ci.IsEmpty, false)
+	require.Equal(ci.IsFirst, true)
+	require.Equal(ci.BufferLength, int32(5))
+	require.True(ci.Done)
+	require.Contains(suggestions(ci), "os.path")
+
+	for _, e := range ci.Entries {
+		if e.Suggestion == "os.path" {
+			require.True(e.ShouldInput)
+			require.Equal("th", e.ActualInput)
+			require.Equal("Common operations on Posix pathnames.", e.Description)
+			require.Equal([]*protoclui.MatchRange{{Start: 0, End: 5}}, e.MatchRanges)
+		}
+	}
+
+	// builtins are completed from the middle of a line as well
+	ci, err = testCompleter.getCompletion(context.Background(), cmdline.Source{LBuffer: "x = pri", RBuffer: "(1)", Buffer: "x = pri(1)", Split: nameSplit})
+	require.Nil(err)
+	require.False(ci.IsFirst)
+	require.NotEmpty(ci.Entries)
+	require.True(strings.HasPrefix(ci.Entries[0].Suggestion, "print"))
+	require.Contains(ci.Entries[0].Description, "Prints the values")
+
+	// nothing is completed before a word is started
+	ci, err = testCompleter.getCompletion(context.Background(), cmdline.Source{LBuffer: "x = ", Buffer: "x = ", Split: nameSplit})
+	require.Nil(err)
+	require.Empty(ci.Entries)
+}
+
+func TestCurrentWord(t *testing.T) {
+	require := require.New(t)
+
+	for _, c := range []struct {
+		lbuffer, rbuffer, left, right string
+	}{
+		{"os.pa", "", "os.pa", ""},
+		{"print(os.pa", "th.join)", "os.pa", "th"},
+		{"x = [1].app", "", ".app", ""},
+		{"größe = län", "ge", "län", "ge"},
+		{"f(", ")", "", ""},
+	} {
+		left, right := (&cmdline.Source{LBuffer: c.lbuffer, RBuffer: c.rbuffer, Split: nameSplit}).CurrentWord()
+		require.Equal(c.left, left, "%q|%q", c.lbuffer, c.rbuffer)
+		require.Equal(c.right, right, "%q|%q", c.lbuffer, c.rbuffer)
+	}
+}
+
+// TestTranslate decodes the reports clui_repl.py encodes by hand
+func TestTranslate(t *testing.T) {
+	require := require.New(t)
+
+	code := `import sys, clui_repl
+sys.stdout.buffer.write(clui_repl.encode_csi(3, 4, "/tmp", "os.pa", "th", "os.path", 300))`
+	out, err := runPython(code).Output()
+	require.Nil(err)
+
+	csi, err := cmdline.Unmarshal(out)
+	require.Nil(err)
+	require.Equal(cmdline.Source{
+		RequestID: 300,
+		Col:       3,
+		Line:      4,
+		Dir:       "/tmp",
+		LBuffer:   "os.pa",
+		RBuffer:   "th",
+		Buffer:    "os.path",
+	}, csi)
+
+	code = `import sys, clui_repl
+sys.stdout.buffer.write(clui_repl.encode_csi(0, 0, "", "日本", "", "日本", 1))`
+	out, err = runPython(code).Output()
+	require.Nil(err)
+	csi, err = cmdline.Unmarshal(out)
+	require.Nil(err)
+	require.Equal("日本", csi.LBuffer)
+}
+
+type recordingHandler struct {
+	ids []uint64
+}
+
+func (h *recordingHandler) Handle(ci *protoclui.CompletionInfo) {
+	h.ids = append(h.ids, ci.RequestId)
+}
+
+func TestAccept(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(strings.Repeat(backwardDeleteKey, 2)+forwardDeleteKey+
+		quotedInsertKey+"é"[:1]+quotedInsertKey+"é"[1:]+quotedInsertKey+"x"+reportKey,
+		keys(cmdline.Edit{Left: "ab", Right: "c", Text: "éx"}))
+
+	p := &Provider{comp: testCompleter}
+	p.Requests.Handler = &recordingHandler{}
+	csi := cmdline.Source{RequestID: 2, LBuffer: "print(os.pa", RBuffer: "th)", Split: nameSplit}
+	_, ok := p.Requests.Begin(csi.RequestID, false)
+	require.True(ok)
+	p.Requests.Deliver(csi, &protoclui.CompletionInfo{
+		RequestId: 2,
+		Entries:   []*protoclui.CompletionEntry{{Suggestion: "os.path"}},
+	})
+
+	var typed bytes.Buffer
+	require.Error(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 1}), "stale request")
+	require.Error(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 2, EntryIndex: 1}), "entry out of range")
+	require.NoError(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 2}))
+	require.Equal(keys(cmdline.Edit{Left: "os.pa", Right: "th", Text: "os.path"}), typed.String())
+
+	// the keys would go to the code of the user while it runs
+	typed.Reset()
+	_, err := io.WriteString(testInput, "import time; time.sleep(1)\n")
+	require.NoError(err)
+	require.Eventually(func() bool {
+		ok, err := testCompleter.atPrompt(context.Background())
+		return err == nil && !ok
+	}, time.Second, 10*time.Millisecond)
+	require.Error(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 2}))
+	require.Empty(typed.String())
+	require.Eventually(func() bool {
+		ok, err := testCompleter.atPrompt(context.Background())
+		return err == nil && ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// readline cannot check the line, entries are refused once a newer line
+	// has been reported even before its completion is delivered
+	typed.Reset()
+	_, ok = p.Requests.Begin(3, false)
+	require.True(ok)
+	require.Error(p.accept(&typed, &protoclui.AcceptCompletion{RequestId: 2}))
+	require.Empty(typed.String())
+}
+
+func TestCompletionInjection(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "injected")
+	touch := `__import__("pathlib").Path("` + marker + `").touch()`
+
+	buffers := []string{
+		touch + ".",
+		touch + ".real",
+		"os.system('touch " + marker + "').",
+		"x = [" + touch + "][0].",
+		"'''\n" + touch + "\n'''.",
+		"open('" + marker + "', 'w').wr",
+		"größe.",
+	}
+
+	for _, buffer := range buffers {
+		_, err := testCompleter.capture(context.Background(), cmdline.Source{Buffer: buffer})
+		require.Nil(err, "%q", buffer)
+
+		_, err = os.Stat(marker)
+		require.True(os.IsNotExist(err), "buffer %q executed code", buffer)
+	}
+}
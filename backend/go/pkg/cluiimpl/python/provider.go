@@ -0,0 +1,125 @@
+package python
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/host"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// scriptDirEnvKey tells clui_startup.py where clui_repl.py is
+var scriptDirEnvKey = "CLUI_SCRIPT_DIR"
+
+// completerSocketEnvKey is the socket clui_repl.py answers completion
+// requests on
+var completerSocketEnvKey = "CLUI_COMPLETER_SOCKET"
+
+// clui_startup.py takes the place of the PYTHONSTARTUP of the user, it runs
+// the one saved in userStartupEnvKey once it is done
+var (
+	startupEnvKey     = "PYTHONSTARTUP"
+	userStartupEnvKey = "CLUI_USER_PYTHONSTARTUP"
+)
+
+// promptTimeout bounds the time the interpreter may take to tell whether it
+// is at its prompt when an entry is accepted
+const promptTimeout = time.Second
+
+// Provider provides the implementation of clui for the interactive python
+// interpreter
+type Provider struct {
+	host.Host
+	comp        *completer
+	startupPath string
+	pythonPath  string
+	tmpPath     string
+}
+
+// NewProvider returns a new instance of Provider using default options
+func NewProvider() *Provider {
+	return &Provider{
+		comp:        &completer{},
+		startupPath: viper.GetString("PYTHON_STARTUP_PATH"),
+		pythonPath:  viper.GetString("PYTHON_PATH"),
+		tmpPath:     viper.GetString("CLUI_TMP_PATH"),
+	}
+}
+
+// Start performs the required preparation and then starts the python process,
+// as well as start providing completion results via compOptHandler
+func (p *Provider) Start() (err error) {
+	sockPath, err := host.SockPath(p.tmpPath)
+	if err != nil {
+		return err
+	}
+	p.comp.sockPath = sockPath + ".complete"
+
+	// python creates the completion socket, but only Start knows when it is
+	// not needed anymore
+	defer func() {
+		if err := os.Remove(p.comp.sockPath); err != nil && !os.IsNotExist(err) {
+			logrus.Errorln(errors.Wrap(err, "cannot remove completion socket"))
+		}
+	}()
+
+	env := os.Environ()
+	env = append(env, fmt.Sprintf("%s=%s", scriptDirEnvKey, filepath.Dir(p.startupPath)))
+	env = append(env, fmt.Sprintf("%s=%s", completerSocketEnvKey, p.comp.sockPath))
+	env = append(env, fmt.Sprintf("%s=%s", userStartupEnvKey, os.Getenv(startupEnvKey)))
+	env = append(env, fmt.Sprintf("%s=%s", startupEnvKey, p.startupPath))
+
+	return p.Host.Start(host.Program{
+		Name: "python",
+		Command: &exec.Cmd{
+			Path: p.pythonPath,
+			Args: []string{p.pythonPath, "-i"},
+			Env:  env,
+		},
+		KeyListener: sockPath,
+		Split:       nameSplit,
+		Complete:    host.Get(p.comp.getCompletion),
+		Accept: func(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+			return p.accept(ptmx, ac)
+		},
+	})
+}
+
+// accept types the keys that apply an accepted entry. Unlike a shell readline
+// cannot check that the line has not changed since the entry was offered, so
+// entries are only applied while no newer line has been reported, and only
+// while the interpreter is at its prompt. Nothing is appended to the
+// suggestion, rlcompleter already ends callables with ( and keywords with a
+// space.
+func (p *Provider) accept(ptmx io.Writer, ac *protoclui.AcceptCompletion) error {
+	if ac.RequestId != p.Requests.Latest() {
+		return errors.Errorf("request %d is not the latest one, the line changed since", ac.RequestId)
+	}
+
+	csi, entry, err := p.Accepted(ac)
+	if err != nil {
+		return err
+	}
+	e := csi.Replace(entry.Suggestion)
+
+	ctx, cancel := context.WithTimeout(context.Background(), promptTimeout)
+	defer cancel()
+	atPrompt, err := p.comp.atPrompt(ctx)
+	if err != nil {
+		return errors.Wrap(err, "cannot tell whether python is at its prompt")
+	}
+	if !atPrompt {
+		return errors.New("python is running code, not at its prompt")
+	}
+
+	_, err = io.WriteString(ptmx, keys(e))
+	return errors.Wrap(err, "cannot write accept keys")
+}
@@ -0,0 +1,34 @@
+package wrap
+
+import (
+	"strings"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+)
+
+// the keys that edit the line, readline and the terminal driver both take
+// backspace, forward deletion is only ever needed outside canonical mode
+const (
+	backspaceKey     = "\x7f"
+	forwardDeleteKey = "\x1b[3~"
+)
+
+// acceptEdit returns the edit that accepts entry for the line described by
+// csi, the word under the cursor is replaced by the suggestion followed by a
+// space, unless there is one already, like rlwrap does
+func acceptEdit(csi cmdline.Source, entry *protoclui.CompletionEntry) cmdline.Edit {
+	e := csi.Replace(entry.Suggestion)
+	if !csi.SpaceFollows() {
+		e.Text += " "
+	}
+	return e
+}
+
+// keys returns the keystrokes that apply e, they are fed to the line tracker
+// as well so that it follows the edit
+func keys(e cmdline.Edit) string {
+	return strings.Repeat(backspaceKey, len([]rune(e.Left))) +
+		strings.Repeat(forwardDeleteKey, len([]rune(e.Right))) +
+		e.Text
+}
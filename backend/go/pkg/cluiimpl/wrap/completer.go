@@ -0,0 +1,254 @@
+package wrap
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the sources of completions, in the order their entries are offered
+var (
+	specGroup    = &protoclui.CompletionGroup{Tag: "completions", Header: "completion"}
+	wordsGroup   = &protoclui.CompletionGroup{Tag: "words", Header: "word"}
+	historyGroup = &protoclui.CompletionGroup{Tag: "history", Header: "history"}
+)
+
+// candidate is a word offered by one of the sources
+type candidate struct {
+	word        string
+	description string
+	group       *protoclui.CompletionGroup
+}
+
+// completer completes from the files of a program in completionsPath, all of
+// them optional. <program>.complete is an executable run with the parts of the
+// line before and after the cursor that prints the completions one per line,
+// <program>.words is a list of words one per line and <program>.history the
+// lines submitted, which the provider appends to. Completions and words may
+// be followed by a tab and a description.
+type completer struct {
+	completionsPath string
+	program         string
+	// historySize is the number of the latest lines of history used
+	historySize int
+}
+
+func (co *completer) path(ext string) string {
+	return filepath.Join(co.completionsPath, co.program+ext)
+}
+
+// parseCandidates reads lines of a word and an optional description
+// separated by a tab. Words with control characters are left out, they
+// could not be typed for the user.
+func parseCandidates(lines []string, group *protoclui.CompletionGroup) (cts []candidate) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		word, description := line, ""
+		if i := strings.IndexByte(line, '\t'); i >= 0 {
+			word, description = line[:i], line[i+1:]
+		}
+		if word == "" || strings.IndexFunc(word, unicode.IsControl) >= 0 {
+			continue
+		}
+		cts = append(cts, candidate{word: word, description: description, group: group})
+	}
+	return
+}
+
+// spec returns the completions printed by the completion spec of the
+// program, the spec is trusted to filter them itself
+func (co *completer) spec(ctx context.Context, csi cmdline.Source) ([]candidate, error) {
+	path := co.path(".complete")
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	// the line is passed as arguments of its own, it must never be parsed by
+	// a shell
+	lbuffer, rbuffer := csi.Cursor()
+	cmd := exec.CommandContext(ctx, path, lbuffer, rbuffer)
+	cmd.Dir = csi.Dir
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot run completion spec")
+	}
+	return parseCandidates(strings.Split(string(out), "\n"), specGroup), nil
+}
+
+// readLines returns the lines of the file at path, or nothing if there is
+// none
+func readLines(path string) (lines []string, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open "+path)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines, errors.Wrap(sc.Err(), "cannot read "+path)
+}
+
+// words returns the word list of the program, lines starting with # are
+// comments
+func (co *completer) words() ([]candidate, error) {
+	lines, err := readLines(co.path(".words"))
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return parseCandidates(words, wordsGroup), nil
+}
+
+// history returns the words of the latest lines of history, the most recent
+// first
+func (co *completer) history() ([]candidate, error) {
+	lines, err := readLines(co.path(".history"))
+	if err != nil {
+		return nil, err
+	}
+	if co.historySize > 0 && len(lines) > co.historySize {
+		lines = lines[len(lines)-co.historySize:]
+	}
+	var words []string
+	for i := len(lines) - 1; i >= 0; i-- {
+		words = append(words, strings.FieldsFunc(lines[i], isWordBreak)...)
+	}
+	return parseCandidates(words, historyGroup), nil
+}
+
+// recordHistory appends a submitted line to the history of the program
+func (co *completer) recordHistory(line string) error {
+	if err := os.MkdirAll(co.completionsPath, 0700); err != nil {
+		return errors.Wrap(err, "cannot make completions dir")
+	}
+	f, err := os.OpenFile(co.path(".history"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot open history")
+	}
+	if _, err := f.WriteString(line + "\n"); err != nil {
+		f.Close()
+		return errors.Wrap(err, "cannot write history")
+	}
+	return errors.Wrap(f.Close(), "cannot close history")
+}
+
+// hasPrefixFold returns whether s starts with prefix, ignoring case, so that
+// keywords listed in upper case are offered for lower case ones
+func hasPrefixFold(s string, prefix string) bool {
+	rs, rp := []rune(s), []rune(prefix)
+	if len(rp) > len(rs) {
+		return false
+	}
+	return strings.EqualFold(string(rs[:len(rp)]), prefix)
+}
+
+// getCompletion returns the completions of the sources of the program for
+// the word under the cursor of csi, the result is complete at once
+func (co *completer) getCompletion(ctx context.Context, csi cmdline.Source) (ci *protoclui.CompletionInfo, err error) {
+
+	logrus.Tracef("completing request %d for %s at cwd %s", csi.RequestID, csi.Buffer, csi.Dir)
+
+	ci = &protoclui.CompletionInfo{RequestId: csi.RequestID, Done: true}
+
+	ci.Col = int32(csi.Col)
+	ci.Line = int32(csi.Line)
+	ci.IsEmpty = csi.IsEmpty()
+	ci.IsFirst = csi.IsFirstWord()
+	ci.BufferLength = int32(len(csi.Buffer))
+
+	if ci.IsEmpty {
+		return
+	}
+
+	cts, err := co.spec(ctx, csi)
+	if err != nil {
+		return
+	}
+
+	// words and history are only offered once a word is started, everything
+	// would match otherwise
+	left, right := csi.CurrentWord()
+	if left != "" {
+		var words, history []candidate
+		if words, err = co.words(); err != nil {
+			return
+		}
+		if history, err = co.history(); err != nil {
+			return
+		}
+		for _, ct := range append(words, history...) {
+			if hasPrefixFold(ct.word, left) && ct.word != left+right {
+				cts = append(cts, ct)
+			}
+		}
+	}
+
+	// a word offered by several sources is offered by the first one
+	seen := map[string]bool{}
+	groups := map[*protoclui.CompletionGroup]uint32{}
+	for _, ct := range cts {
+		if seen[ct.word] {
+			continue
+		}
+		seen[ct.word] = true
+
+		if _, ok := groups[ct.group]; !ok {
+			groups[ct.group] = uint32(len(ci.Groups))
+			ci.Groups = append(ci.Groups, ct.group)
+		}
+
+		// actualInput is what has to be typed at the cursor to get the
+		// word, if it does not start with left and end with right the
+		// frontend is told to leave typing it to the user
+		var actualInput string
+		var shouldInput bool
+		if strings.HasPrefix(ct.word, left) && strings.HasSuffix(ct.word[len(left):], right) {
+			actualInput = ct.word[len(left) : len(ct.word)-len(right)]
+			shouldInput = true
+		} else {
+			actualInput = ct.word
+			shouldInput = false
+		}
+
+		ci.Entries = append(ci.Entries, &protoclui.CompletionEntry{
+			ActualInput: actualInput,
+			ShouldInput: shouldInput,
+			Suggestion:  ct.word,
+			Description: ct.description,
+			Level:       1,
+			Group:       groups[ct.group],
+			MatchRanges: matchRanges(left, ct.word),
+		})
+	}
+	return
+}
+
+// matchRanges returns the range of the characters of candidate that match
+// the part of the word before the cursor, ignoring case
+func matchRanges(left string, candidate string) (ranges []*protoclui.MatchRange) {
+	if left != "" && hasPrefixFold(candidate, left) {
+		ranges = append(ranges, &protoclui.MatchRange{Start: 0, End: uint32(len([]rune(left)))})
+	}
+	return
+}
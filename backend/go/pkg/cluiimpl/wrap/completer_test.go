@@ -0,0 +1,209 @@
+package wrap
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineTracker(t *testing.T) {
+	require := require.New(t)
+
+	for _, c := range []struct {
+		keys             string
+		canonical        bool
+		lbuffer, rbuffer string
+		synced           bool
+	}{
+		{"select", false, "select", "", true},
+		{"selct\x1b[D\x1b[De", false, "sele", "ct", true},
+		{"select\x01x\x05y", false, "xselecty", "", true},
+		{"select\x02\x02\x0b", false, "sele", "", true},
+		{"select * from\x17", false, "select * ", "", true},
+		{"select * from\x1b\x7f", false, "select * ", "", true},
+		{"select\x7f\x7f", false, "sele", "", true},
+		{"select\x1b[H\x1b[3~", false, "", "elect", true},
+		{"select\x1b[1;5D", false, "", "select", true},
+		{"select from\x1bb\x15", false, "", "from", true},
+		{"café 日本", false, "café 日本", "", true},
+		{"\x1b[200~a\tb\x1b[201~", false, "a\tb", "", true},
+		{"\x1bOPab\x1b[15~", false, "ab", "", true},
+		{"sel\x1b[A", false, "sel", "", false},
+		{"sel\t", false, "sel", "", false},
+		{"sel\x1b[Aect\x03ok", false, "ok", "", true},
+
+		// the terminal driver only knows how to erase
+		{"select\x7f\x17x", true, "x", "", true},
+		{"select\x1b[D", true, "select", "", false},
+		{"select\x01", true, "select", "", false},
+	} {
+		lt := newLineTracker()
+		lt.feed([]byte(c.keys), c.canonical)
+		lbuffer, rbuffer := lt.cursor()
+		require.Equal(c.lbuffer, lbuffer, "%q", c.keys)
+		require.Equal(c.rbuffer, rbuffer, "%q", c.keys)
+		require.Equal(c.synced, lt.synced, "%q", c.keys)
+	}
+
+	// runes may be split between reads
+	lt := newLineTracker()
+	lt.feed([]byte("日本"[:2]), false)
+	lt.feed([]byte("日本"[2:]), false)
+	lbuffer, _ := lt.cursor()
+	require.Equal("日本", lbuffer)
+
+	// only lines that are known are submitted
+	lt = newLineTracker()
+	require.Equal([]string{"select 1;", ""}, lt.feed([]byte("select 1;\r\r"), false))
+	require.Empty(lt.feed([]byte("\x1b[A\r"), false))
+	require.True(lt.synced)
+}
+
+func TestCurrentWord(t *testing.T) {
+	require := require.New(t)
+
+	// words are separated like readline separates them
+	left, right := (&cmdline.Source{LBuffer: "select * from (us", RBuffer: "rs;", Split: wordSplit}).CurrentWord()
+	require.Equal("us", left)
+	require.Equal("rs", right)
+}
+
+// writeTestCompletions writes the completion files of the program test in a
+// new completions dir
+func writeTestCompletions(t *testing.T) *completer {
+	dir := t.TempDir()
+	files := map[string]string{
+		"test.words":   "# keywords\nSELECT\tretrieve rows\nSET\nselect\nUPDATE\n",
+		"test.history": "select name from users;\nselect * from sessions;\n",
+		"test.complete": `#!/bin/sh
+case "$1" in
+*from\ *) printf 'users\ttable\nsessions\ttable\n' ;;
+esac
+`,
+	}
+	for name, content := range files {
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0755))
+	}
+	return &completer{completionsPath: dir, program: "test", historySize: 1000}
+}
+
+func suggestions(ci *protoclui.CompletionInfo) (res []string) {
+	for _, e := range ci.Entries {
+		res = append(res, e.Suggestion)
+	}
+	return
+}
+
+func TestCompletion(t *testing.T) {
+	require := require.New(t)
+	co := writeTestCompletions(t)
+
+	csi := cmdline.Source{
+		Dir:     t.TempDir(),
+		Col:     15,
+		Line:    20,
+		LBuffer: "se",
+		Buffer:  "se",
+	}
+	ci, err := co.getCompletion(context.Background(), csi)
+	require.Nil(err)
+
+	require.Equal(ci.Col, int32(csi.Col))
+	require.Equal(ci.Line, int32(csi.Line))
+	require.Equal(ci.IsEmpty, false)
+	require.Equal(ci.IsFirst, true)
+	require.Equal(ci.BufferLength, int32(2))
+	require.True(ci.Done)
+
+	// words come before history, the latest history first, and case is
+	// ignored
+	require.Equal([]string{"SELECT", "SET", "select", "sessions"}, suggestions(ci))
+	require.Equal([]*protoclui.CompletionGroup{wordsGroup, historyGroup}, ci.Groups)
+	require.Equal("retrieve rows", ci.Entries[0].Description)
+	require.False(ci.Entries[0].ShouldInput)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, ci.Entries[0].MatchRanges)
+	require.True(ci.Entries[2].ShouldInput)
+	require.Equal("lect", ci.Entries[2].ActualInput)
+	require.Equal(uint32(1), ci.Entries[3].Group)
+
+	// the spec completes on its own, even before a word is started
+	ci, err = co.getCompletion(context.Background(), cmdline.Source{Dir: csi.Dir, LBuffer: "select * from ", Buffer: "select * from "})
+	require.Nil(err)
+	require.Equal([]string{"users", "sessions"}, suggestions(ci))
+	require.Equal([]*protoclui.CompletionGroup{specGroup}, ci.Groups)
+	require.Equal("table", ci.Entries[0].Description)
+
+	// programs without completions complete nothing
+	co.program = "other"
+	ci, err = co.getCompletion(context.Background(), csi)
+	require.Nil(err)
+	require.Empty(ci.Entries)
+}
+
+func TestRecordHistory(t *testing.T) {
+	require := require.New(t)
+
+	co := &completer{completionsPath: filepath.Join(t.TempDir(), "wrap"), program: "test", historySize: 1}
+	require.Nil(co.recordHistory("select 1;"))
+	require.Nil(co.recordHistory("update t;"))
+
+	content, err := os.ReadFile(co.path(".history"))
+	require.Nil(err)
+	require.Equal("select 1;\nupdate t;\n", string(content))
+
+	// only the latest lines are used
+	cts, err := co.history()
+	require.Nil(err)
+	require.Len(cts, 2)
+	require.Equal("update", cts[0].word)
+}
+
+func TestTakePosReplies(t *testing.T) {
+	require := require.New(t)
+
+	p := &Provider{posReplies: make(chan [2]int, 1)}
+	require.Equal("a\x1b[5;10Rb", string(p.takePosReplies([]byte("a\x1b[5;10Rb"))))
+
+	// only as many answers as there are queries are taken, late ones too
+	p.posQueries = 1
+	p.posDeadline = time.Now().Add(posExpiry)
+	require.Equal("ab\x1b[6;1R", string(p.takePosReplies([]byte("a\x1b[5;10Rb\x1b[6;1R"))))
+	require.Equal([2]int{5, 10}, <-p.posReplies)
+	require.Equal("\x1b[6;1R", string(p.takePosReplies([]byte("\x1b[6;1R"))))
+
+	// answers are not expected anymore after posExpiry
+	p.posQueries = 1
+	p.posDeadline = time.Now().Add(-time.Second)
+	require.Equal("\x1b[5;10R", string(p.takePosReplies([]byte("\x1b[5;10R"))))
+	require.Zero(p.posQueries)
+}
+
+func TestAccept(t *testing.T) {
+	require := require.New(t)
+
+	csi := cmdline.Source{LBuffer: "select * from us", RBuffer: "rs", Split: wordSplit}
+	e := acceptEdit(csi, &protoclui.CompletionEntry{Suggestion: "users"})
+	require.Equal(cmdline.Edit{Left: "us", Right: "rs", Text: "users "}, e)
+	e = acceptEdit(cmdline.Source{LBuffer: "sel", RBuffer: " 1", Split: wordSplit}, &protoclui.CompletionEntry{Suggestion: "SELECT"})
+	require.Equal("SELECT", e.Text)
+
+	// the tracker follows the keys of the edit
+	lt := newLineTracker()
+	lt.feed([]byte("select * from usrs\x1b[D\x1b[D"), false)
+	lt.feed([]byte(keys(cmdline.Edit{Left: "us", Right: "rs", Text: "users "})), false)
+	lbuffer, rbuffer := lt.cursor()
+	require.Equal("select * from users ", lbuffer)
+	require.Equal("", rbuffer)
+	require.True(lt.synced)
+
+	e = acceptEdit(cmdline.Source{LBuffer: "sel", Split: wordSplit}, &protoclui.CompletionEntry{Suggestion: "select"})
+	require.Equal(cmdline.Edit{Left: "sel", Text: "select "}, e)
+	require.True(strings.HasPrefix(keys(e), "\x7f\x7f\x7fselect"))
+}
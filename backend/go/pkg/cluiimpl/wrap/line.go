@@ -0,0 +1,296 @@
+package wrap
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+)
+
+// wordBreaks are the characters that separate the words completed, the same
+// as the defaults of readline
+const wordBreaks = " \t\n\"\\'`@$><=;|&{("
+
+func isWordBreak(r rune) bool {
+	return strings.ContainsRune(wordBreaks, r)
+}
+
+// wordSplit tells the words completed apart
+var wordSplit = &cmdline.Split{IsBreak: isWordBreak}
+
+// lineTracker follows the line typed into the wrapped program from the keys
+// sent to it. Keys are taken the way readline takes them by default, or the
+// way the terminal driver does if the program reads lines in canonical mode.
+type lineTracker struct {
+	line []rune
+	pos  int
+
+	// synced is false once a key was seen whose effect on the line is not
+	// known, like recalling history or completing, until the line is
+	// submitted
+	synced bool
+
+	// esc is the escape sequence being read, paste is set inside a bracketed
+	// paste and pending are the bytes of an incomplete rune
+	esc     []byte
+	paste   bool
+	pending []byte
+}
+
+func newLineTracker() *lineTracker {
+	return &lineTracker{synced: true}
+}
+
+// reset starts an empty line which is known again
+func (lt *lineTracker) reset() {
+	lt.line = nil
+	lt.pos = 0
+	lt.synced = true
+	lt.esc = nil
+	lt.paste = false
+	lt.pending = nil
+}
+
+// cursor returns the parts of the line before and after the cursor
+func (lt *lineTracker) cursor() (lbuffer string, rbuffer string) {
+	return string(lt.line[:lt.pos]), string(lt.line[lt.pos:])
+}
+
+// feed applies keys to the line and returns the lines submitted by them that
+// were known, in canonical mode only the editing of the terminal driver is
+// understood
+func (lt *lineTracker) feed(keys []byte, canonical bool) (submitted []string) {
+	for _, b := range keys {
+		if lt.esc != nil {
+			lt.escape(b, canonical)
+			continue
+		}
+		if len(lt.pending) > 0 || b >= utf8.RuneSelf {
+			lt.pending = append(lt.pending, b)
+			if utf8.FullRune(lt.pending) {
+				if r, _ := utf8.DecodeRune(lt.pending); r != utf8.RuneError {
+					lt.insert(r)
+				} else {
+					lt.synced = false
+				}
+				lt.pending = nil
+			}
+			continue
+		}
+		if b >= ' ' && b != 0x7f {
+			lt.insert(rune(b))
+			continue
+		}
+		if line, ok := lt.control(b, canonical); ok {
+			submitted = append(submitted, line)
+		}
+	}
+	return
+}
+
+func (lt *lineTracker) insert(r rune) {
+	lt.line = append(lt.line, 0)
+	copy(lt.line[lt.pos+1:], lt.line[lt.pos:])
+	lt.line[lt.pos] = r
+	lt.pos++
+}
+
+// control applies a control key, it returns the line if the key submitted a
+// known one
+func (lt *lineTracker) control(b byte, canonical bool) (line string, ok bool) {
+	if lt.paste && b == '\t' {
+		lt.insert('\t')
+		return
+	}
+	switch b {
+	case '\r', '\n':
+		if lt.paste {
+			// readline keeps pasted lines in the buffer
+			lt.synced = false
+			return
+		}
+		line, ok = string(lt.line), lt.synced
+		lt.reset()
+		return
+	case 0x03: // ^C
+		lt.reset()
+	case 0x04: // ^D
+		if len(lt.line) == 0 {
+			lt.reset()
+		} else if !canonical {
+			lt.deleteForward(1)
+		}
+	case 0x7f, 0x08: // backspace
+		lt.deleteBackward(1)
+	case 0x15: // ^U
+		lt.line = lt.line[lt.pos:]
+		lt.pos = 0
+	case 0x17: // ^W
+		lt.deleteBackward(lt.pos - lt.wordStart(unicode.IsSpace))
+	case 0x0c, 0x07: // ^L, ^G
+	case 0x1b:
+		lt.esc = []byte{}
+	default:
+		if canonical {
+			lt.synced = false
+			return
+		}
+		switch b {
+		case 0x01: // ^A
+			lt.pos = 0
+		case 0x05: // ^E
+			lt.pos = len(lt.line)
+		case 0x02: // ^B
+			lt.move(-1)
+		case 0x06: // ^F
+			lt.move(1)
+		case 0x0b: // ^K
+			lt.line = lt.line[:lt.pos]
+		default:
+			lt.synced = false
+		}
+	}
+	return
+}
+
+// escape reads the next byte of an escape sequence and applies the sequence
+// once it is complete
+func (lt *lineTracker) escape(b byte, canonical bool) {
+	lt.esc = append(lt.esc, b)
+	seq := lt.esc
+	switch {
+	case len(seq) == 1 && (b == '[' || b == 'O'):
+		return
+	case len(seq) == 1:
+		// alt and a key
+		lt.esc = nil
+		if canonical {
+			lt.synced = false
+			return
+		}
+		switch b {
+		case 'b':
+			lt.pos = lt.wordStart(isNotAlnum)
+		case 'f':
+			lt.pos = lt.wordEnd()
+		case 0x7f:
+			lt.deleteBackward(lt.pos - lt.wordStart(isNotAlnum))
+		default:
+			lt.synced = false
+		}
+		return
+	case seq[0] == '[' && (b < 0x40 || b > 0x7e):
+		// parameters of a CSI sequence
+		if len(seq) > 32 {
+			lt.esc = nil
+			lt.synced = false
+		}
+		return
+	}
+	lt.esc = nil
+
+	params, final := string(seq[1:len(seq)-1]), b
+	if seq[0] == 'O' {
+		params = ""
+	}
+	if lt.paste {
+		if params == "201" && final == '~' {
+			lt.paste = false
+		} else {
+			lt.synced = false
+		}
+		return
+	}
+	if params == "200" && final == '~' {
+		lt.paste = true
+		return
+	}
+
+	// function keys edit nothing
+	if seq[0] == 'O' && final >= 'P' && final <= 'S' {
+		return
+	}
+	if canonical {
+		lt.synced = false
+		return
+	}
+
+	// modified arrows move by words
+	word := strings.Contains(params, ";")
+	switch {
+	case final == 'C' && word:
+		lt.pos = lt.wordEnd()
+	case final == 'D' && word:
+		lt.pos = lt.wordStart(isNotAlnum)
+	case final == 'C':
+		lt.move(1)
+	case final == 'D':
+		lt.move(-1)
+	case final == 'H' || final == '~' && (params == "1" || params == "7"):
+		lt.pos = 0
+	case final == 'F' || final == '~' && (params == "4" || params == "8"):
+		lt.pos = len(lt.line)
+	case final == '~' && params == "3":
+		lt.deleteForward(1)
+	case final == '~' && params >= "11" && params <= "24" && len(params) == 2:
+		// function keys
+	default:
+		lt.synced = false
+	}
+}
+
+func (lt *lineTracker) move(n int) {
+	lt.pos += n
+	if lt.pos < 0 {
+		lt.pos = 0
+	}
+	if lt.pos > len(lt.line) {
+		lt.pos = len(lt.line)
+	}
+}
+
+func (lt *lineTracker) deleteBackward(n int) {
+	if n > lt.pos {
+		n = lt.pos
+	}
+	lt.line = append(lt.line[:lt.pos-n], lt.line[lt.pos:]...)
+	lt.pos -= n
+}
+
+func (lt *lineTracker) deleteForward(n int) {
+	if n > len(lt.line)-lt.pos {
+		n = len(lt.line) - lt.pos
+	}
+	lt.line = append(lt.line[:lt.pos], lt.line[lt.pos+n:]...)
+}
+
+func isNotAlnum(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// wordStart returns where the word before the cursor starts, words are
+// separated by runes for which isBreak is true
+func (lt *lineTracker) wordStart(isBreak func(rune) bool) int {
+	i := lt.pos
+	for i > 0 && isBreak(lt.line[i-1]) {
+		i--
+	}
+	for i > 0 && !isBreak(lt.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd returns where the word after the cursor ends, like readline's
+// forward-word
+func (lt *lineTracker) wordEnd() int {
+	i := lt.pos
+	for i < len(lt.line) && isNotAlnum(lt.line[i]) {
+		i++
+	}
+	for i < len(lt.line) && !isNotAlnum(lt.line[i]) {
+		i++
+	}
+	return i
+}
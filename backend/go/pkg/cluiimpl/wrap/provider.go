@@ -0,0 +1,288 @@
+package wrap
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/host"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// posQuery asks the terminal of the frontend for the position of the cursor,
+// posReplyRe matches its answer
+var (
+	posQuery   = "\x1b[6n"
+	posReplyRe = regexp.MustCompile(`\x1b\[(\d+);(\d+)R`)
+)
+
+// posTimeout is how long the terminal of the frontend is given to answer
+// posQuery, posExpiry is how long its answers are still taken out of the
+// input after the last query, late ones must not be typed into the program
+var (
+	posTimeout = 500 * time.Millisecond
+	posExpiry  = 5 * time.Second
+)
+
+// Provider provides the implementation of clui for programs that have no
+// completion hooks of their own, like rlwrap it wraps them in a pty and
+// follows the line typed into them from the keys sent to them
+type Provider struct {
+	host.Host
+	comp    *completer
+	command []string
+	// echoDelay is how long the program is given to echo a key before the
+	// position of the cursor is asked for
+	echoDelay time.Duration
+
+	// keysMut guards line and serialises the keys written to the program,
+	// so that the keys of accepted entries are never mixed with typed ones.
+	// Results are never delivered while it is held.
+	keysMut sync.Mutex
+	line    *lineTracker
+
+	// posMut guards posQueries and posDeadline. posQueries is the number of
+	// position queries that have not been answered yet, as many answers are
+	// taken out of the input until posDeadline and sent to posReplies.
+	posMut      sync.Mutex
+	posQueries  int
+	posDeadline time.Time
+	posReplies  chan [2]int
+}
+
+// NewProvider returns a new instance of Provider using default options, the
+// command wrapped is WRAP_COMMAND split at whitespace
+func NewProvider() *Provider {
+	command := strings.Fields(viper.GetString("WRAP_COMMAND"))
+	program := ""
+	if len(command) > 0 {
+		program = filepath.Base(command[0])
+	}
+	return &Provider{
+		comp: &completer{
+			completionsPath: viper.GetString("WRAP_COMPLETIONS_PATH"),
+			program:         program,
+			historySize:     viper.GetInt("WRAP_HISTORY_SIZE"),
+		},
+		command:    command,
+		echoDelay:  viper.GetDuration("WRAP_ECHO_DELAY"),
+		line:       newLineTracker(),
+		posReplies: make(chan [2]int, 1),
+	}
+}
+
+// Start performs the required preparation and then starts the wrapped
+// program, as well as start providing completion results via compOptHandler
+func (p *Provider) Start() (err error) {
+	if len(p.command) == 0 {
+		return errors.New("wrap provider: command is not set")
+	}
+	path, err := exec.LookPath(p.command[0])
+	if err != nil {
+		return errors.Wrap(err, "cannot find wrapped command")
+	}
+
+	return p.Host.Start(host.Program{
+		Name:      "wrap",
+		Command:   &exec.Cmd{Path: path, Args: p.command},
+		Accept:    p.accept,
+		CopyInput: p.copyInput,
+	})
+}
+
+// copyInput passes the input to the program, following the line typed on
+// the way
+func (p *Provider) copyInput(ptmx *os.File, input io.Reader) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := input.Read(buf)
+		if n > 0 {
+			keys := p.takePosReplies(buf[:n])
+			if len(keys) > 0 {
+				if err := p.typeKeys(ptmx, keys); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot read input")
+		}
+	}
+}
+
+// takePosReplies takes the answers to the position queries that have not
+// been answered yet out of keys, even those that come too late to be waited
+// for, they are meant for the provider and not for the program. Any other
+// answers are left to the program, it may have asked itself.
+func (p *Provider) takePosReplies(keys []byte) []byte {
+	p.posMut.Lock()
+	defer p.posMut.Unlock()
+
+	if p.posQueries > 0 && time.Now().After(p.posDeadline) {
+		p.posQueries = 0
+	}
+	if p.posQueries == 0 {
+		return keys
+	}
+
+	return posReplyRe.ReplaceAllFunc(keys, func(reply []byte) []byte {
+		if p.posQueries == 0 {
+			return reply
+		}
+		p.posQueries--
+		m := posReplyRe.FindSubmatch(reply)
+		row, _ := strconv.Atoi(string(m[1]))
+		col, _ := strconv.Atoi(string(m[2]))
+		select {
+		case p.posReplies <- [2]int{row, col}:
+		default:
+		}
+		return nil
+	})
+}
+
+// typeKeys writes keys to the program and applies them to the line. Lines
+// typed while the program hides its input are passwords, they are neither
+// followed nor completed nor kept in history.
+func (p *Provider) typeKeys(ptmx *os.File, keys []byte) error {
+	p.keysMut.Lock()
+	defer p.keysMut.Unlock()
+
+	canonical, echo, err := ttyMode(ptmx)
+	if err != nil {
+		logrus.Trace("wrap provider: ", err)
+	}
+	if err == nil && canonical && !echo {
+		p.line.reset()
+	} else {
+		for _, line := range p.line.feed(keys, canonical) {
+			if line != "" && !strings.HasPrefix(line, " ") {
+				if err := p.comp.recordHistory(line); err != nil {
+					logrus.Error(errors.Wrap(err, "cannot record history"))
+				}
+			}
+		}
+		p.report()
+	}
+
+	_, err = ptmx.Write(keys)
+	return errors.Wrap(err, "cannot write keys")
+}
+
+// report completes the line as it is after the latest keys, keysMut must be
+// held. The result is delivered in the background, a line that is not known
+// is answered with no entries at once, so that the frontend stops showing
+// those of an earlier one.
+func (p *Provider) report() {
+	lbuffer, rbuffer := p.line.cursor()
+	csi := cmdline.Source{
+		Dir:     p.Dir(),
+		LBuffer: lbuffer,
+		RBuffer: rbuffer,
+		Buffer:  lbuffer + rbuffer,
+		Split:   wordSplit,
+	}
+
+	r, ok := p.Requests.Begin(csi.RequestID, false)
+	if !ok {
+		return
+	}
+	csi.RequestID = r.ID
+	synced := p.line.synced
+
+	go func() {
+		defer r.End()
+
+		if !synced {
+			r.Clear(csi)
+			return
+		}
+
+		// the program echoes the keys before the cursor is where the
+		// completions are shown
+		select {
+		case <-time.After(p.echoDelay):
+		case <-r.Context().Done():
+			return
+		}
+		csi.Line, csi.Col = p.queryPos(r.Context())
+
+		r.Get(csi, func(ctx context.Context) (*protoclui.CompletionInfo, error) {
+			return p.comp.getCompletion(ctx, csi)
+		})
+	}()
+}
+
+// queryPos asks the terminal of the frontend for the position of the cursor,
+// it is 0, 0 if the terminal does not answer in time
+func (p *Provider) queryPos(ctx context.Context) (line int, col int) {
+	p.posMut.Lock()
+	select {
+	case <-p.posReplies:
+		// a late answer to an earlier query
+	default:
+	}
+	p.posQueries++
+	p.posDeadline = time.Now().Add(posExpiry)
+	p.posMut.Unlock()
+
+	_, err := io.WriteString(p.Output(), posQuery)
+	if err != nil {
+		p.posMut.Lock()
+		if p.posQueries > 0 {
+			p.posQueries--
+		}
+		p.posMut.Unlock()
+		logrus.Error(errors.Wrap(err, "cannot query cursor position"))
+		return 0, 0
+	}
+
+	select {
+	case pos := <-p.posReplies:
+		return pos[0], pos[1]
+	case <-time.After(posTimeout):
+		logrus.Trace("wrap provider: no answer to cursor position query")
+	case <-ctx.Done():
+	}
+	return 0, 0
+}
+
+// accept types the keys that apply an accepted entry. The program cannot
+// check that the line has not changed since the entry was offered, so
+// entries are only applied while the line is known and no newer one has been
+// reported.
+func (p *Provider) accept(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+	p.keysMut.Lock()
+	defer p.keysMut.Unlock()
+
+	if ac.RequestId != p.Requests.Latest() || !p.line.synced {
+		return errors.Errorf("request %d is not the latest one, the line changed since", ac.RequestId)
+	}
+
+	csi, entry, err := p.Accepted(ac)
+	if err != nil {
+		return err
+	}
+
+	typed := keys(acceptEdit(csi, entry))
+	canonical, _, _ := ttyMode(ptmx)
+	p.line.feed([]byte(typed), canonical)
+	p.report()
+
+	_, err = io.WriteString(ptmx, typed)
+	return errors.Wrap(err, "cannot write accept keys")
+}
@@ -0,0 +1,32 @@
+//go:build linux
+// +build linux
+
+package wrap
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ttyMode returns whether the terminal of the wrapped program reads lines in
+// canonical mode and whether it echoes them, the pty master ptmx shares its
+// settings
+func ttyMode(ptmx *os.File) (canonical bool, echo bool, err error) {
+	conn, err := ptmx.SyscallConn()
+	if err != nil {
+		return false, false, errors.Wrap(err, "cannot get raw pty")
+	}
+	var t *unix.Termios
+	cerr := conn.Control(func(fd uintptr) {
+		t, err = unix.IoctlGetTermios(int(fd), unix.TCGETS)
+	})
+	if cerr != nil {
+		return false, false, errors.Wrap(cerr, "cannot get raw pty")
+	}
+	if err != nil {
+		return false, false, errors.Wrap(err, "cannot get terminal attributes")
+	}
+	return t.Lflag&unix.ICANON != 0, t.Lflag&unix.ECHO != 0, nil
+}
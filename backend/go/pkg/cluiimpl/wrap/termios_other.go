@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package wrap
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// ttyMode returns whether the terminal of the wrapped program reads lines in
+// canonical mode and whether it echoes them, it is only known on linux
+func ttyMode(ptmx *os.File) (canonical bool, echo bool, err error) {
+	return false, false, errors.New("terminal attributes are only read on linux")
+}
@@ -0,0 +1,234 @@
+package zsh
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// descriptionCacheFile is the name of the file descriptions are persisted to
+// inside the cache directory
+const descriptionCacheFile = "descriptions.json"
+
+// warmBatchSize is the number of commands looked up by a single whatis run
+// while warming the cache, warmTimeout bounds each of these runs
+const (
+	warmBatchSize = 256
+	warmTimeout   = 10 * time.Second
+)
+
+// cachedDescription is the description of the binary at a path as it was
+// when its modification time was ModTime, an empty Description records that
+// there is none so that it is not looked up again
+type cachedDescription struct {
+	ModTime     int64  `json:"mtime"`
+	Description string `json:"description"`
+}
+
+// descriptionCache maps resolved binary paths to their descriptions, it is
+// shared by all providers using the same cache directory and persisted there.
+// An entry is only valid as long as the binary keeps its modification time.
+type descriptionCache struct {
+	path string
+
+	mut     sync.Mutex
+	entries map[string]cachedDescription
+
+	// saveMut serialises writes of the cache file, saving tracks the writes
+	// started by saveAsync
+	saveMut  sync.Mutex
+	saving   sync.WaitGroup
+	warmOnce sync.Once
+}
+
+var (
+	descriptionCachesMut sync.Mutex
+	descriptionCaches    = map[string]*descriptionCache{}
+)
+
+// sharedDescriptionCache returns the description cache persisted in dir,
+// loading it from disk the first time it is asked for
+func sharedDescriptionCache(dir string) *descriptionCache {
+	descriptionCachesMut.Lock()
+	defer descriptionCachesMut.Unlock()
+
+	path := filepath.Join(dir, descriptionCacheFile)
+	if dc, ok := descriptionCaches[path]; ok {
+		return dc
+	}
+	dc := &descriptionCache{path: path, entries: map[string]cachedDescription{}}
+	if err := dc.load(); err != nil {
+		logrus.Info("starting with an empty description cache: ", err)
+	}
+	descriptionCaches[path] = dc
+	return dc
+}
+
+func (dc *descriptionCache) load() error {
+	b, err := os.ReadFile(dc.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "cannot read description cache")
+	}
+
+	entries := map[string]cachedDescription{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return errors.Wrap(err, "cannot parse description cache")
+	}
+
+	dc.mut.Lock()
+	dc.entries = entries
+	dc.mut.Unlock()
+	return nil
+}
+
+// save writes the cache to disk, the file is replaced atomically so that
+// readers never see a partial one
+func (dc *descriptionCache) save() error {
+	dc.saveMut.Lock()
+	defer dc.saveMut.Unlock()
+
+	dc.mut.Lock()
+	b, err := json.Marshal(dc.entries)
+	dc.mut.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal description cache")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dc.path), 0700); err != nil {
+		return errors.Wrap(err, "cannot create description cache directory")
+	}
+	// every save writes a temporary file of its own, other processes may
+	// share the cache
+	_, err = replaceFile(dc.path, b)
+	return errors.Wrap(err, "cannot replace description cache")
+}
+
+// saveAsync saves the cache in the background
+func (dc *descriptionCache) saveAsync() {
+	dc.saving.Add(1)
+	go func() {
+		defer dc.saving.Done()
+		if err := dc.save(); err != nil {
+			logrus.Info("cannot save description cache: ", err)
+		}
+	}()
+}
+
+// get returns the cached description of the binary at path, ok is false if
+// there is none or the binary changed since it was cached
+func (dc *descriptionCache) get(path string) (description string, ok bool) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", false
+	}
+
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	cd, ok := dc.entries[path]
+	if !ok {
+		return "", false
+	}
+	if cd.ModTime != fi.ModTime().UnixNano() {
+		delete(dc.entries, path)
+		return "", false
+	}
+	return cd.Description, true
+}
+
+// put caches description for the binary at path as it is now, it reports
+// whether the cache changed
+func (dc *descriptionCache) put(path string, description string) bool {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	cd := cachedDescription{ModTime: fi.ModTime().UnixNano(), Description: description}
+
+	dc.mut.Lock()
+	defer dc.mut.Unlock()
+
+	if old, ok := dc.entries[path]; ok && old == cd {
+		return false
+	}
+	dc.entries[path] = cd
+	return true
+}
+
+// warm looks up the descriptions of all executables in the directories of
+// $PATH that are not cached yet with whatis, it only does so once per cache
+// however often it is called
+func (dc *descriptionCache) warm(ctx context.Context, whatisPath string) {
+	dc.warmOnce.Do(func() {
+		if whatisPath == "" {
+			return
+		}
+
+		// names maps command names to the binaries they resolve to, the
+		// first directory of $PATH containing a name wins just like in a shell
+		names := map[string]string{}
+		var batch []string
+		for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+			des, err := os.ReadDir(dir)
+			if err != nil {
+				continue
+			}
+			for _, de := range des {
+				name := de.Name()
+				if _, ok := names[name]; ok {
+					continue
+				}
+				path, err := filepath.Abs(filepath.Join(dir, name))
+				if err != nil {
+					continue
+				}
+				fi, err := os.Stat(path)
+				if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+					continue
+				}
+				names[name] = path
+				if _, ok := dc.get(path); !ok {
+					batch = append(batch, name)
+				}
+			}
+		}
+
+		logrus.Debugf("warming description cache with %d commands", len(batch))
+		changed := false
+		for len(batch) > 0 && ctx.Err() == nil {
+			n := warmBatchSize
+			if n > len(batch) {
+				n = len(batch)
+			}
+			wctx, cancel := context.WithTimeout(ctx, warmTimeout)
+			descriptions, err := whatis(wctx, whatisPath, batch[:n])
+			cancel()
+			if err != nil {
+				logrus.Debug("cannot warm description cache: ", err)
+			}
+			// commands whatis does not know are left out, they may still be
+			// described by --help later
+			for name, description := range descriptions {
+				if path, ok := names[name]; ok && dc.put(path, description) {
+					changed = true
+				}
+			}
+			batch = batch[n:]
+		}
+
+		if changed {
+			if err := dc.save(); err != nil {
+				logrus.Info("cannot save description cache: ", err)
+			}
+		}
+	})
+}
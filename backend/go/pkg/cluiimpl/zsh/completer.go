@@ -1,162 +1,426 @@
 package zsh
 
 import (
+	"bufio"
 	"context"
-	"fmt"
 	"os/exec"
 	"sort"
 	"strings"
 	"time"
 
+	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
 	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-type completionSourceInfo struct {
-	col     int
-	line    int
-	dir     string
-	lbuffer string
-	rbuffer string
-	buffer  string
+type completer struct {
+	completerScriptPath string
+	zshPath             string
+	// maxHelp indicates the number of first compopt we should provide description for
+	maxHelp int
+	// whatisPath is the whatis used to look up command descriptions, command
+	// descriptions are not looked up if it is empty
+	whatisPath string
+	// execHelp allows running <cmd> --help for commands whatis does not know,
+	// it must only be enabled if every command in $PATH is trusted to not do
+	// anything but print its help
+	execHelp bool
+	// descriptions caches command descriptions across requests, they are
+	// looked up for every request if it is nil
+	descriptions *descriptionCache
+	// describeSem bounds the number of description lookups running at once
+	// across all requests, they are not bounded if it is nil
+	describeSem chan struct{}
+	// describeDeadline is the time streamCompletion waits for descriptions
+	// before it passes on the entries, the rest follows once known
+	describeDeadline time.Duration
+	// initialEntries is the number of entries streamCompletion sends as
+	// soon as compsys has reported them, the rest follows in updates of
+	// entriesChunk entries each once the capture is done. Zero means no
+	// limit.
+	initialEntries int
+	entriesChunk   int
+	// history is the zsh history file and dirHistory the commands recorded
+	// along with their directory by install-key-listener.zsh, both are used
+	// for suggestions on an empty line
+	history    *historyFile
+	dirHistory *historyFile
+	// fuzzy makes compsys offer every candidate for the word under the
+	// cursor, which are then fuzzy matched against it instead of only those
+	// starting with it
+	fuzzy bool
+	// ranker orders the entries by how likely they are to be accepted, they
+	// are only ordered by how well they match if it is nil
+	ranker *ranker
+	// pool holds persistent capture workers, completerScriptPath is executed
+	// for every request instead if it is nil
+	pool *workerPool
 }
 
-func (csi *completionSourceInfo) words() []string {
-	return strings.Fields(csi.buffer)
+// broadCursor returns the parts of the buffer before and after the cursor
+// without the word under the cursor, so that compsys offers every candidate
+// for the word. The word is kept up to its last separator, compsys completes
+// the part after it on its own.
+func broadCursor(csi cmdline.Source) (lbuffer string, rbuffer string) {
+	lbuffer, rbuffer = csi.Cursor()
+	left, right := csi.CurrentWord()
+	keep := strings.LastIndexAny(left, fuzzySeparators) + 1
+	return lbuffer[:len(lbuffer)-len(left)+keep], rbuffer[len(right):]
 }
 
-func (csi *completionSourceInfo) countWord() int64 {
-
-	sepbuf := csi.words()
+// capture returns the raw completion lines printed by capture.zsh for csi
+func (co *completer) capture(ctx context.Context, csi cmdline.Source) (cts []string, err error) {
+	lbuffer, rbuffer := csi.Cursor()
+	return co.captureAt(ctx, csi.Dir, lbuffer, rbuffer)
+}
 
-	// Count the number of non-empty word in sepbuf
-	count := 0
-	for _, s := range sepbuf {
-		if s != "" {
-			count++
-		}
+// captureAt returns the raw completion lines printed by capture.zsh for the
+// cursor between lbuffer and rbuffer in dir
+func (co *completer) captureAt(ctx context.Context, dir string, lbuffer string, rbuffer string) (cts []string, err error) {
+	err = co.captureLinesAt(ctx, dir, lbuffer, rbuffer, func(line string) {
+		cts = append(cts, line)
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return int64(count)
+	return
 }
 
-// isFirstWord returns whether the we are completing for the first word, which
-// is in most cases actual command
-func (csi *completionSourceInfo) isFirstWord() bool {
+// captureLinesAt passes the raw completion lines printed by capture.zsh for
+// the cursor between lbuffer and rbuffer in dir to onLine as soon as they are
+// printed, without the trailing \r\n
+func (co *completer) captureLinesAt(ctx context.Context, dir string, lbuffer string, rbuffer string, onLine func(line string)) (err error) {
 
-	return csi.countWord() == 1
+	if co.pool != nil {
+		return co.pool.captureLines(ctx, dir, lbuffer, rbuffer, onLine)
+	}
 
+	// the buffer is passed as arguments of its own, it must never be parsed
+	// by a shell
+	cmd := exec.CommandContext(ctx, co.zshPath, co.completerScriptPath, lbuffer, rbuffer)
+	cmd.Dir = dir
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrap(err, "cannot get stdout of capture.zsh")
+	}
+	if err = cmd.Start(); err != nil {
+		return errors.Wrap(err, "cannot start capture.zsh")
+	}
+
+	r := bufio.NewReader(out)
+	for {
+		line, rerr := r.ReadString('\n')
+		if line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"); line != "" {
+			onLine(line)
+		}
+		if rerr != nil {
+			break
+		}
+	}
+
+	return cmd.Wait()
 }
 
-// isEmpty returns whether the we are completing for no word, which means the
-// user has not typed any command yet and we can suggest some by ourselves
-func (csi *completionSourceInfo) isEmpty() bool {
+// captureDescriptionSep separates a match from its description in the lines
+// printed by the compadd override of capture-init.zsh
+const captureDescriptionSep = " -- "
 
-	return csi.countWord() == 0
+// parseCaptureLine splits a line printed by capture.zsh into the match and the
+// description compsys gave for it, if any
+func parseCaptureLine(line string) (match string, description string) {
+	line = strings.TrimSuffix(line, "\r")
+	if i := strings.Index(line, captureDescriptionSep); i >= 0 {
+		return line[:i], strings.TrimSpace(line[i+len(captureDescriptionSep):])
+	}
+	// an empty description leaves the separator without its trailing space
+	return strings.TrimSuffix(line, strings.TrimRight(captureDescriptionSep, " ")), ""
+}
 
+// captureGroupSep follows the tag and the explanation of the group of a match
+// in the lines printed by the compadd override of capture-init.zsh
+const captureGroupSep = "\x1f"
+
+// historyTag is the tag of the group of commands from the history offered in
+// fuzzy mode
+const historyTag = "history"
+
+// parseCaptureGroup splits the tag and the explanation of the group of the
+// match off a line printed by capture.zsh, the explanation is what compsys
+// would show as header of the group. Lines without them belong to no group.
+func parseCaptureGroup(line string) (tag string, header string, rest string) {
+	fields := strings.SplitN(line, captureGroupSep, 3)
+	if len(fields) < 3 {
+		return "", "", line
+	}
+	tag, header, rest = fields[0], fields[1], fields[2]
+	if header == "" {
+		header = tag
+	}
+	return
 }
 
-type completer struct {
-	completerScriptPath string
-	zshPath             string
-	// maxHelp indicates the number of first compopt we should provide description for
-	maxHelp int
+// getCompletion provide the hacky logic the retrieve the completions results,
+// it waits for all descriptions and gives up as soon as ctx is cancelled. The
+// updates are merged into a single CompletionInfo.
+func (co *completer) getCompletion(ctx context.Context, csi cmdline.Source) (ci *protoclui.CompletionInfo, err error) {
+	err = co.completion(ctx, csi, 0, func(u *protoclui.CompletionInfo) {
+		if ci == nil {
+			ci = u
+			return
+		}
+		clui.ApplyFollowUp(ci, u)
+	})
+	if ci == nil {
+		ci = &protoclui.CompletionInfo{RequestId: csi.RequestID}
+	}
+	return
 }
 
-// Do not process these commands, those are known to be buggy
-var blacklistedCommands = []string{
-	"vimtutor",
+// streamCompletion passes the completion results for csi to handle as soon as
+// they are known, as a sequence of updates ending with one marked done. Only
+// the first entries go out at once, descriptions not known by
+// describeDeadline follow later. It returns once everything has been passed to
+// handle or ctx is cancelled.
+func (co *completer) streamCompletion(ctx context.Context, csi cmdline.Source, handle func(ci *protoclui.CompletionInfo)) error {
+	return co.completion(ctx, csi, co.describeDeadline, handle)
 }
 
-// getCompletion provide the hacky logic the retrieve the completions results
-func (co *completer) getCompletion(csi completionSourceInfo) (ci protoclui.CompletionInfo, err error) {
+// completion computes the completion results for csi and passes them to
+// handle as a sequence of updates, waiting deadline for descriptions, or for
+// all of them if it is zero. With a non-zero deadline the first entries go
+// out as soon as compsys has reported enough of them, otherwise all of them
+// are ranked together before anything is passed on.
+func (co *completer) completion(ctx context.Context, csi cmdline.Source, deadline time.Duration, handle func(ci *protoclui.CompletionInfo)) (err error) {
+
+	logrus.Tracef("completing request %d for %s at cwd %s", csi.RequestID, csi.Buffer, csi.Dir)
 
-	logrus.Tracef("completing for %s at cwd %s", csi.buffer, csi.dir)
+	ci := &protoclui.CompletionInfo{RequestId: csi.RequestID}
+
+	ci.Col = int32(csi.Col)
+	ci.Line = int32(csi.Line)
+	ci.IsEmpty = csi.IsEmpty()
+	ci.IsFirst = csi.IsFirstWord()
+	ci.BufferLength = int32(len(csi.Buffer))
+
+	if ci.IsEmpty {
+		// we suggest our own completion results if there are no command
+		// has already be input, there is nothing for compsys to complete
+		ci.Entries = co.suggest(csi.Dir)
+		ci.Done = true
+		handle(ci)
+		return
+	}
+
+	left, right := csi.CurrentWord()
+	word := left + right
+	fuzzy := co.fuzzy && isFuzzyWord(word)
+
+	s := &completionStream{
+		co:       co,
+		csi:      csi,
+		ci:       ci,
+		deadline: deadline,
+		handle:   handle,
+		left:     left,
+		right:    right,
+		groups:   map[string]uint32{},
+	}
+
+	// Compile the completions results into our CompletionInfo as they arrive
+
+	// Since our script is hacky, skip empty results
+	var matches []capturedMatch
+	// fuzzy candidates come from both compsys and the history, each of them
+	// is only offered once
+	seen := map[string]bool{}
+	addMatch := func(compopt string, description string, tag string, header string) {
+		if compopt == "" || (fuzzy && seen[compopt]) {
+			return
+		}
+		m := capturedMatch{compopt: compopt, description: description, tag: tag, header: header}
+		if fuzzy {
+			score, positions, ok := fuzzyMatchTypo(word, compopt)
+			if !ok {
+				return
+			}
+			m.quality = prefixWeight * float64(score) / float64(maxFuzzyScore(len([]rune(word))))
+			m.positions = positions
+		} else {
+			m.quality = prefixQuality(left, compopt)
+			m.positions = prefixMatchPositions(left, right, compopt)
+		}
+		seen[compopt] = true
+		matches = append(matches, m)
+	}
+
+	early := deadline > 0 && co.initialEntries > 0
+	var sendErr error
+	onLine := func(ct string) {
+		tag, header, rest := parseCaptureGroup(ct)
+		compopt, description := parseCaptureLine(rest)
+		addMatch(compopt, description, tag, header)
+		if early && s.sequence == 0 && len(matches) >= co.initialEntries {
+			// the first entries do not wait for the rest of the capture,
+			// they are only ranked among themselves
+			batch := co.rankMatches(csi, matches)
+			matches = nil
+			sendErr = s.send(ctx, batch, s.describe(ctx, batch), false)
+		}
+	}
 
 	// Obtain Completion Results
-	cmd := exec.Cmd{
-		Path: co.zshPath,
-		Args: []string{co.zshPath, "-c", fmt.Sprintf("%s '%s'", co.completerScriptPath, csi.buffer)},
-		Dir:  csi.dir,
-		Env:  nil,
+	if fuzzy {
+		lbuffer, rbuffer := broadCursor(csi)
+		err = co.captureLinesAt(ctx, csi.Dir, lbuffer, rbuffer, onLine)
+	} else {
+		lbuffer, rbuffer := csi.Cursor()
+		err = co.captureLinesAt(ctx, csi.Dir, lbuffer, rbuffer, onLine)
+	}
+	if err == nil {
+		err = sendErr
 	}
-	out, err := cmd.Output()
 	if err != nil {
 		return
 	}
-	outStr := string(out)
 
-	cts := strings.Split(outStr, "\r\n")
+	if fuzzy && ci.IsFirst {
+		// whole commands run before are candidates too, a few typed
+		// characters of them are enough to find them again
+		history, herr := co.history.read()
+		if herr != nil {
+			logrus.Debug("cannot read history: ", herr)
+		}
+		for _, cs := range tallyCommands(history, "") {
+			addMatch(cs.command, "run "+pluralTimes(cs.count), historyTag, "command from history")
+		}
+	}
+
+	// the most likely entries come first, so that they make it into the
+	// earliest update
+	matches = co.rankMatches(csi, matches)
+	descriptions := s.describe(ctx, matches)
+	if s.sequence == 0 {
+		// unless the first entries are out already, the groups are known up
+		// front, so that even the first update can show every section
+		s.addGroups(ci, matches)
+	}
 
-	// sort the completion result by alphabetical order
-	sort.Strings(cts)
+	// the matches are split into the updates, entries are in the same order
+	// as matches
+	size := co.initialEntries
+	if s.sequence > 0 {
+		size = co.entriesChunk
+	}
+	chunks := chunkMatches(matches, size, co.entriesChunk)
+	for i, chunk := range chunks {
+		if err = s.send(ctx, chunk, descriptions, i == len(chunks)-1); err != nil {
+			return
+		}
+	}
+	s.finish()
+	return
 
-	// Compile these completions results into our CompletionInfo
+}
 
-	ci.Col = int32(csi.col)
-	ci.Line = int32(csi.line)
-	ci.IsEmpty = csi.isEmpty()
-	ci.IsFirst = csi.isFirstWord()
-	ci.BufferLength = int32(len(csi.buffer))
+// capturedMatch is a match reported by compsys or taken from the history
+type capturedMatch struct {
+	compopt, description string
+	// quality is how well compopt matches the word, positions are the
+	// characters that matched it
+	quality   float64
+	positions []int
+	// tag and header describe the group of compopt, tag is empty if it
+	// belongs to none
+	tag, header string
+}
 
-	if ci.IsEmpty {
-		// we should suggest our own completion results if there are no command
-		// has already be input
-		return
+// rankMatches orders matches by how likely they are to be accepted, matches
+// with the same score are in alphabetical order
+func (co *completer) rankMatches(csi cmdline.Source, matches []capturedMatch) []capturedMatch {
+
+	// sort the completion result by alphabetical order, the ranking below
+	// keeps this order for entries with the same score
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].compopt < matches[j].compopt
+	})
+
+	compopts := make([]string, len(matches))
+	quality := make([]float64, len(matches))
+	for i, m := range matches {
+		compopts[i] = m.compopt
+		quality[i] = m.quality
 	}
+	ranked := make([]capturedMatch, len(matches))
+	for i, j := range co.ranker.rank(csi, compopts, quality) {
+		ranked[i] = matches[j]
+	}
+	return ranked
+}
 
-COMPOPT_LOOP:
-	for compoptI, compopt := range cts {
-		// Since our script is hacky, skip empty results
-		if compopt == "" {
-			continue
-		}
-		// Skip blacklisted commands
-		for _, bcmd := range blacklistedCommands {
-			if bcmd == compopt {
-				logrus.Debug("ignored blacklisted command: ", compopt)
-				continue COMPOPT_LOOP
+// completionStream passes the entries of a single completion to handle as a
+// sequence of updates, ci is the first of them
+type completionStream struct {
+	co          *completer
+	csi         cmdline.Source
+	ci          *protoclui.CompletionInfo
+	deadline    time.Duration
+	handle      func(ci *protoclui.CompletionInfo)
+	left, right string
+
+	// sequence is the sequence of the next update and sent holds the matches
+	// of the entries passed on so far
+	sequence uint32
+	sent     []capturedMatch
+	// groups maps the tags of the groups passed on so far to their index
+	groups map[string]uint32
+	// late holds the description lookups that did not finish by deadline
+	late []<-chan map[string]string
+	done bool
+}
+
+// describe looks up the descriptions of the commands among the matches that
+// are to be sent next, if this is the first word and compsys has no
+// description for them. Only the descriptions known by deadline are returned,
+// the others are sent in a follow-up by finish.
+func (s *completionStream) describe(ctx context.Context, matches []capturedMatch) map[string]string {
+	var undescribed []string
+	if s.ci.IsFirst {
+		maxHelp := s.co.maxHelp
+		for i, m := range matches {
+			compoptI := len(s.sent) + i
+			if m.description == "" && (maxHelp == 0 || (maxHelp > 0 && compoptI < maxHelp)) {
+				undescribed = append(undescribed, m.compopt)
 			}
 		}
-		// logrus.Debug("compopt: ", compopt)
-		var description string
-
-		// if this is the first word, we can provide description of the command
-		// by taking the first line of <cmd> --help
-		// TODO: cache the help results
-		// TODO: preload the help results for common commands that exist in the
-		//		 cotainer enviroment into the clinet
-		// TODO: execute the help commands parallelly to reduce the latency
-		if ci.IsFirst && (co.maxHelp == 0 || (co.maxHelp > 0 && compoptI < co.maxHelp)) {
-
-			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
-			defer cancel()
-
-			// disable zsh for faster help results
-			// helpCmd := exec.CommandContext(ctx, co.zshPath, "-c", fmt.Sprintf("%s --help", compopt))
-			cmdpath, herr := exec.LookPath(compopt)
-			if herr == nil {
-
-				helpCmd := exec.CommandContext(ctx, cmdpath, "--help")
-
-				combout, _ := helpCmd.CombinedOutput()
-
-				// we can ignore herr if it is a ExitError, otherwise we will have
-				// to return error
-				// switch e := herr.(type) {
-				// case *exec.ExitError:
-				// default:
-				// 	// or we can just ignore any kind of error anyway, it shouldn't
-				// 	// be important
-				// 	err = e
-				// 	return
-				// }
-
-				// get the first line of combout
-				description = strings.Split(string(combout), "\n")[0]
-				logrus.Debug("description: ", description)
-			}
+	}
+	descriptions, late := s.co.describeCommands(ctx, undescribed, s.deadline)
+	s.late = append(s.late, late)
+	return descriptions
+}
+
+// send passes batch on as the next update, last marks the update as the end
+// unless descriptions are still coming. It returns ctx.Err() once a newer
+// request has superseded this one, nobody is interested in the results then.
+func (s *completionStream) send(ctx context.Context, batch []capturedMatch, descriptions map[string]string, last bool) error {
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	u := s.ci
+	if s.sequence > 0 {
+		u = &protoclui.CompletionInfo{RequestId: s.ci.RequestId}
+	}
+	u.Sequence = s.sequence
+
+	s.addGroups(u, batch)
+
+	for _, m := range batch {
+		compopt, description := m.compopt, m.description
+		if description == "" {
+			description = descriptions[compopt]
 		}
 
 		// we will also need to provide the actual input the frontend should
@@ -164,14 +428,14 @@ COMPOPT_LOOP:
 
 		var actualInput string
 		var shouldInput bool
-		lastWord := csi.words()[len(csi.words())-1]
-		// normally, lastWord should overlap with compopt, if that is not the
-		// case, we just pass the whole compopt as actualInput and then
-		// tell our frontend not to complete this word, and just let user type
-		// the suggestion instead.
-
-		if compopt[:len(lastWord)] == lastWord {
-			actualInput = compopt[len(lastWord):]
+		// normally, compopt starts with the part of the word before the cursor
+		// and ends with the part after it, so actualInput is what has to be
+		// typed at the cursor. If that is not the case, we just pass the whole
+		// compopt as actualInput and then tell our frontend not to complete
+		// this word, and just let user type the suggestion instead.
+
+		if strings.HasPrefix(compopt, s.left) && strings.HasSuffix(compopt[len(s.left):], s.right) {
+			actualInput = compopt[len(s.left) : len(compopt)-len(s.right)]
 			shouldInput = true
 		} else {
 			actualInput = compopt
@@ -179,15 +443,108 @@ COMPOPT_LOOP:
 		}
 
 		// processing done, now add it to our suggestions
-		ci.Entries = append(ci.Entries, &protoclui.CompletionEntry{
+		entry := &protoclui.CompletionEntry{
 			ActualInput: actualInput,
 			ShouldInput: shouldInput,
 			Description: description,
 			Suggestion:  compopt,
 			Level:       0,
-		})
+			MatchRanges: matchRanges(m.positions),
+		}
+		if m.tag != "" {
+			entry.Level = 1
+			entry.Group = s.groups[m.tag]
+		}
+		u.Entries = append(u.Entries, entry)
+	}
 
+	if last {
+		// the last chunk is the end unless descriptions are still coming
+		s.done = true
+		for i, late := range s.late {
+			select {
+			case descriptions, ok := <-late:
+				if ok {
+					s.late[i] = onlyDescriptions(descriptions)
+					s.done = false
+				}
+			default:
+				s.done = false
+			}
+		}
+		u.Done = s.done
+	}
+
+	s.sent = append(s.sent, batch...)
+	s.sequence++
+	s.handle(u)
+	return nil
+}
+
+// addGroups adds the groups of matches that have not been passed on yet to
+// u, groups are numbered in the order of their first entry
+func (s *completionStream) addGroups(u *protoclui.CompletionInfo, matches []capturedMatch) {
+	for _, m := range matches {
+		if _, ok := s.groups[m.tag]; m.tag != "" && !ok {
+			s.groups[m.tag] = uint32(len(s.groups))
+			u.Groups = append(u.Groups, &protoclui.CompletionGroup{Tag: m.tag, Header: m.header})
+		}
+	}
+}
+
+// finish passes on the descriptions that were not known in time in a last
+// follow-up, unless the last update has been marked done already
+func (s *completionStream) finish() {
+
+	if s.done {
+		return
 	}
-	return
 
+	descriptions := map[string]string{}
+	for _, late := range s.late {
+		for ds := range late {
+			for name, description := range ds {
+				descriptions[name] = description
+			}
+		}
+	}
+
+	fu := &protoclui.CompletionInfo{
+		RequestId: s.ci.RequestId,
+		Sequence:  s.sequence,
+		Done:      true,
+	}
+	for i, m := range s.sent {
+		if description, ok := descriptions[m.compopt]; ok && m.description == "" {
+			fu.LateDescriptions = append(fu.LateDescriptions, &protoclui.EntryDescription{
+				EntryIndex:  uint32(i),
+				Description: description,
+			})
+		}
+	}
+	s.handle(fu)
+}
+
+// onlyDescriptions returns a closed channel that yields descriptions first
+func onlyDescriptions(descriptions map[string]string) <-chan map[string]string {
+	c := make(chan map[string]string, 1)
+	c <- descriptions
+	close(c)
+	return c
+}
+
+// chunkMatches splits matches into the first size of them and chunks of
+// chunk following them, there is always at least one chunk. A chunk size of
+// zero means no limit.
+func chunkMatches(matches []capturedMatch, size int, chunk int) (chunks [][]capturedMatch) {
+	for {
+		if size <= 0 || size >= len(matches) {
+			return append(chunks, matches)
+		}
+		// the capacity is limited so that appending to a chunk never
+		// overwrites the next one
+		chunks = append(chunks, matches[:size:size])
+		matches = matches[size:]
+		size = chunk
+	}
 }
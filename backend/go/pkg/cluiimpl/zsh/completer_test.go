@@ -1,13 +1,20 @@
 package zsh
 
 import (
+	"context"
+	"fmt"
 	"io/fs"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
@@ -42,16 +49,16 @@ func TestMain(m *testing.M) {
 
 func TestCompletion(t *testing.T) {
 	require := require.New(t)
-	csi := completionSourceInfo{
-		dir:     testDir,
-		col:     15,
-		line:    20,
-		lbuffer: "vi",
-		rbuffer: "",
-		buffer:  "vi",
+	csi := cmdline.Source{
+		Dir:     testDir,
+		Col:     15,
+		Line:    20,
+		LBuffer: "vi",
+		RBuffer: "",
+		Buffer:  "vi",
 	}
 
-	ci, err := testCompleter.getCompletion(csi)
+	ci, err := testCompleter.getCompletion(context.Background(), csi)
 
 	if err != nil {
 		if err, ok := err.(*fs.PathError); ok {
@@ -61,25 +68,84 @@ func TestCompletion(t *testing.T) {
 
 	require.Nil(err)
 
-	require.Equal(ci.Col, int64(csi.col))
-	require.Equal(ci.Line, int64(csi.line))
+	require.Equal(ci.Col, int32(csi.Col))
+	require.Equal(ci.Line, int32(csi.Line))
 	require.Equal(ci.IsEmpty, false)
 	require.Equal(ci.IsFirst, true)
-	require.Equal(ci.BufferLength, int64(2))
+	require.Equal(ci.BufferLength, int32(2))
 
 }
 
-func TestWordCount(t *testing.T) {
+func newTestPool(size int) *workerPool {
+	initScriptPath := filepath.Join(filepath.Dir(getCompleterScriptPath()), "capture-init.zsh")
+	return newWorkerPool("/bin/zsh", initScriptPath, size)
+}
+
+func TestCompletionPool(t *testing.T) {
 	require := require.New(t)
 
-	require.Equal((&completionSourceInfo{buffer: "   "}).isEmpty(), true)
-	require.Equal((&completionSourceInfo{buffer: "  \t\t\t "}).isEmpty(), true)
-	require.Equal((&completionSourceInfo{buffer: "\t word  \t "}).isFirstWord(), true)
-	require.Equal((&completionSourceInfo{buffer: "\t word  \t word2 \t  \t  "}).countWord(), int64(2))
+	pool := newTestPool(1)
+	pool.start()
+	defer pool.close()
+
+	poolCompleter := &completer{zshPath: "/bin/zsh", completerScriptPath: getCompleterScriptPath(), pool: pool}
+	csi := cmdline.Source{
+		Dir:     testDir,
+		Col:     15,
+		Line:    20,
+		LBuffer: "vi",
+		RBuffer: "",
+		Buffer:  "vi",
+	}
+
+	// the same worker must be reusable across requests
+	for i := 0; i < 3; i++ {
+		ci, err := poolCompleter.getCompletion(context.Background(), csi)
+		require.Nil(err)
+		require.Equal(ci.IsFirst, true)
+		require.NotEmpty(ci.Entries)
+	}
+
+	oneshot, err := testCompleter.capture(context.Background(), csi)
+	require.Nil(err)
+	pooled, err := pool.capture(context.Background(), csi.Dir, csi.Buffer, "")
+	require.Nil(err)
+	require.ElementsMatch(nonEmpty(oneshot), nonEmpty(pooled))
+}
+
+func TestCompletionPoolRestart(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(1)
+	pool.start()
+	defer pool.close()
+
+	_, err := pool.capture(context.Background(), testDir, "vi", "")
+	require.Nil(err)
+
+	// kill the only worker behind the pool's back, the health check on
+	// checkout must replace it
+	w := <-pool.idle
+	w.kill()
+	<-w.done
+	pool.idle <- w
+
+	_, err = pool.capture(context.Background(), testDir, "vi", "")
+	require.Nil(err)
+}
+
+func nonEmpty(ss []string) (res []string) {
+	for _, s := range ss {
+		if s != "" {
+			res = append(res, s)
+		}
+	}
+	return
 }
 
 // BenchmarkCompletion benchmark the completion speed of a random 1 letter command
-// suffix
+// suffix, running capture.zsh for every request and using a pool of
+// persistent capture workers
 func BenchmarkCompletion(b *testing.B) {
 	logrus.SetLevel(logrus.ErrorLevel)
 	cmdLength := 1
@@ -94,22 +160,790 @@ func BenchmarkCompletion(b *testing.B) {
 	randCmd = "vi"
 	b.Logf("running with command %s", randCmd)
 
-	benchCompleter := &completer{zshPath: "/bin/zsh", completerScriptPath: getCompleterScriptPath(), maxHelp: b.N}
-	csi := completionSourceInfo{
-		dir:     testDir,
-		col:     15,
-		line:    20,
-		lbuffer: randCmd,
-		rbuffer: "",
-		buffer:  randCmd,
+	csi := cmdline.Source{
+		Dir:     testDir,
+		Col:     15,
+		Line:    20,
+		LBuffer: randCmd,
+		RBuffer: "",
+		Buffer:  randCmd,
+	}
+
+	bench := func(benchCompleter *completer) func(b *testing.B) {
+		return func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := benchCompleter.getCompletion(context.Background(), csi); err != nil {
+					b.Fatal("cannot get completion, stopping: ", err)
+				}
+			}
+		}
 	}
 
-	b.ResetTimer()
+	b.Run("oneshot", bench(&completer{zshPath: "/bin/zsh", completerScriptPath: getCompleterScriptPath(), maxHelp: 10}))
 
-	_, err := benchCompleter.getCompletion(csi)
+	pool := newTestPool(1)
+	pool.start()
+	defer pool.close()
+	// wait for the worker to be initialised so compinit is not measured
+	if _, err := pool.capture(context.Background(), csi.Dir, csi.Buffer, ""); err != nil {
+		b.Fatal("cannot initialise capture worker, stopping: ", err)
+	}
 
-	if err != nil {
-		b.Fatal("cannot get completion, stopping: ", err)
+	b.Run("pool", bench(&completer{zshPath: "/bin/zsh", completerScriptPath: getCompleterScriptPath(), maxHelp: 10, pool: pool}))
+
+}
+
+func TestCompletionInjection(t *testing.T) {
+	require := require.New(t)
+
+	pool := newTestPool(1)
+	pool.start()
+	defer pool.close()
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "injected")
+
+	buffers := []string{
+		"echo it's",
+		"echo 'unterminated",
+		"echo \"unterminated",
+		"echo '; touch " + marker + "; echo '",
+		"echo $(touch " + marker + ")",
+		"echo `touch " + marker + "`",
+		"echo a\ntouch " + marker + "\necho ",
+		"echo a\rtouch " + marker + "\recho ",
+		"echo \x03\x15touch " + marker + "\x18\x03",
+		"echo héllo wörld 日本",
+	}
+
+	for _, buffer := range buffers {
+		_, err := testCompleter.capture(context.Background(), cmdline.Source{Dir: dir, Buffer: buffer})
+		require.Nil(err, "oneshot: %q", buffer)
+		_, err = pool.capture(context.Background(), dir, buffer, "")
+		require.Nil(err, "pool: %q", buffer)
+
+		_, err = os.Stat(marker)
+		require.True(os.IsNotExist(err), "buffer %q executed a command", buffer)
+	}
+
+	// unicode must survive the trip into zle
+	require.Nil(os.WriteFile(filepath.Join(dir, "日本語.txt"), nil, 0666))
+	cts, err := testCompleter.capture(context.Background(), cmdline.Source{Dir: dir, Buffer: "cat 日"})
+	require.Nil(err)
+	require.Contains(strings.Join(cts, "\n"), "日本語.txt")
+	cts, err = pool.capture(context.Background(), dir, "cat 日", "")
+	require.Nil(err)
+	require.Contains(strings.Join(cts, "\n"), "日本語.txt")
+}
+
+func TestCompletionCursor(t *testing.T) {
+	require := require.New(t)
+	csi := cmdline.Source{
+		Dir:     testDir,
+		Buffer:  "gi status",
+		LBuffer: "gi",
+		RBuffer: " status",
+	}
+
+	ci, err := testCompleter.getCompletion(context.Background(), csi)
+	require.Nil(err)
+	require.True(ci.IsFirst)
+
+	// the rest of the line is left alone, only the word at the cursor is
+	// completed
+	var found bool
+	for _, e := range ci.Entries {
+		require.NotContains(e.Suggestion, "status")
+		if e.Suggestion == "git" {
+			found = true
+			require.True(e.ShouldInput)
+			require.Equal("t", e.ActualInput)
+		}
+	}
+	require.True(found)
+}
+
+func TestParseCaptureLine(t *testing.T) {
+	require := require.New(t)
+
+	for line, want := range map[string][2]string{
+		"checkout -- switch branches or restore working tree files": {"checkout", "switch branches or restore working tree files"},
+		"--color -- colorize the output -- always":                  {"--color", "colorize the output -- always"},
+		"src/":          {"src/", ""},
+		"main.go -- ":   {"main.go", ""},
+		"main.go --":    {"main.go", ""},
+		"vim\r":         {"vim", ""},
+		"日本語.txt -- 日本": {"日本語.txt", "日本"},
+	} {
+		match, description := parseCaptureLine(line)
+		require.Equal(want[0], match, line)
+		require.Equal(want[1], description, line)
+	}
+}
+
+func TestCompletionDescriptions(t *testing.T) {
+	require := require.New(t)
+	csi := cmdline.Source{
+		Dir:    testDir,
+		Buffer: "git chec",
+	}
+
+	ci, err := testCompleter.getCompletion(context.Background(), csi)
+	require.Nil(err)
+
+	// subcommands are described by compsys, not by running --help
+	var found bool
+	for _, e := range ci.Entries {
+		require.NotContains(e.Suggestion, captureDescriptionSep)
+		if e.Suggestion == "checkout" {
+			found = true
+			require.NotEmpty(e.Description)
+			require.Equal("kout", e.ActualInput)
+		}
+	}
+	require.True(found)
+}
+
+func TestParseWhatis(t *testing.T) {
+	require := require.New(t)
+
+	out := "ls (1)               - list directory contents\n" +
+		"printf (1)           - format and print data\n" +
+		"printf (3)           - formatted output conversion\n" +
+		"git-checkout (1)     - Switch branches or restore working tree files\n" +
+		"nothing appropriate.\n"
+	require.Equal(map[string]string{
+		"ls":           "list directory contents",
+		"printf":       "format and print data",
+		"git-checkout": "Switch branches or restore working tree files",
+	}, parseWhatis([]byte(out)))
+}
+
+// writeTestCommand writes an executable shell script named name into dir
+func writeTestCommand(t *testing.T, dir string, name string, script string) {
+	require.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755))
+}
+
+// describeAll returns the descriptions of names, waiting for all of them
+func describeAll(co *completer, names []string) map[string]string {
+	descriptions, _ := co.describeCommands(context.Background(), names, 0)
+	return descriptions
+}
+
+func TestDescribeCommands(t *testing.T) {
+	require := require.New(t)
+
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("CLUI_SECRET", "secret")
+	marker := filepath.Join(t.TempDir(), "ran")
+
+	writeTestCommand(t, bin, "cluihelp", `touch `+marker+`
+echo "cluihelp $1 home=$HOME secret=$CLUI_SECRET pwd=$(pwd)"
+echo "second line"
+`)
+	writeTestCommand(t, bin, "cluihang", "sleep 10 & sleep 10\n")
+
+	// nothing is executed unless it is enabled explicitly
+	co := &completer{}
+	require.Empty(describeAll(co, []string{"cluihelp"}))
+	_, err := os.Stat(marker)
+	require.True(os.IsNotExist(err))
+
+	// --help runs in an empty directory without the environment of the
+	// completer
+	co.execHelp = true
+	descriptions := describeAll(co, []string{"cluihelp", "cluihang", "cluimissing"})
+	require.Len(descriptions, 1)
+	fields := strings.Fields(descriptions["cluihelp"])
+	require.Len(fields, 5)
+	require.Equal("--help", fields[1])
+	require.Equal("secret=", fields[3])
+	require.Equal(strings.TrimPrefix(fields[2], "home="), strings.TrimPrefix(fields[4], "pwd="))
+	_, err = os.Stat(strings.TrimPrefix(fields[4], "pwd="))
+	require.True(os.IsNotExist(err), "help directory is removed afterwards")
+
+	// commands that do not exit in time are killed along with their children
+	start := time.Now()
+	_, err = helpDescription(context.Background(), "cluihang")
+	require.Error(err)
+	require.Less(time.Since(start), time.Second)
+}
+
+func TestDescriptionCache(t *testing.T) {
+	require := require.New(t)
+
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	calls := filepath.Join(t.TempDir(), "calls")
+
+	// a whatis that knows cluia only and records its arguments
+	writeTestCommand(t, bin, "cluiwhatis", `echo "$@" >> `+calls+`
+for name in "$@"; do
+	[ "$name" = cluia ] && echo "cluia (1) - the a command"
+done
+exit 16
+`)
+	writeTestCommand(t, bin, "cluia", "")
+	writeTestCommand(t, bin, "cluib", "")
+	whatisPath := filepath.Join(bin, "cluiwhatis")
+	countCalls := func() int {
+		b, _ := os.ReadFile(calls)
+		return strings.Count(string(b), "\n")
+	}
+
+	dir := t.TempDir()
+	dc := sharedDescriptionCache(dir)
+	require.Same(dc, sharedDescriptionCache(dir))
+
+	co := &completer{whatisPath: whatisPath, descriptions: dc}
+	want := map[string]string{"cluia": "the a command"}
+	require.Equal(want, describeAll(co, []string{"cluia", "cluib"}))
+	require.Equal(1, countCalls())
+
+	// commands without description are cached as well
+	require.Equal(want, describeAll(co, []string{"cluia", "cluib"}))
+	require.Equal(1, countCalls())
+
+	// a changed binary is looked up again
+	later := time.Now().Add(time.Hour)
+	require.Nil(os.Chtimes(filepath.Join(bin, "cluib"), later, later))
+	require.Equal(want, describeAll(co, []string{"cluia", "cluib"}))
+	require.Equal(2, countCalls())
+
+	// the cache survives restarts
+	dc.saving.Wait()
+	loaded := &descriptionCache{path: filepath.Join(dir, descriptionCacheFile)}
+	require.Nil(loaded.load())
+	description, ok := loaded.get(filepath.Join(bin, "cluia"))
+	require.True(ok)
+	require.Equal("the a command", description)
+
+	// the cache is private to the user and no temporary files are left
+	fi, err := os.Stat(loaded.path)
+	require.Nil(err)
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+	files, err := os.ReadDir(dir)
+	require.Nil(err)
+	require.Len(files, 1)
+
+	// warming looks up everything in $PATH at once, leaving out what whatis
+	// does not know
+	warmed := sharedDescriptionCache(t.TempDir())
+	warmed.warm(context.Background(), whatisPath)
+	require.Equal(3, countCalls())
+	description, ok = warmed.get(filepath.Join(bin, "cluia"))
+	require.True(ok)
+	require.Equal("the a command", description)
+	_, ok = warmed.get(filepath.Join(bin, "cluib"))
+	require.False(ok)
+	warmed.warm(context.Background(), whatisPath)
+	require.Equal(3, countCalls())
+	warmed.saving.Wait()
+}
+
+func TestDescribeDeadline(t *testing.T) {
+	require := require.New(t)
+
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	names := []string{"cluifast"}
+	writeTestCommand(t, bin, "cluifast", "echo fast\n")
+	for _, name := range []string{"cluislow1", "cluislow2", "cluislow3", "cluislow4"} {
+		writeTestCommand(t, bin, name, "sleep 0.06; echo "+name+"\n")
+		names = append(names, name)
+	}
+
+	co := &completer{execHelp: true, describeSem: make(chan struct{}, len(names))}
+	start := time.Now()
+	descriptions, late := co.describeCommands(context.Background(), names, 25*time.Millisecond)
+	require.Less(time.Since(start), 50*time.Millisecond)
+	require.NotContains(descriptions, "cluislow1")
+
+	// the rest follows at once, the lookups run in parallel
+	all := map[string]string{}
+	for name, description := range descriptions {
+		all[name] = description
+	}
+	for rest := range late {
+		for name, description := range rest {
+			all[name] = description
+		}
+	}
+	require.Less(time.Since(start), 4*60*time.Millisecond)
+	require.Equal(map[string]string{
+		"cluifast":  "fast",
+		"cluislow1": "cluislow1",
+		"cluislow2": "cluislow2",
+		"cluislow3": "cluislow3",
+		"cluislow4": "cluislow4",
+	}, all)
+}
+
+func TestStreamCompletion(t *testing.T) {
+	require := require.New(t)
+
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	// stands in for zsh running capture.zsh
+	writeTestCommand(t, bin, "cluicapture", `printf 'cluia1\r\ncluia2 -- second\r\ncluia3\r\ncluia4\r\ncluia5\r\n'`)
+	// a whatis that takes longer than the deadline
+	writeTestCommand(t, bin, "cluiwhatis", `sleep 0.1
+echo "cluia1 (1) - the first"
+echo "cluia5 (1) - the fifth"
+`)
+	for _, name := range []string{"cluia1", "cluia2", "cluia3", "cluia4", "cluia5"} {
+		writeTestCommand(t, bin, name, "")
+	}
+
+	co := &completer{
+		zshPath:          filepath.Join(bin, "cluicapture"),
+		whatisPath:       filepath.Join(bin, "cluiwhatis"),
+		describeDeadline: 20 * time.Millisecond,
+		initialEntries:   2,
+		entriesChunk:     2,
 	}
+	csi := cmdline.Source{RequestID: 4, Dir: bin, Buffer: "cluia"}
+
+	var updates []*protoclui.CompletionInfo
+	require.Nil(co.streamCompletion(context.Background(), csi, func(ci *protoclui.CompletionInfo) {
+		updates = append(updates, ci)
+	}))
+
+	// the entries come first, in chunks, then the late descriptions
+	require.Len(updates, 4)
+	var sizes []int
+	for i, u := range updates {
+		require.Equal(uint64(4), u.RequestId)
+		require.Equal(uint32(i), u.Sequence)
+		require.Equal(i == len(updates)-1, u.Done)
+		sizes = append(sizes, len(u.Entries))
+	}
+	require.Equal([]int{2, 2, 1, 0}, sizes)
+	require.True(updates[0].IsFirst)
+	require.Equal("second", updates[0].Entries[1].Description)
+	require.Equal([]*protoclui.EntryDescription{
+		{EntryIndex: 0, Description: "the first"},
+		{EntryIndex: 4, Description: "the fifth"},
+	}, updates[3].LateDescriptions)
+
+	// the merged updates are what getCompletion returns at once
+	merged, err := co.getCompletion(context.Background(), csi)
+	require.Nil(err)
+	require.True(merged.Done)
+	require.Len(merged.Entries, 5)
+	require.Equal("the first", merged.Entries[0].Description)
+	require.Equal("second", merged.Entries[1].Description)
+	require.Equal("the fifth", merged.Entries[4].Description)
+
+	// without late descriptions the last chunk is marked done
+	co.whatisPath = ""
+	updates = nil
+	require.Nil(co.streamCompletion(context.Background(), csi, func(ci *protoclui.CompletionInfo) {
+		updates = append(updates, ci)
+	}))
+	require.Len(updates, 3)
+	require.True(updates[2].Done)
+}
+
+func TestStreamCompletionEarly(t *testing.T) {
+	require := require.New(t)
+
+	// prints the rest of the matches only once the first ones have been
+	// passed on
+	bin := t.TempDir()
+	writeTestCommand(t, bin, "cluicapture", `printf 'options\037option\037--force\r\n'
+printf 'heads-local\037local head\037main\r\n'
+while [ ! -e sent ]; do sleep 0.01; done
+printf 'heads-remote\037remote head\037origin/main\r\n'
+printf 'heads-local\037local head\037dev\r\n'`)
+	co := &completer{
+		zshPath:          filepath.Join(bin, "cluicapture"),
+		describeDeadline: 20 * time.Millisecond,
+		initialEntries:   2,
+		entriesChunk:     2,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var updates []*protoclui.CompletionInfo
+	require.Nil(co.streamCompletion(ctx, cmdline.Source{RequestID: 3, Dir: bin, Buffer: "git checkout "}, func(ci *protoclui.CompletionInfo) {
+		if len(updates) == 0 {
+			require.Nil(os.WriteFile(filepath.Join(bin, "sent"), nil, 0666))
+		}
+		updates = append(updates, ci)
+	}))
+	require.Len(updates, 2)
+	require.True(updates[1].Done)
+
+	// groups first used in a follow-up come with it
+	require.Equal([]*protoclui.CompletionGroup{
+		{Tag: "heads-local", Header: "local head"},
+		{Tag: "options", Header: "option"},
+	}, updates[0].Groups)
+	require.Equal([]*protoclui.CompletionGroup{
+		{Tag: "heads-remote", Header: "remote head"},
+	}, updates[1].Groups)
+
+	merged := updates[0]
+	for _, u := range updates[1:] {
+		require.True(clui.ApplyFollowUp(merged, u))
+	}
+	var entries [][2]interface{}
+	for _, e := range merged.Entries {
+		entries = append(entries, [2]interface{}{e.Suggestion, merged.Groups[e.Group].Tag})
+	}
+	require.Equal([][2]interface{}{
+		{"main", "heads-local"},
+		{"--force", "options"},
+		{"dev", "heads-local"},
+		{"origin/main", "heads-remote"},
+	}, entries)
+}
+
+func TestParseZshHistory(t *testing.T) {
+	require := require.New(t)
 
+	history := ": 1600000000:0;ls -la\n" +
+		"make\n" +
+		": 1600000100:3;for f in *; do\\\n  echo $f\\\ndone\n" +
+		": 1600000200:0;echo \xc3\x83\x82\n" +
+		"\n"
+	require.Equal([]historyEntry{
+		{time: 1600000000, command: "ls -la"},
+		{command: "make"},
+		{time: 1600000100, command: "for f in *; do\n  echo $f\ndone"},
+		{time: 1600000200, command: "echo â"},
+	}, parseZshHistory([]byte(history)))
+
+	require.Equal([]historyEntry{
+		{time: 1600000000, dir: "/src", command: "go test ./..."},
+		{time: 1600000001, dir: "/tmp", command: "echo a\nb"},
+	}, parseDirHistory([]byte("1600000000\x00/src\x00go test ./...\x00bad\x00/x\x00x\x001600000001\x00/tmp\x00echo a\nb\x00")))
+}
+
+func TestDirHistoryTrim(t *testing.T) {
+	require := require.New(t)
+
+	records := "1\x00/a\x00one\x002\x00/b\x00two\x003\x00/c\x00three\x00"
+	require.Equal([]byte(records), trimDirHistory([]byte(records), len(records)))
+	require.Equal([]byte("3\x00/c\x00three\x00"), trimDirHistory([]byte(records), 19))
+	require.Empty(trimDirHistory([]byte(records), 5))
+
+	path := filepath.Join(t.TempDir(), dirHistoryFile)
+	require.Nil(createPrivateFile(path))
+	require.Nil(os.WriteFile(path, []byte(records), 0666))
+	hf := &historyFile{path: path, parse: parseDirHistory, trim: trimDirHistory, maxSize: 24}
+
+	// a file grown beyond maxSize is cut down to half of it, newest first
+	entries, err := hf.read()
+	require.Nil(err)
+	require.Equal([]historyEntry{{time: 3, dir: "/c", command: "three"}}, entries)
+	fi, err := os.Stat(path)
+	require.Nil(err)
+	require.Equal(int64(len("3\x00/c\x00three\x00")), fi.Size())
+	require.Equal(os.FileMode(0600), fi.Mode().Perm())
+
+	// and the parse is reused until the file changes
+	entries[0].command = "cached"
+	entries, err = hf.read()
+	require.Nil(err)
+	require.Equal("cached", entries[0].command)
+}
+
+func TestSuggest(t *testing.T) {
+	require := require.New(t)
+
+	dir := t.TempDir()
+	require.Nil(os.WriteFile(filepath.Join(dir, "Makefile"), []byte(
+		"VERSION := 1\n"+
+			".PHONY: build\n"+
+			"build: deps ## build the binary\n"+
+			"\tgo build\n"+
+			"%.o: %.c\n"+
+			"deps:\n"), 0666))
+	require.Nil(os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/x\n"), 0666))
+
+	tmp := t.TempDir()
+	history := filepath.Join(tmp, "history")
+	require.Nil(os.WriteFile(history, []byte(
+		": 1:0;git status\n"+
+			": 2:0;git status\n"+
+			": 3:0;vim main.go\n"), 0666))
+	dirHistory := filepath.Join(tmp, "dir_history")
+	require.Nil(os.WriteFile(dirHistory, []byte(
+		"1\x00"+dir+"\x00make build\x00"+
+			"2\x00/elsewhere\x00rm -rf build\x00"), 0666))
+
+	co := &completer{
+		zshPath:    "/nonexistent/zsh",
+		history:    &historyFile{path: history, parse: parseZshHistory},
+		dirHistory: &historyFile{path: dirHistory, parse: parseDirHistory},
+	}
+
+	// an empty line is answered without running compsys at all
+	ci, err := co.getCompletion(context.Background(), cmdline.Source{Dir: dir, Buffer: "  "})
+	require.Nil(err)
+	require.True(ci.IsEmpty)
+	require.True(ci.Done)
+
+	var suggestions [][2]string
+	for _, e := range ci.Entries {
+		require.Equal(e.Suggestion, e.ActualInput)
+		require.True(e.ShouldInput)
+		suggestions = append(suggestions, [2]string{e.Suggestion, e.Description})
+	}
+	require.Equal([][2]string{
+		{"make build", "run once in this directory"},
+		{"make deps", "Makefile target"},
+		{"go test ./...", "run the tests of this Go module"},
+		{"go build ./...", "build this Go module"},
+		{"go vet ./...", "vet this Go module"},
+		{"vim main.go", "run recently"},
+		{"git status", "run recently"},
+	}, suggestions)
+
+	// the history is read again once it changes
+	f, err := os.OpenFile(history, os.O_APPEND|os.O_WRONLY, 0666)
+	require.Nil(err)
+	_, err = f.WriteString(": 4:0;htop -d 5\n")
+	require.Nil(err)
+	require.Nil(f.Close())
+	entries, err := co.history.read()
+	require.Nil(err)
+	require.Len(entries, 4)
+}
+
+func TestRanking(t *testing.T) {
+	require := require.New(t)
+
+	bin := t.TempDir()
+	writeTestCommand(t, bin, "cluicapture", `printf -- '--all\r\nbranch\r\ncheckout\r\ncherry-pick\r\nclean\r\n'`)
+
+	tmp := t.TempDir()
+	history := filepath.Join(tmp, "history")
+	now := int64(1000000000)
+	require.Nil(os.WriteFile(history, []byte(fmt.Sprintf(
+		": %d:0;git clean -fd\n"+
+			": %d:0;git checkout main\n", now-60, now-30)), 0666))
+
+	path := filepath.Join(tmp, "ranking", "ranking.json")
+	r := newRanker(path, &historyFile{path: history, parse: parseZshHistory})
+	r.now = func() int64 { return now }
+	co := &completer{zshPath: filepath.Join(bin, "cluicapture"), ranker: r}
+
+	suggestions := func(buffer string) (res []string) {
+		ci, err := co.getCompletion(context.Background(), cmdline.Source{Dir: bin, Buffer: buffer})
+		require.Nil(err)
+		for _, e := range ci.Entries {
+			res = append(res, e.Suggestion)
+		}
+		return
+	}
+
+	// entries run in the history come first, options are only expected once
+	// a - has been typed
+	require.Equal([]string{"checkout", "clean", "branch", "cherry-pick", "--all"}, suggestions("git "))
+	require.Equal("--all", suggestions("git -")[0])
+	// the history of another command does not count
+	require.Equal([]string{"branch", "checkout", "cherry-pick", "clean", "--all"}, suggestions("hg "))
+
+	// accepted entries outweigh those only run, and are persisted
+	csi := cmdline.Source{Buffer: "git ch"}
+	require.Equal("git", csi.Command())
+	r.recordAccept(csi, "cherry-pick")
+	r.saving.Wait()
+	require.Equal([]string{"cherry-pick", "checkout", "clean", "branch", "--all"}, suggestions("git "))
+
+	loaded := newRanker(path, nil)
+	require.Nil(loaded.load())
+	require.Contains(loaded.accepted, rankKey("git", "cherry-pick"))
+
+	// a directory is the same candidate with or without its trailing slash
+	cd := cmdline.Source{Buffer: "cd "}
+	r.recordAccept(cd, "src")
+	r.saving.Wait()
+	require.Equal([]int{1, 0}, r.rank(cd, []string{"lib/", "src/"}, []float64{0, 0}))
+
+	// uses count less the older they are
+	f := frecency{}
+	f.add(now, 1)
+	require.InDelta(0.5, f.at(now+int64(frecencyHalfLife/time.Second)), 1e-9)
+	f.add(now-int64(frecencyHalfLife/time.Second), 1)
+	require.InDelta(1.5, f.at(now), 1e-9)
+}
+
+func TestFuzzyMatch(t *testing.T) {
+	require := require.New(t)
+
+	_, positions, ok := fuzzyMatch("chk", "checkout")
+	require.True(ok)
+	require.Equal([]int{0, 1, 4}, positions)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}, {Start: 4, End: 5}}, matchRanges(positions))
+
+	// the shortest occurrence is matched, not the first one
+	_, positions, ok = fuzzyMatch("ab", "a-xab")
+	require.True(ok)
+	require.Equal([]int{3, 4}, positions)
+
+	// case is only significant if the pattern has upper case characters
+	_, _, ok = fuzzyMatch("mk", "Makefile")
+	require.True(ok)
+	_, _, ok = fuzzyMatch("mK", "Makefile")
+	require.False(ok)
+
+	// matches at word boundaries and in a row score higher
+	boundary, _, _ := fuzzyMatch("gc", "git-checkout")
+	inside, _, _ := fuzzyMatch("gc", "gitxcheckout")
+	require.Greater(boundary, inside)
+	consecutive, _, _ := fuzzyMatch("che", "checkout")
+	gaps, _, _ := fuzzyMatch("che", "cxhxe")
+	require.Greater(consecutive, gaps)
+	require.LessOrEqual(consecutive, maxFuzzyScore(3))
+
+	// a pair of swapped characters is tolerated, at a cost
+	_, _, ok = fuzzyMatch("gtichk", "git checkout main")
+	require.False(ok)
+	typo, positions, ok := fuzzyMatchTypo("gtichk", "git checkout main")
+	require.True(ok)
+	require.Equal([]int{0, 1, 2, 4, 5, 8}, positions)
+	exact, _, _ := fuzzyMatchTypo("gitchk", "git checkout main")
+	require.Equal(exact+fuzzyScoreTypo, typo)
+}
+
+func TestCompletionFuzzy(t *testing.T) {
+	require := require.New(t)
+
+	bin := t.TempDir()
+	args := filepath.Join(bin, "args")
+	// prints the candidates compsys would offer for an empty word, and
+	// records the buffer it was asked to complete
+	writeTestCommand(t, bin, "cluicapture", `printf '%s|%s\n' "$2" "$3" > `+args+`
+case "$2" in
+"") printf 'git\r\ngitk\r\ngrep\r\n' ;;
+"git ") printf 'branch\r\ncheckout\r\ncherry-pick\r\n' ;;
+"cat src/") printf 'src/main.go\r\nsrc/Makefile\r\n' ;;
+esac`)
+	capturedArgs := func() string {
+		b, err := os.ReadFile(args)
+		require.Nil(err)
+		return strings.TrimSpace(string(b))
+	}
+
+	history := filepath.Join(bin, "history")
+	require.Nil(os.WriteFile(history, []byte(": 1:0;git checkout main\n"), 0666))
+
+	co := &completer{
+		zshPath: filepath.Join(bin, "cluicapture"),
+		fuzzy:   true,
+		history: &historyFile{path: history, parse: parseZshHistory},
+	}
+	complete := func(lbuffer string, rbuffer string) []*protoclui.CompletionEntry {
+		ci, err := co.getCompletion(context.Background(), cmdline.Source{Dir: bin, LBuffer: lbuffer, RBuffer: rbuffer, Buffer: lbuffer + rbuffer})
+		require.Nil(err)
+		return ci.Entries
+	}
+
+	// a mistyped command still finds a command from the history
+	entries := complete("gtichk", "")
+	require.Equal("|", capturedArgs())
+	require.Len(entries, 1)
+	require.Equal("git checkout main", entries[0].Suggestion)
+	require.Equal("run once", entries[0].Description)
+	require.False(entries[0].ShouldInput)
+
+	// arguments are matched against every candidate for their position, the
+	// word after the cursor is part of what is matched
+	entries = complete("git c", "hk --force")
+	require.Equal("git | --force", capturedArgs())
+	require.Len(entries, 2)
+	require.Equal("checkout", entries[0].Suggestion)
+	require.Equal("cherry-pick", entries[1].Suggestion)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}, {Start: 4, End: 5}}, entries[0].MatchRanges)
+	require.Equal(cmdline.Edit{Left: "c", Right: "hk", Text: "checkout"}, (&cmdline.Source{LBuffer: "git c", RBuffer: "hk --force"}).ReplaceShellWord(entries[0].Suggestion, cmdline.QuotePOSIX))
+
+	// the word is kept up to its last separator
+	entries = complete("cat src/mgo", "")
+	require.Equal("cat src/|", capturedArgs())
+	require.Len(entries, 1)
+	require.Equal("src/main.go", entries[0].Suggestion)
+
+	// words compsys would expand are left to it
+	complete("cat ~/src", "")
+	require.Equal("cat ~/src|", capturedArgs())
+}
+
+func TestPrefixMatchRanges(t *testing.T) {
+	require := require.New(t)
+
+	ranges := func(left string, right string, candidate string) []*protoclui.MatchRange {
+		return matchRanges(prefixMatchPositions(left, right, candidate))
+	}
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, ranges("ch", "", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, ranges("CH", "", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 1}, {Start: 6, End: 8}}, ranges("c", "ut", "checkout"))
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, ranges("日本", "", "日本語"))
+	// the parts must not overlap
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 3}}, ranges("che", "eck", "check"))
+	require.Empty(ranges("xy", "", "checkout"))
+
+	bin := t.TempDir()
+	writeTestCommand(t, bin, "cluicapture", `printf 'checkout\r\ncherry-pick\r\n'`)
+	co := &completer{zshPath: filepath.Join(bin, "cluicapture")}
+	ci, err := co.getCompletion(context.Background(), cmdline.Source{Dir: bin, LBuffer: "git ch", RBuffer: "eckout", Buffer: "git checkout"})
+	require.Nil(err)
+	require.Len(ci.Entries, 2)
+	require.Equal("checkout", ci.Entries[0].Suggestion)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 8}}, ci.Entries[0].MatchRanges)
+	require.Equal([]*protoclui.MatchRange{{Start: 0, End: 2}}, ci.Entries[1].MatchRanges)
+}
+
+func TestCompletionGroups(t *testing.T) {
+	require := require.New(t)
+
+	tag, header, rest := parseCaptureGroup("heads-local\x1flocal head\x1fmain -- the main branch")
+	require.Equal([3]string{"heads-local", "local head", "main -- the main branch"}, [3]string{tag, header, rest})
+	tag, header, rest = parseCaptureGroup("options\x1f\x1f--force")
+	require.Equal([3]string{"options", "options", "--force"}, [3]string{tag, header, rest})
+	tag, header, rest = parseCaptureGroup("\x1f\x1fmain.go")
+	require.Equal([3]string{"", "", "main.go"}, [3]string{tag, header, rest})
+	tag, header, rest = parseCaptureGroup("main.go")
+	require.Equal([3]string{"", "", "main.go"}, [3]string{tag, header, rest})
+
+	bin := t.TempDir()
+	writeTestCommand(t, bin, "cluicapture", `printf 'options\037option\037--force\r\n'
+printf 'heads-local\037local head\037main\r\n'
+printf 'heads-remote\037remote head\037origin/main\r\n'
+printf 'heads-local\037local head\037dev\r\n'
+printf '\037\037plain\r\n'`)
+	co := &completer{zshPath: filepath.Join(bin, "cluicapture"), initialEntries: 2, entriesChunk: 2}
+
+	var updates []*protoclui.CompletionInfo
+	require.Nil(co.streamCompletion(context.Background(), cmdline.Source{Dir: bin, Buffer: "git checkout "}, func(ci *protoclui.CompletionInfo) {
+		updates = append(updates, ci)
+	}))
+	require.Len(updates, 3)
+
+	// every group is known by the first update, in the order of the entries
+	require.Equal([]*protoclui.CompletionGroup{
+		{Tag: "heads-local", Header: "local head"},
+		{Tag: "heads-remote", Header: "remote head"},
+		{Tag: "options", Header: "option"},
+	}, updates[0].Groups)
+	require.Empty(updates[1].Groups)
+
+	var entries [][3]interface{}
+	for _, u := range updates {
+		for _, e := range u.Entries {
+			entries = append(entries, [3]interface{}{e.Suggestion, e.Level, e.Group})
+		}
+	}
+	require.Equal([][3]interface{}{
+		{"dev", int32(1), uint32(0)},
+		{"main", int32(1), uint32(0)},
+		{"origin/main", int32(1), uint32(1)},
+		{"plain", int32(0), uint32(0)},
+		{"--force", int32(1), uint32(2)},
+	}, entries)
 }
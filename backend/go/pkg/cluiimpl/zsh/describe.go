@@ -0,0 +1,352 @@
+package zsh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// whatisTimeout bounds a single whatis lookup, helpTimeout a single run of
+// <cmd> --help
+const (
+	whatisTimeout = 200 * time.Millisecond
+	helpTimeout   = 100 * time.Millisecond
+)
+
+// Do not run --help of these commands, those are known to ignore it and do
+// real work instead
+var blacklistedCommands = []string{
+	"vimtutor",
+}
+
+// namedDescription is a description looked up for the command name
+type namedDescription struct {
+	name        string
+	description string
+}
+
+// describeCommands returns one-line descriptions for the commands in names.
+// They are taken from the description cache if possible, otherwise looked up
+// in the man page index by whatis, which never runs the commands themselves.
+// Only if execHelp is enabled, the first line of <cmd> --help is used for
+// commands whatis does not know.
+//
+// Only the descriptions known within deadline are returned, a zero deadline
+// waits for all of them. The others are sent on late once all lookups are
+// done, late is closed when no more descriptions will come.
+func (co *completer) describeCommands(ctx context.Context, names []string, deadline time.Duration) (descriptions map[string]string, late <-chan map[string]string) {
+
+	descriptions = map[string]string{}
+	lateChan := make(chan map[string]string, 1)
+	late = lateChan
+
+	// paths maps the names that resolve to a binary to it, only those can be
+	// cached since builtins and functions have no modification time
+	paths := map[string]string{}
+	var missing []string
+	for _, name := range names {
+		if co.descriptions != nil {
+			if path, err := exec.LookPath(name); err == nil {
+				if path, err = filepath.Abs(path); err == nil {
+					paths[name] = path
+					if description, ok := co.descriptions.get(path); ok {
+						if description != "" {
+							descriptions[name] = description
+						}
+						continue
+					}
+				}
+			}
+		}
+		missing = append(missing, name)
+	}
+	if len(missing) == 0 {
+		close(lateChan)
+		return
+	}
+
+	results := make(chan namedDescription)
+	completeChan := make(chan bool, 1)
+	go func() {
+		complete := co.lookUpDescriptions(ctx, missing, results)
+		close(results)
+		completeChan <- complete
+	}()
+
+	var timeout <-chan time.Time
+	if deadline > 0 {
+		timer := time.NewTimer(deadline)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	looked := map[string]string{}
+COLLECT_LOOP:
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				co.cacheDescriptions(paths, missing, looked, <-completeChan)
+				for name, description := range looked {
+					descriptions[name] = description
+				}
+				close(lateChan)
+				return
+			}
+			looked[r.name] = r.description
+		case <-timeout:
+			break COLLECT_LOOP
+		}
+	}
+
+	for name, description := range looked {
+		descriptions[name] = description
+	}
+	go func() {
+		defer close(lateChan)
+		rest := map[string]string{}
+		for r := range results {
+			looked[r.name] = r.description
+			rest[r.name] = r.description
+		}
+		co.cacheDescriptions(paths, missing, looked, <-completeChan)
+		if len(rest) > 0 && ctx.Err() == nil {
+			lateChan <- rest
+		}
+	}()
+	return
+}
+
+// cacheDescriptions caches the descriptions looked up for missing, paths maps
+// the names to the binaries they resolve to, complete tells whether all of
+// the lookups succeeded
+func (co *completer) cacheDescriptions(paths map[string]string, missing []string, looked map[string]string, complete bool) {
+	if co.descriptions == nil {
+		return
+	}
+	changed := false
+	for _, name := range missing {
+		description := looked[name]
+		// that a command has no description is only known for sure if none
+		// of the lookups failed
+		path, ok := paths[name]
+		if ok && (description != "" || complete) && co.descriptions.put(path, description) {
+			changed = true
+		}
+	}
+	if changed {
+		co.descriptions.saveAsync()
+	}
+}
+
+// acquireDescriber blocks until one of the describeWorkers is free, it returns
+// false if ctx is done first
+func (co *completer) acquireDescriber(ctx context.Context) bool {
+	if co.describeSem == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case co.describeSem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (co *completer) releaseDescriber() {
+	if co.describeSem != nil {
+		<-co.describeSem
+	}
+}
+
+// lookUpDescriptions looks up descriptions for names bypassing the cache and
+// sends those found on results, whatis runs first and --help for the rest in
+// parallel. It returns false if any of the lookups failed.
+func (co *completer) lookUpDescriptions(ctx context.Context, names []string, results chan<- namedDescription) bool {
+
+	var completeMut sync.Mutex
+	complete := true
+	fail := func() {
+		completeMut.Lock()
+		complete = false
+		completeMut.Unlock()
+	}
+
+	found := map[string]bool{}
+	if co.whatisPath != "" {
+		if !co.acquireDescriber(ctx) {
+			return false
+		}
+		wctx, cancel := context.WithTimeout(ctx, whatisTimeout)
+		looked, err := whatis(wctx, co.whatisPath, names)
+		cancel()
+		co.releaseDescriber()
+		if err != nil {
+			logrus.Debug("cannot look up descriptions with whatis: ", err)
+			fail()
+		}
+		for name, description := range looked {
+			found[name] = true
+			results <- namedDescription{name, description}
+		}
+	}
+
+	if !co.execHelp {
+		return complete
+	}
+
+	var wg sync.WaitGroup
+NAME_LOOP:
+	for _, name := range names {
+		if found[name] {
+			continue
+		}
+		for _, bcmd := range blacklistedCommands {
+			if bcmd == name {
+				logrus.Debug("not running --help of blacklisted command: ", name)
+				continue NAME_LOOP
+			}
+		}
+		if !co.acquireDescriber(ctx) {
+			fail()
+			break
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer co.releaseDescriber()
+			description, err := helpDescription(ctx, name)
+			if err != nil {
+				// a command that is not found has no description for sure
+				if _, ok := errors.Cause(err).(*exec.Error); !ok {
+					fail()
+				}
+				logrus.Debug("cannot get --help description: ", err)
+				return
+			}
+			if description != "" {
+				results <- namedDescription{name, description}
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	return complete
+}
+
+// whatis looks up the descriptions of all names with a single whatis run
+func whatis(ctx context.Context, whatisPath string, names []string) (map[string]string, error) {
+
+	// whatis would take a name starting with - as an option
+	args := []string{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, "-") {
+			args = append(args, name)
+		}
+	}
+	if len(args) == 0 {
+		return map[string]string{}, nil
+	}
+
+	// whatis exits with non-zero if any of the names is unknown, the others
+	// are still printed
+	out, err := exec.CommandContext(ctx, whatisPath, args...).Output()
+	if _, ok := err.(*exec.ExitError); err != nil && (!ok || ctx.Err() != nil) {
+		return map[string]string{}, errors.Wrap(err, "cannot run whatis")
+	}
+	return parseWhatis(out), nil
+}
+
+// parseWhatis parses whatis output, lines like
+// `ls (1)               - list directory contents`, if a name has pages in
+// several sections the first one wins
+func parseWhatis(out []byte) map[string]string {
+	descriptions := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, " - ")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:i])
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		if _, ok := descriptions[name]; ok {
+			continue
+		}
+		descriptions[name] = strings.TrimSpace(line[i+len(" - "):])
+	}
+	return descriptions
+}
+
+// helpDescription returns the first line of <name> --help. The command runs
+// in an empty temporary directory with a minimal environment, no stdin and its
+// own process group, which is killed as a whole once helpTimeout is over.
+func helpDescription(ctx context.Context, name string) (string, error) {
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot find command")
+	}
+
+	dir, err := os.MkdirTemp("", "clui-help-")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create help directory")
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(ctx, helpTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.Command(path, "--help")
+	cmd.Dir = dir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + dir,
+		"TMPDIR=" + dir,
+		"LANG=C",
+		"TERM=dumb",
+	}
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return "", errors.Wrap(err, "cannot start --help")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			// kill anything the command may have spawned too
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+				logrus.Debug("cannot kill --help process group: ", err)
+			}
+		case <-done:
+		}
+	}()
+	// the exit status does not matter, plenty of commands exit with non-zero
+	// after printing their help
+	_ = cmd.Wait()
+	close(done)
+
+	if ctx.Err() != nil {
+		return "", errors.Wrap(ctx.Err(), "--help did not finish in time")
+	}
+	return strings.TrimSpace(strings.SplitN(out.String(), "\n", 2)[0]), nil
+}
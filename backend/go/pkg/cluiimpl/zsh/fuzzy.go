@@ -0,0 +1,257 @@
+package zsh
+
+import (
+	"strings"
+	"unicode"
+
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+)
+
+// the scores of fuzzyMatch, after fzf. Every matched character scores
+// fuzzyScoreMatch plus a bonus depending on where it is, gaps between matched
+// characters cost.
+const (
+	fuzzyScoreMatch        = 16
+	fuzzyScoreGapStart     = -3
+	fuzzyScoreGapExtension = -1
+	// a match at the start of a word, after a delimiter like / or - or after
+	// a space is what someone typing abbreviations means
+	fuzzyBonusBoundary          = fuzzyScoreMatch / 2
+	fuzzyBonusBoundaryDelimiter = fuzzyBonusBoundary + 1
+	fuzzyBonusBoundaryWhite     = fuzzyBonusBoundary + 2
+	fuzzyBonusCamel             = fuzzyBonusBoundary + fuzzyScoreGapExtension
+	fuzzyBonusConsecutive       = -(fuzzyScoreGapStart + fuzzyScoreGapExtension)
+	fuzzyBonusFirstCharFactor   = 2
+	// fuzzyScoreTypo is the cost of a pair of swapped characters
+	fuzzyScoreTypo = -fuzzyScoreMatch
+)
+
+// fuzzyUnsafe are the characters that make a word more than a literal, those
+// words are left to compsys to expand and match
+const fuzzyUnsafe = "$~*?[]{}\\'\"`"
+
+// fuzzySeparators are the characters up to which the word under the cursor is
+// kept when asking compsys for candidates, they start a new part of the word
+// that compsys completes on its own like the file in a directory or the value
+// of an option
+const fuzzySeparators = "/=:"
+
+type charClass int
+
+const (
+	charWhite charClass = iota
+	charDelimiter
+	charNonWord
+	charLower
+	charUpper
+	charNumber
+	charLetter
+)
+
+func classOf(r rune) charClass {
+	switch {
+	case unicode.IsSpace(r):
+		return charWhite
+	case strings.ContainsRune("/,:;|-_.=", r):
+		return charDelimiter
+	case unicode.IsLower(r):
+		return charLower
+	case unicode.IsUpper(r):
+		return charUpper
+	case unicode.IsDigit(r):
+		return charNumber
+	case unicode.IsLetter(r):
+		return charLetter
+	}
+	return charNonWord
+}
+
+// bonusAt returns the bonus for matching a character of class after one of
+// class prev
+func bonusAt(prev charClass, class charClass) int {
+	if class > charNonWord {
+		switch prev {
+		case charWhite:
+			return fuzzyBonusBoundaryWhite
+		case charDelimiter:
+			return fuzzyBonusBoundaryDelimiter
+		case charNonWord:
+			return fuzzyBonusBoundary
+		}
+	}
+	switch {
+	case prev == charLower && class == charUpper,
+		prev != charNumber && class == charNumber:
+		return fuzzyBonusCamel
+	case class == charWhite:
+		return fuzzyBonusBoundaryWhite
+	case class == charDelimiter, class == charNonWord:
+		return fuzzyBonusBoundary
+	}
+	return 0
+}
+
+// fuzzyMatch matches the characters of pattern in order anywhere in text, it
+// returns the score of the match and the positions of the matched characters
+// in code points. The match ignores case unless pattern has upper case
+// characters.
+func fuzzyMatch(pattern string, text string) (score int, positions []int, ok bool) {
+	p := []rune(pattern)
+	t := []rune(text)
+	if len(p) == 0 {
+		return 0, nil, true
+	}
+
+	fold := func(r rune) rune { return r }
+	if strings.ToLower(pattern) == pattern {
+		fold = unicode.ToLower
+	}
+
+	// the first occurrence of the pattern ends the match, going back from
+	// there finds the shortest one ending there
+	start, end := -1, -1
+	pi := 0
+	for i, r := range t {
+		if fold(r) == p[pi] {
+			if start < 0 {
+				start = i
+			}
+			pi++
+			if pi == len(p) {
+				end = i + 1
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+	pi = len(p) - 1
+	for i := end - 1; i >= start; i-- {
+		if fold(t[i]) == p[pi] {
+			pi--
+			if pi < 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	prev := charWhite
+	if start > 0 {
+		prev = classOf(t[start-1])
+	}
+	inGap := false
+	consecutive := 0
+	firstBonus := 0
+	pi = 0
+	for i := start; i < end && pi < len(p); i++ {
+		class := classOf(t[i])
+		if fold(t[i]) == p[pi] {
+			positions = append(positions, i)
+			score += fuzzyScoreMatch
+			bonus := bonusAt(prev, class)
+			if consecutive == 0 {
+				firstBonus = bonus
+			} else {
+				// a run of consecutive matches keeps the bonus of its start
+				if bonus >= fuzzyBonusBoundary && bonus > firstBonus {
+					firstBonus = bonus
+				}
+				bonus = maxInt(bonus, firstBonus, fuzzyBonusConsecutive)
+			}
+			if pi == 0 {
+				bonus *= fuzzyBonusFirstCharFactor
+			}
+			score += bonus
+			inGap = false
+			consecutive++
+			pi++
+		} else {
+			if inGap {
+				score += fuzzyScoreGapExtension
+			} else {
+				score += fuzzyScoreGapStart
+			}
+			inGap = true
+			consecutive = 0
+			firstBonus = 0
+		}
+		prev = class
+	}
+	return score, positions, true
+}
+
+// fuzzyMatchTypo is fuzzyMatch that also tolerates a pair of swapped
+// characters in pattern at the cost of fuzzyScoreTypo
+func fuzzyMatchTypo(pattern string, text string) (score int, positions []int, ok bool) {
+	if score, positions, ok = fuzzyMatch(pattern, text); ok {
+		return
+	}
+	p := []rune(pattern)
+	for i := 0; i+1 < len(p); i++ {
+		if p[i] == p[i+1] {
+			continue
+		}
+		p[i], p[i+1] = p[i+1], p[i]
+		s, pos, matched := fuzzyMatch(string(p), text)
+		p[i], p[i+1] = p[i+1], p[i]
+		if matched && (!ok || s+fuzzyScoreTypo > score) {
+			score, positions, ok = s+fuzzyScoreTypo, pos, true
+		}
+	}
+	return
+}
+
+// maxFuzzyScore is the score of the best possible match of a pattern with n
+// characters
+func maxFuzzyScore(n int) int {
+	return n*(fuzzyScoreMatch+fuzzyBonusBoundaryWhite) + fuzzyBonusBoundaryWhite*(fuzzyBonusFirstCharFactor-1)
+}
+
+func maxInt(first int, rest ...int) int {
+	for _, i := range rest {
+		if i > first {
+			first = i
+		}
+	}
+	return first
+}
+
+// isFuzzyWord returns whether word can be fuzzy matched, it must be plain
+// text that compsys would not expand
+func isFuzzyWord(word string) bool {
+	return word != "" && !strings.ContainsAny(word, fuzzyUnsafe)
+}
+
+// prefixMatchPositions returns the positions of the characters of candidate
+// that match the parts of the word before and after the cursor, left as a
+// prefix ignoring case and right as a suffix
+func prefixMatchPositions(left string, right string, candidate string) (positions []int) {
+	if len(left) <= len(candidate) && strings.EqualFold(candidate[:len(left)], left) {
+		for i := range []rune(candidate[:len(left)]) {
+			positions = append(positions, i)
+		}
+	} else {
+		left = ""
+	}
+	if right != "" && len(left)+len(right) <= len(candidate) && strings.HasSuffix(candidate, right) {
+		start := len([]rune(candidate[:len(candidate)-len(right)]))
+		for i := range []rune(right) {
+			positions = append(positions, start+i)
+		}
+	}
+	return
+}
+
+// matchRanges merges the positions of matched characters into ranges
+func matchRanges(positions []int) (ranges []*protoclui.MatchRange) {
+	for _, pos := range positions {
+		if n := len(ranges); n > 0 && ranges[n-1].End == uint32(pos) {
+			ranges[n-1].End++
+			continue
+		}
+		ranges = append(ranges, &protoclui.MatchRange{Start: uint32(pos), End: uint32(pos) + 1})
+	}
+	return
+}
@@ -0,0 +1,337 @@
+package zsh
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/pty"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// captureRequestKey is the key sequence bound to the clui-capture widget in
+// capture-init.zsh, killLineKey clears whatever a previous request left behind
+const (
+	captureRequestKey = "\x18\x03" // ^X^C
+	killLineKey       = "\x15"     // ^U
+)
+
+// captureWorker is a long-lived `zsh -f -i` running in a pty with
+// capture-init.zsh sourced, so compinit only has to run once per worker
+// instead of once per keystroke. A worker serves one request at a time.
+type captureWorker struct {
+	cmd  *exec.Cmd
+	ptmx *os.File
+	// lines receives the pty output line by line, with the trailing \r\n
+	// stripped, it is closed when the pty can no longer be read
+	lines chan string
+	// done is closed when the zsh process exited
+	done chan struct{}
+	// pendingMarkers is the number of null lines of the current request that
+	// have not been read yet, a worker is only reusable when it is 0
+	pendingMarkers int
+}
+
+// startCaptureWorker starts a new worker and waits until capture-init.zsh has
+// been sourced
+func startCaptureWorker(zshPath string, initScriptPath string, initTimeout time.Duration) (*captureWorker, error) {
+
+	var err error
+	w := &captureWorker{
+		cmd: &exec.Cmd{
+			Path: zshPath,
+			Args: []string{zshPath, "-f", "-i"},
+		},
+		lines: make(chan string),
+		done:  make(chan struct{}),
+	}
+
+	if w.ptmx, err = pty.Start(w.cmd); err != nil {
+		return nil, errors.Wrap(err, "cannot start capture worker")
+	}
+
+	go func() {
+		if err := w.cmd.Wait(); err != nil {
+			logrus.Debug("capture worker exited: ", err)
+		}
+		close(w.done)
+	}()
+
+	go w.readLines()
+
+	initCmd := fmt.Sprintf("source '%s' && echo ok\r", strings.ReplaceAll(initScriptPath, "'", `'\''`))
+	if _, err = io.WriteString(w.ptmx, initCmd); err != nil {
+		w.kill()
+		return nil, errors.Wrap(err, "cannot write init command to capture worker")
+	}
+
+	timeout := time.After(initTimeout)
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				w.kill()
+				return nil, errors.New("capture worker exited during init")
+			}
+			if strings.HasPrefix(line, "ok") {
+				return w, nil
+			}
+		case <-timeout:
+			w.kill()
+			return nil, errors.New("capture worker init timed out")
+		}
+	}
+}
+
+func (w *captureWorker) readLines() {
+	defer close(w.lines)
+	r := bufio.NewReader(w.ptmx)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		select {
+		case w.lines <- strings.TrimSuffix(line, "\r\n"):
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// alive reports whether the zsh process of the worker is still running
+func (w *captureWorker) alive() bool {
+	select {
+	case <-w.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// kill terminates the worker, it is safe to be called on a dead worker
+func (w *captureWorker) kill() {
+	if w.alive() {
+		if err := w.cmd.Process.Kill(); err != nil {
+			logrus.Debug("cannot kill capture worker: ", err)
+		}
+	}
+	if err := w.ptmx.Close(); err != nil {
+		logrus.Debug("cannot close capture worker pty: ", err)
+	}
+}
+
+// captureLines passes the raw completion lines for the buffer lbuffer+rbuffer
+// completed at the cursor between them in dir to onLine as soon as zsh prints
+// them, in the same format capture.zsh prints them. The worker must be killed
+// if an error other than ctx.Err() is returned since it is left in an unknown
+// state, after a cancellation it must be drained before it is reused.
+func (w *captureWorker) captureLines(ctx context.Context, dir string, lbuffer string, rbuffer string, timeout time.Duration, onLine func(line string)) (err error) {
+
+	req := killLineKey +
+		hex.EncodeToString([]byte(dir)) + ":" +
+		hex.EncodeToString([]byte(lbuffer)) + ":" +
+		hex.EncodeToString([]byte(rbuffer)) +
+		captureRequestKey
+	if _, err = io.WriteString(w.ptmx, req); err != nil {
+		return errors.Wrap(err, "cannot write request to capture worker")
+	}
+	w.pendingMarkers = 2
+
+	// matches are printed between two null lines, anything else is zle noise
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				return errors.New("capture worker exited during request")
+			}
+			if strings.HasSuffix(line, "\x00") {
+				w.pendingMarkers--
+				if w.pendingMarkers == 0 {
+					return nil
+				}
+				continue
+			}
+			if w.pendingMarkers == 1 {
+				onLine(line)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return errors.New("capture worker timed out")
+		}
+	}
+}
+
+// drain discards the rest of a cancelled request, it returns an error if the
+// request did not finish within timeout
+func (w *captureWorker) drain(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for w.pendingMarkers > 0 {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				return errors.New("capture worker exited during drain")
+			}
+			if strings.HasSuffix(line, "\x00") {
+				w.pendingMarkers--
+			}
+		case <-deadline:
+			return errors.New("capture worker timed out during drain")
+		}
+	}
+	return nil
+}
+
+// workerPool keeps a fixed number of pre-initialised capture workers, workers
+// that died or hung are replaced in the background
+type workerPool struct {
+	zshPath        string
+	initScriptPath string
+	size           int
+	// initTimeout bounds the time a new worker may take to run compinit
+	initTimeout time.Duration
+	// requestTimeout bounds the time a single completion may take before the
+	// worker is considered hung and restarted
+	requestTimeout time.Duration
+
+	idle      chan *captureWorker
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newWorkerPool(zshPath string, initScriptPath string, size int) *workerPool {
+	return &workerPool{
+		zshPath:        zshPath,
+		initScriptPath: initScriptPath,
+		size:           size,
+		initTimeout:    10 * time.Second,
+		requestTimeout: 2 * time.Second,
+		idle:           make(chan *captureWorker, size),
+		closed:         make(chan struct{}),
+	}
+}
+
+// start fills the pool in the background, it returns immediately
+func (wp *workerPool) start() {
+	for i := 0; i < wp.size; i++ {
+		go wp.spawn()
+	}
+}
+
+// spawn starts a worker and puts it into the pool, retrying with backoff if
+// the worker cannot be started
+func (wp *workerPool) spawn() {
+	backoff := 100 * time.Millisecond
+	for {
+		w, err := startCaptureWorker(wp.zshPath, wp.initScriptPath, wp.initTimeout)
+		if err == nil {
+			wp.release(w)
+			return
+		}
+		logrus.Errorf("cannot start capture worker: %+v", err)
+		select {
+		case <-wp.closed:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// release puts w back into the pool, or kills it if the pool is closed
+func (wp *workerPool) release(w *captureWorker) {
+	select {
+	case <-wp.closed:
+		w.kill()
+	default:
+		wp.idle <- w
+	}
+}
+
+// capture runs one completion request on an idle worker and returns all of
+// its lines at once
+func (wp *workerPool) capture(ctx context.Context, dir string, lbuffer string, rbuffer string) (cts []string, err error) {
+	err = wp.captureLines(ctx, dir, lbuffer, rbuffer, func(line string) {
+		cts = append(cts, line)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// captureLines runs one completion request on an idle worker, passing its
+// lines to onLine as they are printed
+func (wp *workerPool) captureLines(ctx context.Context, dir string, lbuffer string, rbuffer string, onLine func(line string)) (err error) {
+
+	var w *captureWorker
+	for w == nil {
+		select {
+		case w = <-wp.idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wp.closed:
+			return errors.New("capture worker pool is closed")
+		case <-time.After(wp.initTimeout):
+			return errors.New("no capture worker available")
+		}
+		// health check, the worker may have died while idling
+		if !w.alive() {
+			logrus.Info("replacing dead capture worker")
+			w.kill()
+			w = nil
+			go wp.spawn()
+		}
+	}
+
+	err = w.captureLines(ctx, dir, lbuffer, rbuffer, wp.requestTimeout, onLine)
+	if err != nil && err == ctx.Err() {
+		// the worker is still busy with the cancelled request, let it finish
+		// in the background instead of paying for a restart
+		go func() {
+			if err := w.drain(wp.requestTimeout); err != nil {
+				logrus.Info("replacing capture worker after failed drain: ", err)
+				w.kill()
+				go wp.spawn()
+				return
+			}
+			wp.release(w)
+		}()
+		return err
+	}
+	if err != nil {
+		logrus.Info("replacing capture worker after failed request: ", err)
+		w.kill()
+		go wp.spawn()
+		return err
+	}
+	wp.release(w)
+	return nil
+}
+
+// close kills all idle workers, workers in use are killed when released
+func (wp *workerPool) close() {
+	wp.closeOnce.Do(func() {
+		close(wp.closed)
+		for {
+			select {
+			case w := <-wp.idle:
+				w.kill()
+			default:
+				return
+			}
+		}
+	})
+}
@@ -1,86 +1,86 @@
 package zsh
 
 import (
+	"context"
 	"fmt"
-	"github.com/kr/pty"
 	"io"
-	"math/rand"
-	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
-	"time"
 
 	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"google.golang.org/protobuf/proto"
 
-	"github.com/michaellee8/clui-nix/backend/go/pkg/clui"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/host"
 	"github.com/spf13/viper"
 )
 
-var keyListenerOutputEnvKey = "KEY_LISTENER_OUTPUT"
+// dirHistoryEnvKey tells install-key-listener.zsh where to record the commands
+// run along with their directory, dirHistoryFile is its name in CLUI_TMP_PATH
+var dirHistoryEnvKey = "CLUI_DIR_HISTORY"
+
+const dirHistoryFile = "dir_history"
 
 // Provider provides the zsh implementation of clui
 type Provider struct {
-	dir            string
-	input          io.Reader
-	output         io.Writer
-	compOptHandler clui.CompletionInfoHandler
-	winsizeChan    chan pty.Winsize
-	comp           *completer
-	trans          *translator
-	pipeBuffer     string
-	installerPath  string
-	zshPath        string
-	tmpPath        string
-	// pipe file opened for read
-	pf net.Listener
-	// it is a socket now, pipe is just here for historial reaons
-	// TODO: rename pipe* to sock*
-	pipePath string
-}
-
-func (p *Provider) SetWinsizeChan(winsizes chan pty.Winsize) {
-	p.winsizeChan = winsizes
-}
-
-// SetDir sets the current working directory of the process
-func (p *Provider) SetDir(s string) {
-	p.dir = s
-}
-
-// SetInput sets the input stream used for Stdin
-func (p *Provider) SetInput(r io.Reader) {
-	p.input = r
-}
-
-// SetOutput sets the output stream used for both Stdout and Stderr
-func (p *Provider) SetOutput(w io.Writer) {
-	p.output = w
-}
-
-// SetCompOptHandler sets the completion option handler
-func (p *Provider) SetCompOptHandler(j clui.CompletionInfoHandler) {
-	p.compOptHandler = j
+	host.Host
+	comp          *completer
+	installerPath string
+	zshPath       string
+	tmpPath       string
 }
 
 // NewProvider returns a new instance of Provider using default options
 func NewProvider() *Provider {
-	var defaultTranslator = &translator{
-		fieldSep: string([]byte{0x00, 0x1b}),       // \0\e
-		endSep:   string([]byte{0x00, 0x07, 0x1b}), // \0\a\e
-	}
 	var defaultCompleter = &completer{
 		completerScriptPath: viper.GetString("ZSH_COMPLETER_SCRIPT_PATH"),
 		zshPath:             viper.GetString("ZSH_PATH"),
 		maxHelp:             10,
+		execHelp:            viper.GetBool("ZSH_COMPLETER_EXEC_HELP"),
+		describeDeadline:    viper.GetDuration("ZSH_COMPLETER_DESCRIBE_DEADLINE"),
+		initialEntries:      viper.GetInt("ZSH_COMPLETER_INITIAL_ENTRIES"),
+		entriesChunk:        viper.GetInt("ZSH_COMPLETER_ENTRIES_CHUNK"),
+		fuzzy:               viper.GetBool("ZSH_COMPLETER_FUZZY"),
+	}
+	if history := viper.GetString("ZSH_HISTFILE"); history != "" {
+		defaultCompleter.history = &historyFile{path: history, parse: parseZshHistory}
+	}
+	if tmpPath := viper.GetString("CLUI_TMP_PATH"); tmpPath != "" {
+		defaultCompleter.dirHistory = &historyFile{
+			path:    filepath.Join(tmpPath, dirHistoryFile),
+			parse:   parseDirHistory,
+			trim:    trimDirHistory,
+			maxSize: maxDirHistorySize,
+		}
+	}
+	if ranking := viper.GetString("ZSH_COMPLETER_RANKING_PATH"); ranking != "" {
+		defaultCompleter.ranker = sharedRanker(ranking, defaultCompleter.history)
+	}
+	if workers := viper.GetInt("ZSH_COMPLETER_DESCRIBE_WORKERS"); workers > 0 {
+		defaultCompleter.describeSem = make(chan struct{}, workers)
+	}
+	cacheDir := viper.GetString("ZSH_COMPLETER_CACHE_PATH")
+	if cacheDir == "" {
+		cacheDir = viper.GetString("CLUI_TMP_PATH")
+	}
+	if cacheDir != "" {
+		defaultCompleter.descriptions = sharedDescriptionCache(cacheDir)
+	}
+	if whatis := viper.GetString("ZSH_COMPLETER_WHATIS_PATH"); whatis != "" {
+		if path, err := exec.LookPath(whatis); err != nil {
+			logrus.Info("command descriptions disabled, cannot find whatis: ", err)
+		} else {
+			defaultCompleter.whatisPath = path
+		}
+	}
+	if workers := viper.GetInt("ZSH_COMPLETER_WORKERS"); workers > 0 {
+		initScriptPath := filepath.Join(filepath.Dir(defaultCompleter.completerScriptPath), "capture-init.zsh")
+		defaultCompleter.pool = newWorkerPool(defaultCompleter.zshPath, initScriptPath, workers)
 	}
 	return &Provider{
 		comp:          defaultCompleter,
-		trans:         defaultTranslator,
 		installerPath: viper.GetString("ZSH_COMPLETER_SCRIPT_PATH"),
 		zshPath:       viper.GetString("ZSH_PATH"),
 		tmpPath:       viper.GetString("CLUI_TMP_PATH"),
@@ -90,161 +90,68 @@ func NewProvider() *Provider {
 // Start starts performs the required preparation and then starts the zsh
 // process, as well as start providing completion results via compOptHandler
 func (p *Provider) Start() (err error) {
-
-	// validate we have correct options set by clui first
-	if p.dir == "" {
-		return errors.New("zsh provider: dir is not set")
-	}
-	if p.input == nil {
-		return errors.New("zsh provider: input is not set")
-	}
-	if p.output == nil {
-		return errors.New("zsh provider: output is not set")
-	}
-	if p.compOptHandler == nil {
-		return errors.New("zsh provider: compOptHandler is not set")
+	sockPath, err := host.SockPath(p.tmpPath)
+	if err != nil {
+		return err
 	}
-	if p.winsizeChan == nil {
-		return errors.New("zsh provider: winsizeChan is not set")
+	if p.comp.dirHistory != nil {
+		// the commands run are nobody else's business, install-key-listener.zsh
+		// only appends to the file if it exists
+		if err := createPrivateFile(p.comp.dirHistory.path); err != nil {
+			return errors.Wrap(err, "cannot create directory history")
+		}
 	}
 
-	// created the named pipe used for communication
-	if err := os.MkdirAll(p.tmpPath, 0777); err != nil {
-		return errors.Wrap(err, "cannot make tmp dir")
+	if p.comp.pool != nil {
+		p.comp.pool.start()
+		defer p.comp.pool.close()
 	}
-	// no chance of pipeName collision
-	pipeName := strconv.Itoa(int(time.Now().UnixNano()))
-	pipeName += strconv.Itoa(rand.Int())
-
-	sockPath := filepath.Join(p.tmpPath, pipeName)
 
-	if p.pf, err = net.Listen("unixpacket", sockPath); err != nil {
-		return errors.Wrap(err, "cannot create unixpacket socket for key listener")
+	// the cache is shared, so this only scans $PATH for the first provider
+	if p.comp.descriptions != nil {
+		go p.comp.descriptions.warm(context.Background(), p.comp.whatisPath)
 	}
 
-	defer func() {
-		if err := p.pf.Close(); err != nil {
-			logrus.Errorln(errors.Wrap(err, "closing key listener socket failed"))
-		}
-	}()
-
-	p.pipePath = sockPath
-
 	zdotdir := filepath.Dir(p.installerPath)
 
 	env := os.Environ()
 	env = append(env, fmt.Sprintf("ZDOTDIR=%s", zdotdir))
-	env = append(env, fmt.Sprintf("%s=unixpacket://%s", keyListenerOutputEnvKey, sockPath))
-
-	cmd := exec.Cmd{
-		Path: p.zshPath,
-		// force interactive shell here, so maybe we don't need to use pty
-		Args: []string{p.zshPath, "-i"},
-		Dir:  p.dir,
-		Env:  env,
-	}
-
-	go p.startKeyListener()
-
-	ptmx, err := pty.Start(&cmd)
-
-	if err != nil {
-		logrus.Error("cannot start zsh: ", err)
-		return errors.Wrap(err, "cannot start zsh")
-	}
-
-	defer func() {
-		if err = ptmx.Close(); err != nil {
-			logrus.Error("cannot close zsh: ", err)
-
-		}
-	}()
-
-	go func() {
-		if _, err = io.Copy(ptmx, p.input); err != nil {
-			logrus.Error("cannot copy ptmx stdout to p.input: ", err)
-		}
-	}()
-
-	go func() {
-		for winsize := range p.winsizeChan {
-			if err := pty.Setsize(ptmx, &winsize); err != nil {
-				logrus.Error("zsh provder: unable to resize pty: ", err)
-			}
-		}
-	}()
-
-	if _, err = io.Copy(p.output, ptmx); err != nil {
-		logrus.Error("cannot copy p.output to ptmx stdin: ", err)
-		return errors.Wrap(err, "cannot copy")
-	}
-
-	return
+	if p.comp.history != nil {
+		env = append(env, fmt.Sprintf("HISTFILE=%s", p.comp.history.path))
+	}
+	if p.comp.dirHistory != nil {
+		env = append(env, fmt.Sprintf("%s=%s", dirHistoryEnvKey, p.comp.dirHistory.path))
+	}
+
+	return p.Host.Start(host.Program{
+		Name: "zsh",
+		Command: &exec.Cmd{
+			Path: p.zshPath,
+			// force interactive shell here, so maybe we don't need to use pty
+			Args: []string{p.zshPath, "-i"},
+			Env:  env,
+		},
+		KeyListener: sockPath,
+		Complete:    p.comp.streamCompletion,
+		Accept: func(ptmx *os.File, ac *protoclui.AcceptCompletion) error {
+			return p.accept(ptmx, ac)
+		},
+	})
 }
 
-func (p *Provider) startKeyListener() {
-
-	logrus.Trace("starting key listener")
-
-	for {
-		conn, err := p.pf.Accept()
-		if err != nil {
-			logrus.Errorln(errors.Wrap(err, "key listener accept failed"))
-			continue
-		}
-		go p.receiveRawCompletionSourceInfo(conn)
-	}
-
-}
-
-func (p *Provider) receiveRawCompletionSourceInfo(conn net.Conn) {
-	logrus.Trace("receiving raw CSI")
-	rcsi, err := io.ReadAll(conn)
+// accept types the keys that make zsh apply an accepted entry while it is at
+// its prompt, zsh itself checks that the line has not changed since the entry
+// was offered
+func (p *Provider) accept(ptmx io.Writer, ac *protoclui.AcceptCompletion) error {
+	csi, entry, err := p.Accepted(ac)
 	if err != nil {
-		// if there is a read error we just discard this trial
-		// but we still log it for further debugging anyway
-		logrus.Errorf("unable to read pipeFile: %+v", errors.Wrap(err, "cannot read pipeFile"))
-		return
+		return err
 	}
 
-	if err := conn.Close(); err != nil {
-		logrus.Error(errors.Wrap(err, "cannot close conn"))
+	if p.comp.ranker != nil {
+		p.comp.ranker.recordAccept(csi, entry.Suggestion)
 	}
 
-	csi, err := p.trans.translate(rcsi)
-	if err != nil {
-		logrus.Errorf("cannot translate raw CSI: %+v", errors.Wrap(err, "cannot translate raw CSI"))
-		return
-	}
-	ci, err := p.comp.getCompletion(csi)
-	if err != nil {
-		logrus.Errorf("cannot get completion: %+v, %+v", errors.Wrap(err, "cannot get completion"), err)
-	}
-	p.compOptHandler.Handle(&ci)
-}
-
-type translator struct {
-	fieldSep string
-	endSep   string
-}
-
-func (t *translator) translate(rcsi []byte) (csi completionSourceInfo, err error) {
-
-	pcsi := protoclui.CompletionSourceInfo{}
-
-	if err := proto.Unmarshal(rcsi, &pcsi); err != nil {
-		return completionSourceInfo{}, errors.Wrap(err, "cannot unmarshal raw CSI")
-	}
-
-	csi.line = int(pcsi.Line)
-	csi.col = int(pcsi.Col)
-	csi.dir = pcsi.Dir
-
-	csi.lbuffer = pcsi.LBuffer
-
-	csi.rbuffer = pcsi.RBuffer
-
-	csi.buffer = pcsi.Buffer
-
-	return
+	_, err = io.WriteString(ptmx, csi.ReplaceShellWord(entry.Suggestion, cmdline.QuotePOSIX).Keys())
+	return errors.Wrap(err, "cannot write accept keys")
 }
@@ -0,0 +1,306 @@
+package zsh
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaellee8/clui-nix/backend/go/pkg/cluiimpl/internal/cmdline"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// frecencyHalfLife is the time after which a use counts half as much
+const frecencyHalfLife = 7 * 24 * time.Hour
+
+// weights of the parts of a score, a use weighs 1 when it just happened
+const (
+	acceptWeight       = 2.0
+	historyWeight      = 1.0
+	prefixWeight       = 3.0
+	foldedPrefixWeight = 1.5
+	unexpectedWeight   = -2.0
+)
+
+// frecency is a count of uses that decays over time
+type frecency struct {
+	Score   float64 `json:"score"`
+	Updated int64   `json:"updated"`
+}
+
+// at returns the score decayed to t
+func (f frecency) at(t int64) float64 {
+	age := time.Duration(t-f.Updated) * time.Second
+	if age < 0 {
+		age = 0
+	}
+	return f.Score * math.Pow(0.5, float64(age)/float64(frecencyHalfLife))
+}
+
+// add records a use at t
+func (f *frecency) add(t int64, weight float64) {
+	if t < f.Updated {
+		// uses are not always recorded in order, decay the late one instead
+		f.Score += weight * frecency{Score: 1, Updated: t}.at(f.Updated)
+		return
+	}
+	f.Score = f.at(t) + weight
+	f.Updated = t
+}
+
+// rankKey identifies a candidate in the context it is used in, candidates for
+// the first word stand alone, the others are qualified by the command. A
+// directory is the same candidate with or without its trailing slash.
+func rankKey(command string, candidate string) string {
+	candidate = strings.TrimSuffix(candidate, "/")
+	if command == "" {
+		return candidate
+	}
+	return command + "\x00" + candidate
+}
+
+// ranker scores completion candidates by how often and how recently they
+// were accepted or run, and by how well they match what has been typed. The
+// accepted completions are persisted to path.
+type ranker struct {
+	path    string
+	history *historyFile
+
+	mut      sync.Mutex
+	accepted map[string]*frecency
+	// fromHistory is derived from the entries of history, it is recomputed
+	// whenever they change
+	fromHistory    map[string]*frecency
+	historyEntries []historyEntry
+
+	saveMut sync.Mutex
+	saving  sync.WaitGroup
+
+	// now returns the current unix time, it is replaced by tests
+	now func() int64
+}
+
+var (
+	rankersMut sync.Mutex
+	rankers    = map[string]*ranker{}
+)
+
+// sharedRanker returns the ranker persisted at path, loading it from disk the
+// first time it is asked for. Rankers are shared by all providers of the same
+// user, the history of the first one is used.
+func sharedRanker(path string, history *historyFile) *ranker {
+	rankersMut.Lock()
+	defer rankersMut.Unlock()
+
+	if r, ok := rankers[path]; ok {
+		return r
+	}
+	r := newRanker(path, history)
+	if err := r.load(); err != nil {
+		logrus.Info("starting with an empty completion ranking: ", err)
+	}
+	rankers[path] = r
+	return r
+}
+
+func newRanker(path string, history *historyFile) *ranker {
+	return &ranker{
+		path:     path,
+		history:  history,
+		accepted: map[string]*frecency{},
+		now:      func() int64 { return time.Now().Unix() },
+	}
+}
+
+func (r *ranker) load() error {
+	if r.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrap(err, "cannot read completion ranking")
+	}
+	saved := map[string]*frecency{}
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return errors.Wrap(err, "cannot parse completion ranking")
+	}
+	// directories used to be recorded with their trailing slash
+	accepted := map[string]*frecency{}
+	for key, f := range saved {
+		key = strings.TrimSuffix(key, "/")
+		if merged, ok := accepted[key]; ok {
+			merged.add(f.Updated, f.Score)
+			continue
+		}
+		accepted[key] = f
+	}
+	r.mut.Lock()
+	r.accepted = accepted
+	r.mut.Unlock()
+	return nil
+}
+
+// save writes the accepted completions to disk, the file is replaced
+// atomically so that readers never see a partial one
+func (r *ranker) save() error {
+	if r.path == "" {
+		return nil
+	}
+	r.saveMut.Lock()
+	defer r.saveMut.Unlock()
+
+	r.mut.Lock()
+	b, err := json.Marshal(r.accepted)
+	r.mut.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "cannot marshal completion ranking")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return errors.Wrap(err, "cannot create completion ranking directory")
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrap(err, "cannot write completion ranking")
+	}
+	return errors.Wrap(os.Rename(tmp, r.path), "cannot replace completion ranking")
+}
+
+// recordAccept learns that candidate was accepted for the word at the cursor
+// of csi, and saves that in the background
+func (r *ranker) recordAccept(csi cmdline.Source, candidate string) {
+	key := rankKey(csi.Command(), candidate)
+
+	r.mut.Lock()
+	f, ok := r.accepted[key]
+	if !ok {
+		f = &frecency{}
+		r.accepted[key] = f
+	}
+	f.add(r.now(), 1)
+	r.mut.Unlock()
+
+	r.saving.Add(1)
+	go func() {
+		defer r.saving.Done()
+		if err := r.save(); err != nil {
+			logrus.Info("cannot save completion ranking: ", err)
+		}
+	}()
+}
+
+// historyFrecency returns the uses of the words of the commands in history,
+// it must be called with mut held
+func (r *ranker) historyFrecency() map[string]*frecency {
+	entries, err := r.history.read()
+	if err != nil {
+		logrus.Debug("cannot read history for ranking: ", err)
+	}
+	if r.fromHistory != nil && len(entries) == len(r.historyEntries) &&
+		(len(entries) == 0 || &entries[0] == &r.historyEntries[0]) {
+		return r.fromHistory
+	}
+
+	r.fromHistory = map[string]*frecency{}
+	r.historyEntries = entries
+	now := r.now()
+	for _, e := range entries {
+		// entries without timestamp are taken as old
+		t := e.time
+		if t == 0 {
+			t = now - int64(4*frecencyHalfLife/time.Second)
+		}
+		words := strings.Fields(e.command)
+		for i, word := range words {
+			command := ""
+			if i > 0 {
+				command = words[0]
+			}
+			key := rankKey(command, word)
+			f, ok := r.fromHistory[key]
+			if !ok {
+				f = &frecency{}
+				r.fromHistory[key] = f
+			}
+			f.add(t, 1)
+		}
+	}
+	return r.fromHistory
+}
+
+// prefixQuality scores how well candidate matches the part of the word before
+// the cursor as a prefix
+func prefixQuality(left string, candidate string) float64 {
+	switch {
+	case strings.HasPrefix(candidate, left):
+		return prefixWeight
+	case strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(left)):
+		return foldedPrefixWeight
+	}
+	return 0
+}
+
+// typeQuality scores whether candidate is of the type expected for the word
+// before the cursor, options and hidden files are only expected once their
+// first character has been typed
+func typeQuality(left string, candidate string) (score float64) {
+	if strings.HasPrefix(candidate, "-") && !strings.HasPrefix(left, "-") {
+		score += unexpectedWeight
+	}
+	if strings.HasPrefix(candidate, ".") && !strings.HasPrefix(left, ".") {
+		score += unexpectedWeight
+	}
+	return
+}
+
+// score returns the score of candidate for the word at the cursor of csi at
+// now, quality is how well it matches the word and fromHistory the result of
+// historyFrecency. It must be called with mut held.
+func (r *ranker) score(csi cmdline.Source, candidate string, quality float64, fromHistory map[string]*frecency, now int64) float64 {
+	left, _ := csi.CurrentWord()
+	score := quality + typeQuality(left, candidate)
+	if r == nil {
+		return score
+	}
+
+	key := rankKey(csi.Command(), candidate)
+	if f, ok := r.accepted[key]; ok {
+		score += acceptWeight * f.at(now)
+	}
+	if f, ok := fromHistory[key]; ok {
+		score += historyWeight * f.at(now)
+	}
+	return score
+}
+
+// rank orders candidates by descending score, candidates with the same score
+// keep their order. quality holds how well each of them matches the word.
+func (r *ranker) rank(csi cmdline.Source, candidates []string, quality []float64) []int {
+	var fromHistory map[string]*frecency
+	var now int64
+	if r != nil {
+		now = r.now()
+		r.mut.Lock()
+		defer r.mut.Unlock()
+		fromHistory = r.historyFrecency()
+	}
+
+	scores := make([]float64, len(candidates))
+	order := make([]int, len(candidates))
+	for i, c := range candidates {
+		scores[i] = r.score(csi, c, quality[i], fromHistory, now)
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	return order
+}
@@ -0,0 +1,385 @@
+package zsh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	protoclui "github.com/michaellee8/clui-nix/backend/go/pkg/proto/clui"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// the number of suggestions taken from each source for an empty line
+const (
+	maxDirSuggestions      = 5
+	maxRecentSuggestions   = 5
+	maxFrequentSuggestions = 5
+)
+
+// historyEntry is a command run by the user, dir is only known for commands
+// recorded by the preexec hook of install-key-listener.zsh
+type historyEntry struct {
+	time    int64
+	dir     string
+	command string
+}
+
+// maxDirHistorySize is the size the directory history may grow to before
+// its oldest records are dropped, it is trimmed to half of it
+const maxDirHistorySize = 1 << 20
+
+// historyFile caches the entries of a history file for as long as the file
+// does not change
+type historyFile struct {
+	path  string
+	parse func(b []byte) []historyEntry
+	// trim returns the newest records of b that fit into size, the file is
+	// trimmed when it grows beyond maxSize if both are set
+	trim    func(b []byte, size int) []byte
+	maxSize int64
+
+	mut     sync.Mutex
+	modTime time.Time
+	size    int64
+	entries []historyEntry
+}
+
+// read returns the entries of the file, it only parses the file again if it
+// changed since the last read
+func (hf *historyFile) read() ([]historyEntry, error) {
+	if hf == nil || hf.path == "" {
+		return nil, nil
+	}
+
+	hf.mut.Lock()
+	defer hf.mut.Unlock()
+
+	fi, err := os.Stat(hf.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "cannot stat history file")
+	}
+	if hf.entries != nil && fi.ModTime().Equal(hf.modTime) && fi.Size() == hf.size {
+		return hf.entries, nil
+	}
+
+	b, err := os.ReadFile(hf.path)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read history file")
+	}
+	if hf.trim != nil && hf.maxSize > 0 && int64(len(b)) > hf.maxSize {
+		b = hf.trim(b, int(hf.maxSize/2))
+		if fi, err = replaceFile(hf.path, b); err != nil {
+			return nil, errors.Wrap(err, "cannot trim history file")
+		}
+	}
+	hf.entries = hf.parse(b)
+	hf.modTime = fi.ModTime()
+	hf.size = fi.Size()
+	return hf.entries, nil
+}
+
+// createPrivateFile creates the file at path readable only by the user if it
+// does not exist, an existing file is made private
+func createPrivateFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err = f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replaceFile atomically replaces the file at path with a private one holding
+// b, it returns the info of the new file
+func replaceFile(path string, b []byte) (os.FileInfo, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fi, os.Rename(f.Name(), path)
+}
+
+// zshMeta marks a metafied byte in zsh history files, the byte following it
+// has been xored with 32
+const zshMeta = 0x83
+
+func unmetafy(b []byte) []byte {
+	if bytes.IndexByte(b, zshMeta) < 0 {
+		return b
+	}
+	res := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] == zshMeta && i+1 < len(b) {
+			i++
+			res = append(res, b[i]^32)
+			continue
+		}
+		res = append(res, b[i])
+	}
+	return res
+}
+
+// parseZshHistory parses a zsh history file, both plain and with
+// EXTENDED_HISTORY timestamps `: <start>:<elapsed>;<command>`. Lines ending
+// with a backslash continue on the next line.
+func parseZshHistory(b []byte) (entries []historyEntry) {
+	lines := strings.Split(string(unmetafy(b)), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = line[:len(line)-1] + "\n" + lines[i]
+		}
+
+		var e historyEntry
+		if strings.HasPrefix(line, ": ") {
+			if semi := strings.IndexByte(line, ';'); semi >= 0 {
+				meta := strings.SplitN(line[2:semi], ":", 2)
+				e.time, _ = strconv.ParseInt(strings.TrimSpace(meta[0]), 10, 64)
+				line = line[semi+1:]
+			}
+		}
+		e.command = strings.TrimSpace(line)
+		if e.command != "" {
+			entries = append(entries, e)
+		}
+	}
+	return
+}
+
+// parseDirHistory parses the records written by the preexec hook of
+// install-key-listener.zsh, <time>\0<dir>\0<command>\0 each
+func parseDirHistory(b []byte) (entries []historyEntry) {
+	fields := strings.Split(string(b), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		t, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			continue
+		}
+		command := strings.TrimSpace(fields[i+2])
+		if command != "" {
+			entries = append(entries, historyEntry{time: t, dir: fields[i+1], command: command})
+		}
+	}
+	return
+}
+
+// trimDirHistory returns the newest records of a directory history that fit
+// into size
+func trimDirHistory(b []byte, size int) []byte {
+	for start, fields := 0, 0; start < len(b); {
+		if len(b)-start <= size && fields%3 == 0 {
+			return b[start:]
+		}
+		i := bytes.IndexByte(b[start:], 0)
+		if i < 0 {
+			break
+		}
+		start += i + 1
+		fields++
+	}
+	return nil
+}
+
+// commandStats is how often and how recently a command was run
+type commandStats struct {
+	command string
+	count   int
+	last    int64
+	// order is the position of the last run in the history, it breaks ties
+	// between commands run within the same second or without timestamps
+	order int
+}
+
+// tallyCommands returns the stats of the commands of entries, only counting
+// the entries in dir if it is not empty
+func tallyCommands(entries []historyEntry, dir string) []*commandStats {
+	byCommand := map[string]*commandStats{}
+	var stats []*commandStats
+	for i, e := range entries {
+		if dir != "" && e.dir != dir {
+			continue
+		}
+		cs, ok := byCommand[e.command]
+		if !ok {
+			cs = &commandStats{command: e.command}
+			byCommand[e.command] = cs
+			stats = append(stats, cs)
+		}
+		cs.count++
+		cs.order = i
+		if e.time > cs.last {
+			cs.last = e.time
+		}
+	}
+	return stats
+}
+
+func byRecency(stats []*commandStats) {
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].last != stats[j].last {
+			return stats[i].last > stats[j].last
+		}
+		return stats[i].order > stats[j].order
+	})
+}
+
+func byFrequency(stats []*commandStats) {
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].count != stats[j].count {
+			return stats[i].count > stats[j].count
+		}
+		return stats[i].order > stats[j].order
+	})
+}
+
+// makeTargetRegexp matches the rules of a Makefile, along with a description
+// given as a `## comment` on the same line
+var makeTargetRegexp = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9_./-]*)\s*:([^=]|$)(?:.*##\s*(.*))?`)
+
+// projectActions returns commands that make sense for the project in dir,
+// like the targets of a Makefile
+func projectActions(dir string) (actions []suggestion) {
+
+	if b, err := os.ReadFile(filepath.Join(dir, "Makefile")); err == nil {
+		seen := map[string]bool{}
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		for scanner.Scan() {
+			m := makeTargetRegexp.FindStringSubmatch(scanner.Text())
+			if m == nil || seen[m[1]] || strings.ContainsAny(m[1], "%") {
+				continue
+			}
+			seen[m[1]] = true
+			description := strings.TrimSpace(m[3])
+			if description == "" {
+				description = "Makefile target"
+			}
+			actions = append(actions, suggestion{"make " + m[1], description})
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+		actions = append(actions,
+			suggestion{"go test ./...", "run the tests of this Go module"},
+			suggestion{"go build ./...", "build this Go module"},
+			suggestion{"go vet ./...", "vet this Go module"},
+		)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dir, "package.json")); err == nil {
+		var pkg struct {
+			Scripts map[string]string `json:"scripts"`
+		}
+		if err := json.Unmarshal(b, &pkg); err == nil {
+			var names []string
+			for name := range pkg.Scripts {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				actions = append(actions, suggestion{"npm run " + name, pkg.Scripts[name]})
+			}
+		}
+	}
+
+	return
+}
+
+// suggestion is a command proposed for an empty line
+type suggestion struct {
+	command     string
+	description string
+}
+
+func pluralTimes(n int) string {
+	if n == 1 {
+		return "once"
+	}
+	return fmt.Sprintf("%d times", n)
+}
+
+// suggest proposes commands for an empty line in dir: those run in dir
+// before, project actions, and the most recently and frequently run ones
+func (co *completer) suggest(dir string) (entries []*protoclui.CompletionEntry) {
+
+	var suggestions []suggestion
+
+	dirHistory, err := co.dirHistory.read()
+	if err != nil {
+		logrus.Debug("cannot read directory history: ", err)
+	}
+	dirStats := tallyCommands(dirHistory, dir)
+	byFrequency(dirStats)
+	for i, cs := range dirStats {
+		if i == maxDirSuggestions {
+			break
+		}
+		suggestions = append(suggestions, suggestion{cs.command, "run " + pluralTimes(cs.count) + " in this directory"})
+	}
+
+	suggestions = append(suggestions, projectActions(dir)...)
+
+	history, err := co.history.read()
+	if err != nil {
+		logrus.Debug("cannot read history: ", err)
+	}
+	stats := tallyCommands(history, "")
+	byRecency(stats)
+	for i, cs := range stats {
+		if i == maxRecentSuggestions {
+			break
+		}
+		suggestions = append(suggestions, suggestion{cs.command, "run recently"})
+	}
+	byFrequency(stats)
+	for i, cs := range stats {
+		if i == maxFrequentSuggestions {
+			break
+		}
+		suggestions = append(suggestions, suggestion{cs.command, "run " + pluralTimes(cs.count)})
+	}
+
+	seen := map[string]bool{}
+	for _, s := range suggestions {
+		if seen[s.command] {
+			continue
+		}
+		seen[s.command] = true
+		entries = append(entries, &protoclui.CompletionEntry{
+			ActualInput: s.command,
+			ShouldInput: true,
+			Description: s.description,
+			Suggestion:  s.command,
+			Level:       0,
+		})
+	}
+	return
+}
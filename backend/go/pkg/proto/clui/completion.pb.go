@@ -28,8 +28,19 @@ type CompletionEntry struct {
 	ActualInput string `protobuf:"bytes,1,opt,name=actual_input,json=actualInput,proto3" json:"actual_input,omitempty"`
 	Suggestion  string `protobuf:"bytes,2,opt,name=suggestion,proto3" json:"suggestion,omitempty"`
 	Description string `protobuf:"bytes,3,opt,name=description,proto3" json:"description,omitempty"`
-	Level       int32  `protobuf:"varint,4,opt,name=level,proto3" json:"level,omitempty"`
-	ShouldInput bool   `protobuf:"varint,5,opt,name=should_input,json=shouldInput,proto3" json:"should_input,omitempty"`
+	// level is the depth of the entry in the sections of the completion, 0
+	// for entries that belong to no group and 1 for entries of the group
+	// groups[group] of the CompletionInfo
+	Level       int32 `protobuf:"varint,4,opt,name=level,proto3" json:"level,omitempty"`
+	ShouldInput bool  `protobuf:"varint,5,opt,name=should_input,json=shouldInput,proto3" json:"should_input,omitempty"`
+	// match_ranges are the parts of suggestion that matched the typed word,
+	// in order, so that frontends can highlight them. For a prefix match those
+	// are the parts of the word before and after the cursor, for a fuzzy match
+	// the single characters that matched.
+	MatchRanges []*MatchRange `protobuf:"bytes,6,rep,name=match_ranges,json=matchRanges,proto3" json:"match_ranges,omitempty"`
+	// group is the index of the group of the entry in the groups of the
+	// CompletionInfo, it is only meaningful if level is 1
+	Group uint32 `protobuf:"varint,7,opt,name=group,proto3" json:"group,omitempty"`
 }
 
 func (x *CompletionEntry) Reset() {
@@ -99,6 +110,136 @@ func (x *CompletionEntry) GetShouldInput() bool {
 	return false
 }
 
+func (x *CompletionEntry) GetMatchRanges() []*MatchRange {
+	if x != nil {
+		return x.MatchRanges
+	}
+	return nil
+}
+
+func (x *CompletionEntry) GetGroup() uint32 {
+	if x != nil {
+		return x.Group
+	}
+	return 0
+}
+
+// CompletionGroup is a section of entries of the same kind, like local
+// branches, options or files
+type CompletionGroup struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// tag is the compsys tag of the entries, like heads-local or options
+	Tag string `protobuf:"bytes,1,opt,name=tag,proto3" json:"tag,omitempty"`
+	// header is a human readable name of the section, like "local head"
+	Header string `protobuf:"bytes,2,opt,name=header,proto3" json:"header,omitempty"`
+}
+
+func (x *CompletionGroup) Reset() {
+	*x = CompletionGroup{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_clui_completion_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CompletionGroup) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CompletionGroup) ProtoMessage() {}
+
+func (x *CompletionGroup) ProtoReflect() protoreflect.Message {
+	mi := &file_clui_completion_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CompletionGroup.ProtoReflect.Descriptor instead.
+func (*CompletionGroup) Descriptor() ([]byte, []int) {
+	return file_clui_completion_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *CompletionGroup) GetTag() string {
+	if x != nil {
+		return x.Tag
+	}
+	return ""
+}
+
+func (x *CompletionGroup) GetHeader() string {
+	if x != nil {
+		return x.Header
+	}
+	return ""
+}
+
+// MatchRange is the part [start, end) of a suggestion, counted in unicode
+// code points
+type MatchRange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Start uint32 `protobuf:"varint,1,opt,name=start,proto3" json:"start,omitempty"`
+	End   uint32 `protobuf:"varint,2,opt,name=end,proto3" json:"end,omitempty"`
+}
+
+func (x *MatchRange) Reset() {
+	*x = MatchRange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_clui_completion_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *MatchRange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MatchRange) ProtoMessage() {}
+
+func (x *MatchRange) ProtoReflect() protoreflect.Message {
+	mi := &file_clui_completion_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MatchRange.ProtoReflect.Descriptor instead.
+func (*MatchRange) Descriptor() ([]byte, []int) {
+	return file_clui_completion_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *MatchRange) GetStart() uint32 {
+	if x != nil {
+		return x.Start
+	}
+	return 0
+}
+
+func (x *MatchRange) GetEnd() uint32 {
+	if x != nil {
+		return x.End
+	}
+	return 0
+}
+
 type CompletionInfo struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -110,12 +251,32 @@ type CompletionInfo struct {
 	BufferLength int32              `protobuf:"varint,5,opt,name=buffer_length,json=bufferLength,proto3" json:"buffer_length,omitempty"`
 	IsFirst      bool               `protobuf:"varint,6,opt,name=is_first,json=isFirst,proto3" json:"is_first,omitempty"`
 	IsEmpty      bool               `protobuf:"varint,7,opt,name=is_empty,json=isEmpty,proto3" json:"is_empty,omitempty"`
+	// request_id is the request_id of the CompletionSourceInfo this
+	// CompletionInfo answers, consumers never receive a smaller one after a
+	// larger one
+	RequestId uint64 `protobuf:"varint,8,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// late_descriptions fills in descriptions of entries sent earlier for the
+	// same request_id that were not known in time
+	LateDescriptions []*EntryDescription `protobuf:"bytes,9,rep,name=late_descriptions,json=lateDescriptions,proto3" json:"late_descriptions,omitempty"`
+	// sequence numbers the CompletionInfos answering the same request_id. The
+	// one with sequence 0 carries the first entries and replaces whatever was
+	// shown before, the follow-ups with larger sequences append their entries
+	// to the earlier ones, append their groups and fill in late_descriptions,
+	// their other fields are left empty. Entry and group indices refer to
+	// those appended so far.
+	Sequence uint32 `protobuf:"varint,10,opt,name=sequence,proto3" json:"sequence,omitempty"`
+	// done is set on the last CompletionInfo answering request_id
+	Done bool `protobuf:"varint,11,opt,name=done,proto3" json:"done,omitempty"`
+	// groups are the groups the entries belong to, in the order of their
+	// first entry. A follow-up only carries the groups first used by its own
+	// entries.
+	Groups []*CompletionGroup `protobuf:"bytes,12,rep,name=groups,proto3" json:"groups,omitempty"`
 }
 
 func (x *CompletionInfo) Reset() {
 	*x = CompletionInfo{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_clui_completion_proto_msgTypes[1]
+		mi := &file_clui_completion_proto_msgTypes[3]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -128,7 +289,7 @@ func (x *CompletionInfo) String() string {
 func (*CompletionInfo) ProtoMessage() {}
 
 func (x *CompletionInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_clui_completion_proto_msgTypes[1]
+	mi := &file_clui_completion_proto_msgTypes[3]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -141,7 +302,7 @@ func (x *CompletionInfo) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CompletionInfo.ProtoReflect.Descriptor instead.
 func (*CompletionInfo) Descriptor() ([]byte, []int) {
-	return file_clui_completion_proto_rawDescGZIP(), []int{1}
+	return file_clui_completion_proto_rawDescGZIP(), []int{3}
 }
 
 func (x *CompletionInfo) GetEntries() []*CompletionEntry {
@@ -186,6 +347,97 @@ func (x *CompletionInfo) GetIsEmpty() bool {
 	return false
 }
 
+func (x *CompletionInfo) GetRequestId() uint64 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+func (x *CompletionInfo) GetLateDescriptions() []*EntryDescription {
+	if x != nil {
+		return x.LateDescriptions
+	}
+	return nil
+}
+
+func (x *CompletionInfo) GetSequence() uint32 {
+	if x != nil {
+		return x.Sequence
+	}
+	return 0
+}
+
+func (x *CompletionInfo) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+func (x *CompletionInfo) GetGroups() []*CompletionGroup {
+	if x != nil {
+		return x.Groups
+	}
+	return nil
+}
+
+// EntryDescription is the description of entries[entry_index]
+type EntryDescription struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	EntryIndex  uint32 `protobuf:"varint,1,opt,name=entry_index,json=entryIndex,proto3" json:"entry_index,omitempty"`
+	Description string `protobuf:"bytes,2,opt,name=description,proto3" json:"description,omitempty"`
+}
+
+func (x *EntryDescription) Reset() {
+	*x = EntryDescription{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_clui_completion_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *EntryDescription) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*EntryDescription) ProtoMessage() {}
+
+func (x *EntryDescription) ProtoReflect() protoreflect.Message {
+	mi := &file_clui_completion_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use EntryDescription.ProtoReflect.Descriptor instead.
+func (*EntryDescription) Descriptor() ([]byte, []int) {
+	return file_clui_completion_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *EntryDescription) GetEntryIndex() uint32 {
+	if x != nil {
+		return x.EntryIndex
+	}
+	return 0
+}
+
+func (x *EntryDescription) GetDescription() string {
+	if x != nil {
+		return x.Description
+	}
+	return ""
+}
+
 type CompletionSourceInfo struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -197,12 +449,18 @@ type CompletionSourceInfo struct {
 	LBuffer string `protobuf:"bytes,4,opt,name=l_buffer,json=lBuffer,proto3" json:"l_buffer,omitempty"`
 	RBuffer string `protobuf:"bytes,5,opt,name=r_buffer,json=rBuffer,proto3" json:"r_buffer,omitempty"`
 	Buffer  string `protobuf:"bytes,6,opt,name=buffer,proto3" json:"buffer,omitempty"`
+	// request_id increases monotonically for every request sent by a shell
+	RequestId uint64 `protobuf:"varint,7,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// executing is set when the shell leaves its prompt to run the command
+	// line, nothing may be typed into the line until a request without it
+	// reports the next one
+	Executing bool `protobuf:"varint,8,opt,name=executing,proto3" json:"executing,omitempty"`
 }
 
 func (x *CompletionSourceInfo) Reset() {
 	*x = CompletionSourceInfo{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_clui_completion_proto_msgTypes[2]
+		mi := &file_clui_completion_proto_msgTypes[5]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -215,7 +473,7 @@ func (x *CompletionSourceInfo) String() string {
 func (*CompletionSourceInfo) ProtoMessage() {}
 
 func (x *CompletionSourceInfo) ProtoReflect() protoreflect.Message {
-	mi := &file_clui_completion_proto_msgTypes[2]
+	mi := &file_clui_completion_proto_msgTypes[5]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -228,7 +486,7 @@ func (x *CompletionSourceInfo) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use CompletionSourceInfo.ProtoReflect.Descriptor instead.
 func (*CompletionSourceInfo) Descriptor() ([]byte, []int) {
-	return file_clui_completion_proto_rawDescGZIP(), []int{2}
+	return file_clui_completion_proto_rawDescGZIP(), []int{5}
 }
 
 func (x *CompletionSourceInfo) GetCol() int32 {
@@ -273,11 +531,238 @@ func (x *CompletionSourceInfo) GetBuffer() string {
 	return ""
 }
 
+func (x *CompletionSourceInfo) GetRequestId() uint64 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+func (x *CompletionSourceInfo) GetExecuting() bool {
+	if x != nil {
+		return x.Executing
+	}
+	return false
+}
+
+// Resize tells the provider the size of the frontend terminal, x and y are
+// the size in pixels and can be left as 0
+type Resize struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Rows uint32 `protobuf:"varint,1,opt,name=rows,proto3" json:"rows,omitempty"`
+	Cols uint32 `protobuf:"varint,2,opt,name=cols,proto3" json:"cols,omitempty"`
+	X    uint32 `protobuf:"varint,3,opt,name=x,proto3" json:"x,omitempty"`
+	Y    uint32 `protobuf:"varint,4,opt,name=y,proto3" json:"y,omitempty"`
+}
+
+func (x *Resize) Reset() {
+	*x = Resize{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_clui_completion_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *Resize) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Resize) ProtoMessage() {}
+
+func (x *Resize) ProtoReflect() protoreflect.Message {
+	mi := &file_clui_completion_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Resize.ProtoReflect.Descriptor instead.
+func (*Resize) Descriptor() ([]byte, []int) {
+	return file_clui_completion_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Resize) GetRows() uint32 {
+	if x != nil {
+		return x.Rows
+	}
+	return 0
+}
+
+func (x *Resize) GetCols() uint32 {
+	if x != nil {
+		return x.Cols
+	}
+	return 0
+}
+
+func (x *Resize) GetX() uint32 {
+	if x != nil {
+		return x.X
+	}
+	return 0
+}
+
+func (x *Resize) GetY() uint32 {
+	if x != nil {
+		return x.Y
+	}
+	return 0
+}
+
+// AcceptCompletion asks the provider to apply entries[entry_index] of the
+// CompletionInfo with the given request_id to the command line, instead of
+// the frontend typing actual_input itself
+type AcceptCompletion struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	RequestId  uint64 `protobuf:"varint,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	EntryIndex uint32 `protobuf:"varint,2,opt,name=entry_index,json=entryIndex,proto3" json:"entry_index,omitempty"`
+}
+
+func (x *AcceptCompletion) Reset() {
+	*x = AcceptCompletion{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_clui_completion_proto_msgTypes[7]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AcceptCompletion) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AcceptCompletion) ProtoMessage() {}
+
+func (x *AcceptCompletion) ProtoReflect() protoreflect.Message {
+	mi := &file_clui_completion_proto_msgTypes[7]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AcceptCompletion.ProtoReflect.Descriptor instead.
+func (*AcceptCompletion) Descriptor() ([]byte, []int) {
+	return file_clui_completion_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *AcceptCompletion) GetRequestId() uint64 {
+	if x != nil {
+		return x.RequestId
+	}
+	return 0
+}
+
+func (x *AcceptCompletion) GetEntryIndex() uint32 {
+	if x != nil {
+		return x.EntryIndex
+	}
+	return 0
+}
+
+// ControlMessage is sent by the frontend over the control stream, it carries
+// everything that is neither terminal input nor completion
+type ControlMessage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// Types that are assignable to Message:
+	//	*ControlMessage_Resize
+	//	*ControlMessage_Accept
+	Message isControlMessage_Message `protobuf_oneof:"message"`
+}
+
+func (x *ControlMessage) Reset() {
+	*x = ControlMessage{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_clui_completion_proto_msgTypes[8]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ControlMessage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ControlMessage) ProtoMessage() {}
+
+func (x *ControlMessage) ProtoReflect() protoreflect.Message {
+	mi := &file_clui_completion_proto_msgTypes[8]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ControlMessage.ProtoReflect.Descriptor instead.
+func (*ControlMessage) Descriptor() ([]byte, []int) {
+	return file_clui_completion_proto_rawDescGZIP(), []int{8}
+}
+
+func (m *ControlMessage) GetMessage() isControlMessage_Message {
+	if m != nil {
+		return m.Message
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetResize() *Resize {
+	if x, ok := x.GetMessage().(*ControlMessage_Resize); ok {
+		return x.Resize
+	}
+	return nil
+}
+
+func (x *ControlMessage) GetAccept() *AcceptCompletion {
+	if x, ok := x.GetMessage().(*ControlMessage_Accept); ok {
+		return x.Accept
+	}
+	return nil
+}
+
+type isControlMessage_Message interface {
+	isControlMessage_Message()
+}
+
+type ControlMessage_Resize struct {
+	Resize *Resize `protobuf:"bytes,1,opt,name=resize,proto3,oneof"`
+}
+
+type ControlMessage_Accept struct {
+	Accept *AcceptCompletion `protobuf:"bytes,2,opt,name=accept,proto3,oneof"`
+}
+
+func (*ControlMessage_Resize) isControlMessage_Message() {}
+
+func (*ControlMessage_Accept) isControlMessage_Message() {}
+
 var File_clui_completion_proto protoreflect.FileDescriptor
 
 var file_clui_completion_proto_rawDesc = []byte{
 	0x0a, 0x15, 0x63, 0x6c, 0x75, 0x69, 0x2f, 0x63, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f,
-	0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x04, 0x63, 0x6c, 0x75, 0x69, 0x22, 0xaf, 0x01,
+	0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x04, 0x63, 0x6c, 0x75, 0x69, 0x22, 0xfa, 0x01,
 	0x0a, 0x0f, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x45, 0x6e, 0x74, 0x72,
 	0x79, 0x12, 0x21, 0x0a, 0x0c, 0x61, 0x63, 0x74, 0x75, 0x61, 0x6c, 0x5f, 0x69, 0x6e, 0x70, 0x75,
 	0x74, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x0b, 0x61, 0x63, 0x74, 0x75, 0x61, 0x6c, 0x49,
@@ -288,33 +773,84 @@ var file_clui_completion_proto_rawDesc = []byte{
 	0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x18,
 	0x04, 0x20, 0x01, 0x28, 0x05, 0x52, 0x05, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x12, 0x21, 0x0a, 0x0c,
 	0x73, 0x68, 0x6f, 0x75, 0x6c, 0x64, 0x5f, 0x69, 0x6e, 0x70, 0x75, 0x74, 0x18, 0x05, 0x20, 0x01,
-	0x28, 0x08, 0x52, 0x0b, 0x73, 0x68, 0x6f, 0x75, 0x6c, 0x64, 0x49, 0x6e, 0x70, 0x75, 0x74, 0x22,
-	0xc2, 0x01, 0x0a, 0x0e, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x6e,
-	0x66, 0x6f, 0x12, 0x2f, 0x0a, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x18, 0x01, 0x20,
-	0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x63, 0x6c, 0x75, 0x69, 0x2e, 0x43, 0x6f, 0x6d, 0x70, 0x6c,
-	0x65, 0x74, 0x69, 0x6f, 0x6e, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72,
-	0x69, 0x65, 0x73, 0x12, 0x10, 0x0a, 0x03, 0x63, 0x6f, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05,
-	0x52, 0x03, 0x63, 0x6f, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x18, 0x03, 0x20,
-	0x01, 0x28, 0x05, 0x52, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x62, 0x75, 0x66,
-	0x66, 0x65, 0x72, 0x5f, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05,
-	0x52, 0x0c, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x12, 0x19,
-	0x0a, 0x08, 0x69, 0x73, 0x5f, 0x66, 0x69, 0x72, 0x73, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08,
-	0x52, 0x07, 0x69, 0x73, 0x46, 0x69, 0x72, 0x73, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x69, 0x73, 0x5f,
-	0x65, 0x6d, 0x70, 0x74, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x69, 0x73, 0x45,
-	0x6d, 0x70, 0x74, 0x79, 0x22, 0x9c, 0x01, 0x0a, 0x14, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74,
-	0x69, 0x6f, 0x6e, 0x53, 0x6f, 0x75, 0x72, 0x63, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x10, 0x0a,
-	0x03, 0x63, 0x6f, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03, 0x63, 0x6f, 0x6c, 0x12,
-	0x12, 0x0a, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x6c,
-	0x69, 0x6e, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x64, 0x69, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x03, 0x64, 0x69, 0x72, 0x12, 0x19, 0x0a, 0x08, 0x6c, 0x5f, 0x62, 0x75, 0x66, 0x66, 0x65,
-	0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x6c, 0x42, 0x75, 0x66, 0x66, 0x65, 0x72,
-	0x12, 0x19, 0x0a, 0x08, 0x72, 0x5f, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x18, 0x05, 0x20, 0x01,
-	0x28, 0x09, 0x52, 0x07, 0x72, 0x42, 0x75, 0x66, 0x66, 0x65, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x62,
-	0x75, 0x66, 0x66, 0x65, 0x72, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x62, 0x75, 0x66,
-	0x66, 0x65, 0x72, 0x42, 0x33, 0x5a, 0x31, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f,
-	0x6d, 0x2f, 0x6d, 0x69, 0x63, 0x68, 0x61, 0x65, 0x6c, 0x6c, 0x65, 0x65, 0x38, 0x2f, 0x63, 0x6c,
-	0x75, 0x69, 0x2d, 0x6e, 0x69, 0x78, 0x2f, 0x67, 0x6f, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x70, 0x72,
-	0x6f, 0x74, 0x6f, 0x2f, 0x63, 0x6c, 0x75, 0x69, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x28, 0x08, 0x52, 0x0b, 0x73, 0x68, 0x6f, 0x75, 0x6c, 0x64, 0x49, 0x6e, 0x70, 0x75, 0x74, 0x12,
+	0x33, 0x0a, 0x0c, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x5f, 0x72, 0x61, 0x6e, 0x67, 0x65, 0x73, 0x18,
+	0x06, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x10, 0x2e, 0x63, 0x6c, 0x75, 0x69, 0x2e, 0x4d, 0x61, 0x74,
+	0x63, 0x68, 0x52, 0x61, 0x6e, 0x67, 0x65, 0x52, 0x0b, 0x6d, 0x61, 0x74, 0x63, 0x68, 0x52, 0x61,
+	0x6e, 0x67, 0x65, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x18, 0x07, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x05, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x22, 0x3b, 0x0a, 0x0f, 0x43, 0x6f,
+	0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x12, 0x10, 0x0a,
+	0x03, 0x74, 0x61, 0x67, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x74, 0x61, 0x67, 0x12,
+	0x16, 0x0a, 0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x22, 0x34, 0x0a, 0x0a, 0x4d, 0x61, 0x74, 0x63, 0x68,
+	0x52, 0x61, 0x6e, 0x67, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x05, 0x73, 0x74, 0x61, 0x72, 0x74, 0x12, 0x10, 0x0a, 0x03, 0x65,
+	0x6e, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x03, 0x65, 0x6e, 0x64, 0x22, 0x85, 0x03,
+	0x0a, 0x0e, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x49, 0x6e, 0x66, 0x6f,
+	0x12, 0x2f, 0x0a, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x15, 0x2e, 0x63, 0x6c, 0x75, 0x69, 0x2e, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74,
+	0x69, 0x6f, 0x6e, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x65, 0x6e, 0x74, 0x72, 0x69, 0x65,
+	0x73, 0x12, 0x10, 0x0a, 0x03, 0x63, 0x6f, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x03,
+	0x63, 0x6f, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28,
+	0x05, 0x52, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x62, 0x75, 0x66, 0x66, 0x65,
+	0x72, 0x5f, 0x6c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x18, 0x05, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0c,
+	0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x4c, 0x65, 0x6e, 0x67, 0x74, 0x68, 0x12, 0x19, 0x0a, 0x08,
+	0x69, 0x73, 0x5f, 0x66, 0x69, 0x72, 0x73, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07,
+	0x69, 0x73, 0x46, 0x69, 0x72, 0x73, 0x74, 0x12, 0x19, 0x0a, 0x08, 0x69, 0x73, 0x5f, 0x65, 0x6d,
+	0x70, 0x74, 0x79, 0x18, 0x07, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x69, 0x73, 0x45, 0x6d, 0x70,
+	0x74, 0x79, 0x12, 0x1d, 0x0a, 0x0a, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49,
+	0x64, 0x12, 0x43, 0x0a, 0x11, 0x6c, 0x61, 0x74, 0x65, 0x5f, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x18, 0x09, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x63,
+	0x6c, 0x75, 0x69, 0x2e, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70,
+	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x10, 0x6c, 0x61, 0x74, 0x65, 0x44, 0x65, 0x73, 0x63, 0x72, 0x69,
+	0x70, 0x74, 0x69, 0x6f, 0x6e, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e,
+	0x63, 0x65, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x08, 0x73, 0x65, 0x71, 0x75, 0x65, 0x6e,
+	0x63, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x6f, 0x6e, 0x65, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x08,
+	0x52, 0x04, 0x64, 0x6f, 0x6e, 0x65, 0x12, 0x2d, 0x0a, 0x06, 0x67, 0x72, 0x6f, 0x75, 0x70, 0x73,
+	0x18, 0x0c, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x63, 0x6c, 0x75, 0x69, 0x2e, 0x43, 0x6f,
+	0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x47, 0x72, 0x6f, 0x75, 0x70, 0x52, 0x06, 0x67,
+	0x72, 0x6f, 0x75, 0x70, 0x73, 0x22, 0x55, 0x0a, 0x10, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x44, 0x65,
+	0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1f, 0x0a, 0x0b, 0x65, 0x6e, 0x74,
+	0x72, 0x79, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a,
+	0x65, 0x6e, 0x74, 0x72, 0x79, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x12, 0x20, 0x0a, 0x0b, 0x64, 0x65,
+	0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x0b, 0x64, 0x65, 0x73, 0x63, 0x72, 0x69, 0x70, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0xd9, 0x01, 0x0a,
+	0x14, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x53, 0x6f, 0x75, 0x72, 0x63,
+	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x10, 0x0a, 0x03, 0x63, 0x6f, 0x6c, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x05, 0x52, 0x03, 0x63, 0x6f, 0x6c, 0x12, 0x12, 0x0a, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x05, 0x52, 0x04, 0x6c, 0x69, 0x6e, 0x65, 0x12, 0x10, 0x0a, 0x03, 0x64,
+	0x69, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x64, 0x69, 0x72, 0x12, 0x19, 0x0a,
+	0x08, 0x6c, 0x5f, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x6c, 0x42, 0x75, 0x66, 0x66, 0x65, 0x72, 0x12, 0x19, 0x0a, 0x08, 0x72, 0x5f, 0x62, 0x75,
+	0x66, 0x66, 0x65, 0x72, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x72, 0x42, 0x75, 0x66,
+	0x66, 0x65, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x18, 0x06, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x62, 0x75, 0x66, 0x66, 0x65, 0x72, 0x12, 0x1d, 0x0a, 0x0a, 0x72,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x07, 0x20, 0x01, 0x28, 0x04, 0x52,
+	0x09, 0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x64, 0x12, 0x1c, 0x0a, 0x09, 0x65, 0x78,
+	0x65, 0x63, 0x75, 0x74, 0x69, 0x6e, 0x67, 0x18, 0x08, 0x20, 0x01, 0x28, 0x08, 0x52, 0x09, 0x65,
+	0x78, 0x65, 0x63, 0x75, 0x74, 0x69, 0x6e, 0x67, 0x22, 0x4c, 0x0a, 0x06, 0x52, 0x65, 0x73, 0x69,
+	0x7a, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x72, 0x6f, 0x77, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x04, 0x72, 0x6f, 0x77, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x63, 0x6f, 0x6c, 0x73, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0d, 0x52, 0x04, 0x63, 0x6f, 0x6c, 0x73, 0x12, 0x0c, 0x0a, 0x01, 0x78, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x01, 0x78, 0x12, 0x0c, 0x0a, 0x01, 0x79, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x0d, 0x52, 0x01, 0x79, 0x22, 0x52, 0x0a, 0x10, 0x41, 0x63, 0x63, 0x65, 0x70, 0x74,
+	0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x1d, 0x0a, 0x0a, 0x72, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x5f, 0x69, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x04, 0x52, 0x09,
+	0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x49, 0x64, 0x12, 0x1f, 0x0a, 0x0b, 0x65, 0x6e, 0x74,
+	0x72, 0x79, 0x5f, 0x69, 0x6e, 0x64, 0x65, 0x78, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0a,
+	0x65, 0x6e, 0x74, 0x72, 0x79, 0x49, 0x6e, 0x64, 0x65, 0x78, 0x22, 0x75, 0x0a, 0x0e, 0x43, 0x6f,
+	0x6e, 0x74, 0x72, 0x6f, 0x6c, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x26, 0x0a, 0x06,
+	0x72, 0x65, 0x73, 0x69, 0x7a, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x0c, 0x2e, 0x63,
+	0x6c, 0x75, 0x69, 0x2e, 0x52, 0x65, 0x73, 0x69, 0x7a, 0x65, 0x48, 0x00, 0x52, 0x06, 0x72, 0x65,
+	0x73, 0x69, 0x7a, 0x65, 0x12, 0x30, 0x0a, 0x06, 0x61, 0x63, 0x63, 0x65, 0x70, 0x74, 0x18, 0x02,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x63, 0x6c, 0x75, 0x69, 0x2e, 0x41, 0x63, 0x63, 0x65,
+	0x70, 0x74, 0x43, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x69, 0x6f, 0x6e, 0x48, 0x00, 0x52, 0x06,
+	0x61, 0x63, 0x63, 0x65, 0x70, 0x74, 0x42, 0x09, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67,
+	0x65, 0x42, 0x33, 0x5a, 0x31, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f,
+	0x6d, 0x69, 0x63, 0x68, 0x61, 0x65, 0x6c, 0x6c, 0x65, 0x65, 0x38, 0x2f, 0x63, 0x6c, 0x75, 0x69,
+	0x2d, 0x6e, 0x69, 0x78, 0x2f, 0x67, 0x6f, 0x2f, 0x70, 0x6b, 0x67, 0x2f, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x2f, 0x63, 0x6c, 0x75, 0x69, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -329,19 +865,30 @@ func file_clui_completion_proto_rawDescGZIP() []byte {
 	return file_clui_completion_proto_rawDescData
 }
 
-var file_clui_completion_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_clui_completion_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
 var file_clui_completion_proto_goTypes = []interface{}{
 	(*CompletionEntry)(nil),      // 0: clui.CompletionEntry
-	(*CompletionInfo)(nil),       // 1: clui.CompletionInfo
-	(*CompletionSourceInfo)(nil), // 2: clui.CompletionSourceInfo
+	(*CompletionGroup)(nil),      // 1: clui.CompletionGroup
+	(*MatchRange)(nil),           // 2: clui.MatchRange
+	(*CompletionInfo)(nil),       // 3: clui.CompletionInfo
+	(*EntryDescription)(nil),     // 4: clui.EntryDescription
+	(*CompletionSourceInfo)(nil), // 5: clui.CompletionSourceInfo
+	(*Resize)(nil),               // 6: clui.Resize
+	(*AcceptCompletion)(nil),     // 7: clui.AcceptCompletion
+	(*ControlMessage)(nil),       // 8: clui.ControlMessage
 }
 var file_clui_completion_proto_depIdxs = []int32{
-	0, // 0: clui.CompletionInfo.entries:type_name -> clui.CompletionEntry
-	1, // [1:1] is the sub-list for method output_type
-	1, // [1:1] is the sub-list for method input_type
-	1, // [1:1] is the sub-list for extension type_name
-	1, // [1:1] is the sub-list for extension extendee
-	0, // [0:1] is the sub-list for field type_name
+	2, // 0: clui.CompletionEntry.match_ranges:type_name -> clui.MatchRange
+	0, // 1: clui.CompletionInfo.entries:type_name -> clui.CompletionEntry
+	4, // 2: clui.CompletionInfo.late_descriptions:type_name -> clui.EntryDescription
+	1, // 3: clui.CompletionInfo.groups:type_name -> clui.CompletionGroup
+	6, // 4: clui.ControlMessage.resize:type_name -> clui.Resize
+	7, // 5: clui.ControlMessage.accept:type_name -> clui.AcceptCompletion
+	6, // [6:6] is the sub-list for method output_type
+	6, // [6:6] is the sub-list for method input_type
+	6, // [6:6] is the sub-list for extension type_name
+	6, // [6:6] is the sub-list for extension extendee
+	0, // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_clui_completion_proto_init() }
@@ -363,7 +910,7 @@ func file_clui_completion_proto_init() {
 			}
 		}
 		file_clui_completion_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
-			switch v := v.(*CompletionInfo); i {
+			switch v := v.(*CompletionGroup); i {
 			case 0:
 				return &v.state
 			case 1:
@@ -375,6 +922,42 @@ func file_clui_completion_proto_init() {
 			}
 		}
 		file_clui_completion_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*MatchRange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_clui_completion_proto_msgTypes[3].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*CompletionInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_clui_completion_proto_msgTypes[4].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*EntryDescription); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_clui_completion_proto_msgTypes[5].Exporter = func(v interface{}, i int) interface{} {
 			switch v := v.(*CompletionSourceInfo); i {
 			case 0:
 				return &v.state
@@ -386,6 +969,46 @@ func file_clui_completion_proto_init() {
 				return nil
 			}
 		}
+		file_clui_completion_proto_msgTypes[6].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*Resize); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_clui_completion_proto_msgTypes[7].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*AcceptCompletion); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_clui_completion_proto_msgTypes[8].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ControlMessage); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+	}
+	file_clui_completion_proto_msgTypes[8].OneofWrappers = []interface{}{
+		(*ControlMessage_Resize)(nil),
+		(*ControlMessage_Accept)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -393,7 +1016,7 @@ func file_clui_completion_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_clui_completion_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   9,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
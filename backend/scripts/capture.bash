@@ -0,0 +1,133 @@
+#!/bin/bash
+
+# usage: capture.bash <lbuffer> [<rbuffer>], prints the completions bash offers
+# at the cursor between lbuffer and rbuffer, one per line. Directories end
+# with a /.
+#
+# The completion specs registered with `complete` are used just like readline
+# would, bash-completion is loaded if it is installed so that its loader finds
+# the specs of commands on demand.
+
+__clui_lbuffer=$1
+__clui_rbuffer=$2
+
+# nothing in the buffer may ever be expanded
+set -f
+shopt -s extglob progcomp
+
+# bash-completion sources the completions of the user itself, they are only
+# sourced here without it
+__clui_f=${BASH_COMPLETION_USER_FILE:-~/.bash_completion}
+for __clui_bc in \
+    /usr/share/bash-completion/bash_completion \
+    /usr/local/share/bash-completion/bash_completion \
+    /etc/bash_completion; do
+    if [[ -r $__clui_bc ]]; then
+        __clui_f=$__clui_bc
+        break
+    fi
+done
+[[ -r $__clui_f ]] && . "$__clui_f" >/dev/null 2>&1
+
+# the words are split at whitespace, the word under the cursor is made of the
+# parts before and after it
+read -ra __clui_words <<< "$__clui_lbuffer"
+if [[ -z $__clui_lbuffer || $__clui_lbuffer == *[[:space:]] ]]; then
+    __clui_words+=("")
+fi
+__clui_cword=$(( ${#__clui_words[@]} - 1 ))
+cur=${__clui_words[__clui_cword]}
+__clui_right=${__clui_rbuffer%%[[:space:]]*}
+read -ra __clui_rest <<< "${__clui_rbuffer:${#__clui_right}}"
+
+COMP_WORDS=("${__clui_words[@]}")
+COMP_WORDS[__clui_cword]+=$__clui_right
+COMP_WORDS+=("${__clui_rest[@]}")
+COMP_CWORD=$__clui_cword
+COMP_LINE=$__clui_lbuffer$__clui_rbuffer
+COMP_POINT=${#__clui_lbuffer}
+COMP_TYPE=9
+COMP_KEY=9
+prev=
+(( COMP_CWORD > 0 )) && prev=${COMP_WORDS[COMP_CWORD-1]}
+
+# __clui_load_spec sets __clui_spec to the completion spec of a command, as the
+# arguments given to complete. The spec is loaded on demand if bash-completion
+# knows how to, commands without one get the default spec if there is any.
+__clui_load_spec () {
+    local spec
+    spec=$(complete -p -- "$1" 2>/dev/null)
+    if [[ -z $spec ]]; then
+        if declare -F _comp_load >/dev/null; then
+            _comp_load -- "$1" >/dev/null 2>&1
+        elif declare -F __load_completion >/dev/null; then
+            __load_completion "$1" >/dev/null 2>&1
+        fi
+        spec=$(complete -p -- "$1" 2>/dev/null)
+    fi
+    [[ -z $spec ]] && spec=$(complete -p -D 2>/dev/null)
+    __clui_spec=()
+    [[ -n $spec ]] && eval "__clui_spec=( $spec )"
+}
+
+__clui_results=()
+
+if (( COMP_CWORD == 0 )); then
+    mapfile -t __clui_results < <(compgen -c -- "$cur")
+    if [[ $cur == */* ]]; then
+        mapfile -t -O ${#__clui_results[@]} __clui_results < <(compgen -f -- "$cur")
+    fi
+else
+    __clui_load_spec "${COMP_WORDS[0]}"
+
+    # the options of the spec are split into those compgen understands and
+    # those it does not
+    __clui_opts=()
+    __clui_func=
+    __clui_cmd=
+    __clui_compgen=()
+    __clui_i=1
+    while (( __clui_i < ${#__clui_spec[@]} - 1 )); do
+        case ${__clui_spec[__clui_i]} in
+            -o) __clui_opts+=("${__clui_spec[__clui_i+1]}"); (( __clui_i += 2 )) ;;
+            -F) __clui_func=${__clui_spec[__clui_i+1]}; (( __clui_i += 2 )) ;;
+            -C) __clui_cmd=${__clui_spec[__clui_i+1]}; (( __clui_i += 2 )) ;;
+            -[AWGPSX]) __clui_compgen+=("${__clui_spec[@]:__clui_i:2}"); (( __clui_i += 2 )) ;;
+            -[DEI]) (( __clui_i++ )) ;;
+            *) __clui_compgen+=("${__clui_spec[__clui_i]}"); (( __clui_i++ )) ;;
+        esac
+    done
+
+    if (( ${#__clui_compgen[@]} )); then
+        mapfile -t __clui_results < <(compgen "${__clui_compgen[@]}" -- "$cur" 2>/dev/null)
+    fi
+    if [[ -n $__clui_func ]] && declare -F "$__clui_func" >/dev/null; then
+        COMPREPLY=()
+        "$__clui_func" "${COMP_WORDS[0]}" "$cur" "$prev" >/dev/null 2>&1
+        __clui_results+=("${COMPREPLY[@]}")
+    fi
+    if [[ -n $__clui_cmd ]]; then
+        # the command gets the line in its environment, like from readline
+        export COMP_LINE COMP_POINT COMP_KEY COMP_TYPE
+        mapfile -t -O ${#__clui_results[@]} __clui_results < <(
+            eval "$__clui_cmd"' "${COMP_WORDS[0]}" "$cur" "$prev"' 2>/dev/null
+        )
+    fi
+
+    if (( ${#__clui_spec[@]} == 0 )) || { (( ${#__clui_results[@]} == 0 )) &&
+        [[ " ${__clui_opts[*]} " == *" "@(default|bashdefault)" "* ]]; }; then
+        mapfile -t -O ${#__clui_results[@]} __clui_results < <(compgen -f -- "$cur")
+    fi
+    if [[ " ${__clui_opts[*]} " == *" plusdirs "* ]]; then
+        mapfile -t -O ${#__clui_results[@]} __clui_results < <(compgen -d -- "$cur")
+    fi
+fi
+
+# commands are only taken for directories if they are paths
+for __clui_r in "${__clui_results[@]}"; do
+    [[ -z $__clui_r ]] && continue
+    if [[ $__clui_r != */ && -d $__clui_r ]] && { (( COMP_CWORD > 0 )) || [[ $__clui_r == */* ]]; }; then
+        __clui_r+=/
+    fi
+    printf '%s\n' "$__clui_r"
+done
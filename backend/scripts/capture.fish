@@ -0,0 +1,11 @@
+#!/usr/bin/env fish
+
+# usage: capture.fish <lbuffer> [<rbuffer>], prints the completions fish offers
+# at the cursor between lbuffer and rbuffer, one `<match>\t<description>` per
+# line.
+#
+# fish only completes at the end of a command line, so only lbuffer is given to
+# it, the part of the word after the cursor is left to the completer. The
+# buffer is expanded as a variable, it is never parsed as code.
+
+complete --do-complete="$argv[1]"
@@ -0,0 +1,262 @@
+-- clui.lua is loaded into the nvim started by the nvim provider once it has
+-- attached over msgpack-RPC. It reports the line being edited in insert mode
+-- and on the command line to the provider, and answers its completion and
+-- accept requests.
+
+local M = {}
+
+-- the channel of the provider and the id of the last report, every change
+-- gets a larger id so that stale completion results can be told apart
+local chan
+local request_id = 0
+
+-- keyword is the pattern of the characters of a word in insert mode, the
+-- provider splits words the same way
+local keyword = '[%w_]'
+
+-- buffer_lines is the number of lines of a buffer whose words are offered,
+-- those around the cursor in the current buffer and the first ones of the
+-- others
+local buffer_lines = 1000
+
+-- buffer_words caches the words of the loaded buffers by their changedtick
+-- and the first line scanned, only the buffer being edited has to be scanned
+-- again while typing
+local buffer_words = {}
+
+local function notify(state)
+  request_id = request_id + 1
+  state.id = request_id
+  state.dir = vim.fn.getcwd()
+  vim.rpcnotify(chan, 'clui_changed', state)
+end
+
+-- report sends the line being edited to the provider, the cursor is given as
+-- the number of bytes before it and as a position on the screen
+local function report()
+  local mode = vim.api.nvim_get_mode().mode:sub(1, 1)
+  if mode == 'c' then
+    -- only ex commands are completed, not searches
+    if vim.fn.getcmdtype() ~= ':' then
+      return
+    end
+    notify({
+      mode = 'c',
+      line = vim.fn.getcmdline(),
+      col = vim.fn.getcmdpos() - 1,
+      screen_row = vim.o.lines,
+      screen_col = vim.fn.getcmdpos() + 1,
+    })
+  elseif mode == 'i' then
+    notify({
+      mode = 'i',
+      line = vim.api.nvim_get_current_line(),
+      col = vim.api.nvim_win_get_cursor(0)[2],
+      screen_row = vim.fn.screenrow(),
+      screen_col = vim.fn.screencol(),
+    })
+  end
+end
+
+-- report_idle tells the provider that nothing is being edited anymore, so
+-- that the entries of the last line are cleared
+local function report_idle()
+  notify({ mode = 'n', line = '', col = 0, screen_row = 0, screen_col = 0 })
+end
+
+function M.setup(provider_chan)
+  chan = provider_chan
+  local group = vim.api.nvim_create_augroup('clui', { clear = true })
+  vim.api.nvim_create_autocmd({ 'TextChangedI', 'TextChangedP', 'CmdlineChanged' }, {
+    group = group,
+    callback = report,
+  })
+  vim.api.nvim_create_autocmd({ 'InsertLeave', 'CmdlineLeave' }, {
+    group = group,
+    callback = report_idle,
+  })
+  vim.api.nvim_create_autocmd('BufUnload', {
+    group = group,
+    callback = function(args)
+      buffer_words[args.buf] = nil
+    end,
+  })
+end
+
+-- words returns the distinct words of buf
+local function words(buf)
+  local first = 0
+  if buf == vim.api.nvim_get_current_buf() then
+    first = math.max(vim.api.nvim_win_get_cursor(0)[1] - 1 - math.floor(buffer_lines / 2), 0)
+  end
+  local tick = vim.api.nvim_buf_get_changedtick(buf)
+  local cached = buffer_words[buf]
+  if cached and cached.tick == tick and cached.first == first then
+    return cached.words
+  end
+
+  local list, seen = {}, {}
+  for _, line in ipairs(vim.api.nvim_buf_get_lines(buf, first, first + buffer_lines, false)) do
+    for word in line:gmatch(keyword .. '+') do
+      if not seen[word] then
+        seen[word] = true
+        table.insert(list, word)
+      end
+    end
+  end
+  buffer_words[buf] = { tick = tick, first = first, words = list }
+  return list
+end
+
+-- lsp_request is the language server request of the last completion while it
+-- is running, cancel cancels it
+local lsp_request
+
+-- request_lsp asks the language servers attached to the current buffer for
+-- completion items for request id without waiting for them, callback is
+-- called with the items once all of them have answered. It returns false if
+-- there are no language servers to ask.
+local function request_lsp(id, callback)
+  local get_clients = vim.lsp.get_clients or vim.lsp.get_active_clients
+  local clients = get_clients({ bufnr = 0 })
+  if #clients == 0 then
+    return false
+  end
+  local params = vim.lsp.util.make_position_params(0, clients[1].offset_encoding)
+  local request = { id = id }
+  request.cancel = vim.lsp.buf_request_all(0, 'textDocument/completion', params, function(responses)
+    if lsp_request == request then
+      lsp_request = nil
+    end
+    local items = {}
+    for _, response in pairs(responses or {}) do
+      local result = response.result
+      if result then
+        for _, item in ipairs(result.items or result) do
+          table.insert(items, item)
+        end
+      end
+    end
+    callback(items)
+  end)
+  lsp_request = request
+  return true
+end
+
+-- cancel cancels the language server request of request id if it is still
+-- running, the provider has stopped waiting for it
+function M.cancel(id)
+  if lsp_request and lsp_request.id == id then
+    lsp_request.cancel()
+    lsp_request = nil
+  end
+end
+
+-- complete returns the candidates for the word before the cursor as a list of
+-- { word, description }. On the command line they are those of the command
+-- line completion of nvim, in insert mode those of the popup menu and the
+-- words of the loaded buffers. The language servers are asked in the
+-- background, lsp is set if they are, their candidates are then sent to the
+-- provider as a clui_lsp notification for request id.
+function M.complete(mode, lbuffer, rbuffer, id)
+  if lsp_request then
+    M.cancel(lsp_request.id)
+  end
+
+  local items = {}
+  local seen = {}
+  local function add(list, word, description)
+    if word and word ~= '' and not seen[word] then
+      seen[word] = true
+      table.insert(list, { word = word, description = description or '' })
+    end
+  end
+
+  if mode == 'c' then
+    for _, word in ipairs(vim.fn.getcompletion(lbuffer, 'cmdline')) do
+      add(items, word)
+    end
+    return { items = items, lsp = false }
+  end
+
+  local prefix = lbuffer:match(keyword .. '*$')
+  if prefix == '' then
+    return { items = items, lsp = false }
+  end
+
+  if vim.fn.pumvisible() == 1 then
+    for _, item in ipairs(vim.fn.complete_info({ 'items' }).items) do
+      add(items, item.word, item.menu ~= '' and item.menu or item.kind)
+    end
+  end
+
+  for _, buf in ipairs(vim.api.nvim_list_bufs()) do
+    if vim.api.nvim_buf_is_loaded(buf) then
+      for _, word in ipairs(words(buf)) do
+        if #word > #prefix and word:sub(1, #prefix) == prefix then
+          add(items, word, 'buffer')
+        end
+      end
+    end
+  end
+
+  local lsp = request_lsp(id, function(lsp_items)
+    local found = {}
+    for _, item in ipairs(lsp_items) do
+      local word = item.label
+      -- snippets would need expanding, their label is inserted instead
+      if item.insertTextFormat ~= 2 then
+        word = (item.textEdit and item.textEdit.newText) or item.insertText or item.label
+      end
+      if vim.startswith(word:lower(), prefix:lower()) then
+        add(found, word, item.detail)
+      end
+    end
+    vim.rpcnotify(chan, 'clui_lsp', { id = id, items = found })
+  end)
+
+  return { items = items, lsp = lsp }
+end
+
+-- accept replaces left and right around the cursor with text, unless the line
+-- has been edited since the entry was offered. It returns whether the edit
+-- was applied.
+function M.accept(mode, left, right, text)
+  local line, col
+  if mode == 'c' and vim.fn.getcmdtype() == ':' then
+    line, col = vim.fn.getcmdline(), vim.fn.getcmdpos() - 1
+  elseif mode == 'i' and vim.api.nvim_get_mode().mode:sub(1, 1) == 'i' then
+    line, col = vim.api.nvim_get_current_line(), vim.api.nvim_win_get_cursor(0)[2]
+  else
+    return false
+  end
+
+  local lbuffer, rbuffer = line:sub(1, col), line:sub(col + 1)
+  if lbuffer:sub(#lbuffer - #left + 1) ~= left or rbuffer:sub(1, #right) ~= right then
+    return false
+  end
+  lbuffer = lbuffer:sub(1, #lbuffer - #left) .. text
+  rbuffer = rbuffer:sub(#right + 1)
+
+  if mode == 'c' then
+    if vim.fn.exists('*setcmdline') == 1 then
+      vim.fn.setcmdline(lbuffer .. rbuffer, #lbuffer + 1)
+    else
+      local keys = (lbuffer .. rbuffer):gsub('<', '<lt>')
+      vim.api.nvim_input('<C-e><C-u>' .. keys .. string.rep('<Left>', vim.fn.strchars(rbuffer)))
+    end
+    return true
+  end
+
+  local row = vim.api.nvim_win_get_cursor(0)[1]
+  local lines = vim.split(text, '\n', { plain = true })
+  vim.api.nvim_buf_set_text(0, row - 1, col - #left, row - 1, col + #right, lines)
+  if #lines == 1 then
+    vim.api.nvim_win_set_cursor(0, { row, #lbuffer })
+  else
+    vim.api.nvim_win_set_cursor(0, { row + #lines - 1, #lines[#lines] })
+  end
+  return true
+end
+
+return M
@@ -0,0 +1,304 @@
+"""clui_repl is loaded into the interactive python started by the python
+provider. It reports the line being edited to the provider over the socket
+zkeylis uses, and answers the completion requests of the provider from a
+background thread, with jedi if it is installed and rlcompleter otherwise.
+
+readline has no hook after a key is inserted, so every printable key is bound
+to a macro that inserts it and then runs insert-completions on a key of its
+own. The completer tells those runs apart from completions asked for by the
+user by their completion type, and reports the line instead.
+"""
+
+import __main__
+import builtins
+import inspect
+import json
+import os
+import re
+import select
+import socket
+import sys
+import threading
+
+import readline
+import rlcompleter
+
+# the keys bound by install, the accept keys typed by the provider use them
+# too. ^Q and ^S are left alone, the terminal may take them for flow control.
+QUOTED_INSERT_KEY = r"\C-x\C-e"
+REPORT_KEY = r"\C-x\C-r"
+BACKWARD_DELETE_KEY = r"\C-x\C-h"
+DELETE_KEY = r"\C-x\C-d"
+
+# the completion type readline passes for insert-completions
+_REPORT_COMPLETION_TYPE = ord("*")
+
+# the number of candidates described, looking up docstrings is slow with jedi
+MAX_DESCRIPTIONS = 50
+
+# the word completed before the cursor, a possibly dotted name
+_word_re = re.compile(r"[\w.]*$")
+
+# every report gets a larger request id, so that stale completion results can
+# be told apart from fresh ones
+_request_id = 0
+
+# the completer that was installed before ours, it completes for the user
+_delegate = None
+
+
+def _varint(n):
+    out = bytearray()
+    while True:
+        b = n & 0x7F
+        n >>= 7
+        if not n:
+            out.append(b)
+            return bytes(out)
+        out.append(b | 0x80)
+
+
+def encode_csi(col, line, dir, lbuffer, rbuffer, buffer, request_id):
+    """encode_csi encodes a CompletionSourceInfo like zkeylis sends it"""
+    msg = bytearray()
+    fields = [
+        (1, col),
+        (2, line),
+        (3, dir),
+        (4, lbuffer),
+        (5, rbuffer),
+        (6, buffer),
+        (7, request_id),
+    ]
+    for field, value in fields:
+        if not value:
+            continue
+        if isinstance(value, str):
+            b = value.encode("utf-8", "surrogateescape")
+            msg += _varint(field << 3 | 2) + _varint(len(b)) + b
+        else:
+            msg += _varint(field << 3) + _varint(value)
+    return bytes(msg)
+
+
+def _get_pos():
+    """_get_pos asks the terminal for the position of the cursor"""
+    try:
+        fd = os.open("/dev/tty", os.O_RDWR | os.O_NOCTTY)
+    except OSError:
+        return 0, 0
+    try:
+        os.write(fd, b"\x1b[6n")
+        reply = b""
+        while not reply.endswith(b"R"):
+            ready, _, _ = select.select([fd], [], [], 1)
+            if not ready:
+                break
+            reply += os.read(fd, 1)
+    finally:
+        os.close(fd)
+    m = re.search(rb"\[(\d+);(\d+)R", reply)
+    if not m:
+        return 0, 0
+    return int(m[1]), int(m[2])
+
+
+def _report(lbuffer, rbuffer):
+    """_report sends the line to the provider"""
+    global _request_id
+    url = os.environ.get("KEY_LISTENER_OUTPUT", "")
+    if not url.startswith("unixpacket://"):
+        return
+    _request_id += 1
+    row, col = _get_pos()
+    msg = encode_csi(col, row, os.getcwd(), lbuffer, rbuffer, lbuffer + rbuffer, _request_id)
+    try:
+        with socket.socket(socket.AF_UNIX, socket.SOCK_SEQPACKET) as s:
+            s.connect(url[len("unixpacket://"):])
+            s.send(msg)
+    except OSError:
+        pass
+
+
+def _complete(text, state):
+    if readline.get_completion_type() != _REPORT_COMPLETION_TYPE:
+        if _delegate is None:
+            return None
+        return _delegate(text, state)
+    if state == 0:
+        # the cursor is where the completion ends, in bytes of the line
+        line = readline.get_line_buffer().encode("utf-8", "surrogateescape")
+        point = readline.get_endidx()
+        _report(
+            line[:point].decode("utf-8", "replace"),
+            line[point:].decode("utf-8", "replace"),
+        )
+    return None
+
+
+def _pre_input():
+    """_pre_input runs whenever a line is read, it makes sure that the
+    completer is ours and reports the empty line, so that suggestions for it
+    can be shown before anything is typed"""
+    global _delegate
+    completer = readline.get_completer()
+    if completer is not _complete:
+        _delegate = completer
+        readline.set_completer(_complete)
+    _report("", "")
+
+
+def _first_line(doc):
+    if not doc:
+        return ""
+    lines = doc.strip().splitlines()
+    return lines[0].strip() if lines else ""
+
+
+def _describe(namespace, word):
+    """_describe returns the first line of the docstring of the object named
+    by word, without running any code but the lookup of the object the name
+    is an attribute of, just like rlcompleter does"""
+    name = word.rstrip("(")
+    try:
+        if "." in name:
+            expr, attr = name.rsplit(".", 1)
+            obj = inspect.getattr_static(eval(expr, namespace), attr)
+        elif name in namespace:
+            obj = namespace[name]
+        else:
+            obj = inspect.getattr_static(builtins, name)
+    except Exception:
+        return ""
+    # plain values like strings only have the docstring of their type
+    if not callable(obj) and not inspect.ismodule(obj) and not isinstance(obj, property):
+        if getattr(obj, "__doc__", None) == getattr(type(obj), "__doc__", None):
+            return ""
+    return _first_line(inspect.getdoc(obj))
+
+
+def complete(lbuffer, rbuffer, namespace=None):
+    """complete returns the candidates for the word before the cursor as a
+    list of {"word", "description"}, each replacing the whole word"""
+    if namespace is None:
+        namespace = __main__.__dict__
+    word = _word_re.search(lbuffer).group()
+    if not word:
+        return []
+
+    try:
+        import jedi
+    except ImportError:
+        jedi = None
+
+    candidates = []
+    if jedi is not None:
+        prefix = word[: word.rfind(".") + 1]
+        script = jedi.Interpreter(lbuffer, [namespace])
+        for i, c in enumerate(script.complete()):
+            description = ""
+            # plain values like strings only have the docstring of their type
+            if i < MAX_DESCRIPTIONS and c.type not in ("instance", "statement"):
+                try:
+                    description = _first_line(c.docstring(raw=True))
+                except Exception:
+                    pass
+            candidates.append({"word": prefix + c.name, "description": description})
+        return candidates
+
+    completer = rlcompleter.Completer(namespace)
+    state = 0
+    seen = set()
+    while True:
+        match = completer.complete(word, state)
+        if match is None:
+            break
+        state += 1
+        if match in seen:
+            continue
+        seen.add(match)
+        description = _describe(namespace, match) if len(candidates) < MAX_DESCRIPTIONS else ""
+        candidates.append({"word": match, "description": description})
+    return candidates
+
+
+def at_prompt():
+    """at_prompt reports whether the main thread waits for a line at the
+    prompt of the interactive interpreter, rather than running code of the
+    user that may read the terminal itself. The interpreter reads lines
+    outside of python code, only the hooks of this module may run then."""
+    frame = sys._current_frames().get(threading.main_thread().ident)
+    while frame is not None:
+        if frame.f_globals.get("__name__") != __name__:
+            return False
+        frame = frame.f_back
+    return True
+
+
+def _answer(conn):
+    # nothing may be printed from here, it would end up in the middle of the
+    # line being edited
+    with conn:
+        try:
+            request = b""
+            while True:
+                chunk = conn.recv(65536)
+                if not chunk:
+                    break
+                request += chunk
+            try:
+                req = json.loads(request)
+                if req.get("prompt"):
+                    answer = at_prompt()
+                else:
+                    answer = complete(req["lbuffer"], req["rbuffer"])
+            except Exception as e:
+                answer = {"error": repr(e)}
+            conn.sendall(json.dumps(answer).encode())
+        except OSError:
+            # the provider gives up on requests that are superseded
+            pass
+
+
+def serve(path):
+    """serve answers the completion requests sent to the unix socket at path,
+    a request is {"lbuffer", "rbuffer"} and its answer the result of
+    complete, both as JSON. {"prompt": true} is answered with at_prompt
+    instead."""
+    srv = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+    srv.bind(path)
+    srv.listen()
+    while True:
+        conn, _ = srv.accept()
+        threading.Thread(target=_answer, args=(conn,), daemon=True).start()
+
+
+def install():
+    """install binds the keys that report the line and starts answering
+    completion requests, only GNU readline is supported"""
+    if "libedit" in (readline.__doc__ or ""):
+        return
+
+    path = os.environ.get("CLUI_COMPLETER_SOCKET", "")
+    if path:
+        threading.Thread(target=serve, args=(path,), daemon=True).start()
+
+    if not os.environ.get("KEY_LISTENER_OUTPUT"):
+        return
+
+    # reports must not ring the bell when there is nothing to insert
+    readline.parse_and_bind("set bell-style none")
+    readline.parse_and_bind('"%s": quoted-insert' % QUOTED_INSERT_KEY)
+    readline.parse_and_bind('"%s": insert-completions' % REPORT_KEY)
+    readline.parse_and_bind('"%s": backward-delete-char' % BACKWARD_DELETE_KEY)
+    readline.parse_and_bind('"%s": delete-char' % DELETE_KEY)
+    for code in range(32, 127):
+        key = chr(code)
+        if key in '"\\':
+            key = "\\" + key
+        readline.parse_and_bind('"%s": "%s%s%s"' % (key, QUOTED_INSERT_KEY, key, REPORT_KEY))
+
+    global _delegate
+    _delegate = readline.get_completer()
+    readline.set_completer(_complete)
+    readline.set_pre_input_hook(_pre_input)
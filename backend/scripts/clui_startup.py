@@ -0,0 +1,25 @@
+# clui_startup.py is the PYTHONSTARTUP of the python started by the python
+# provider, it loads clui_repl without leaving names behind in __main__ and
+# runs the startup file of the user afterwards
+
+
+def _clui_startup():
+    import os
+    import sys
+
+    sys.path.insert(0, os.environ["CLUI_SCRIPT_DIR"])
+    try:
+        import clui_repl
+    finally:
+        del sys.path[0]
+    clui_repl.install()
+    return os.environ.get("CLUI_USER_PYTHONSTARTUP", "")
+
+
+_clui_user_startup = _clui_startup()
+del _clui_startup
+if _clui_user_startup:
+    with open(_clui_user_startup) as _clui_f:
+        exec(compile(_clui_f.read(), _clui_user_startup, "exec"))
+    del _clui_f
+del _clui_user_startup
@@ -0,0 +1,107 @@
+#!/bin/bash
+
+# every keystroke gets a larger request id, so that stale completion results
+# can be told apart from fresh ones
+declare -gi CLUI_REQUEST_ID=0
+
+# __clui_report sends the current line to the completer through zkeylis
+__clui_report () {
+    (( CLUI_REQUEST_ID++ ))
+    "$CLUI_SCRIPT_DIR/zkeylis" -id "$CLUI_REQUEST_ID" -url "$KEY_LISTENER_OUTPUT" -pos "$(__clui_get_pos)" -dir "$PWD" \
+        -buffer "$READLINE_LINE" \
+        -lbuffer "${READLINE_LINE:0:READLINE_POINT}" \
+        -rbuffer "${READLINE_LINE:READLINE_POINT}"
+}
+
+# __clui_preexec tells the completer that the line is run, so that it types
+# nothing into whatever the line starts until the next line is reported. It
+# runs from PS0 in a subshell, which cannot count the request id up itself, so
+# __clui_precmd does that for it before the next prompt.
+__clui_preexec () {
+    "$CLUI_SCRIPT_DIR/zkeylis" -exec -id $(( CLUI_REQUEST_ID + 1 )) -url "$KEY_LISTENER_OUTPUT" -dir "$PWD"
+}
+
+__clui_precmd () {
+    (( CLUI_REQUEST_ID++ ))
+}
+
+if [[ -n $KEY_LISTENER_OUTPUT ]]; then
+    PS0=$PS0'$(__clui_preexec)'
+    PROMPT_COMMAND="__clui_precmd${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+fi
+
+# __clui_self_insert inserts the character with the hex code $1 at the cursor
+# and reports the line
+__clui_self_insert () {
+    local c
+    printf -v c "\\x$1"
+    READLINE_LINE=${READLINE_LINE:0:READLINE_POINT}$c${READLINE_LINE:READLINE_POINT}
+    (( READLINE_POINT++ ))
+    __clui_report
+}
+
+# readline has no hook run after self-insert, every printable key is bound to
+# __clui_self_insert instead
+if [[ -n $KEY_LISTENER_OUTPUT ]]; then
+    for __clui_code in {32..126}; do
+        printf -v __clui_hex '%02x' "$__clui_code"
+        printf -v __clui_key "\\x$__clui_hex"
+        case $__clui_key in
+            '"'|'\') __clui_key=\\$__clui_key ;;
+        esac
+        bind -x "\"$__clui_key\": __clui_self_insert $__clui_hex"
+    done
+    unset __clui_code __clui_hex __clui_key
+fi
+
+# decode a hex string into $REPLY
+__clui_unhex () {
+    local i escaped=
+    for (( i = 0; i < ${#1}; i += 2 )); do
+        escaped+="\\x${1:i:2}"
+    done
+    printf -v REPLY '%b' "$escaped"
+}
+
+# __clui_accept is typed by the completer when an entry is accepted on the
+# frontend, it is followed by <left>:<right>:<text>; hex encoded. The word
+# parts left and right around the cursor are replaced by text, unless the line
+# has been edited since the entry was offered.
+__clui_accept () {
+    local payload key left right text lbuffer rbuffer
+    while IFS= read -rsn 1 -t 1 key && [[ $key != ";" ]]; do
+        payload+=$key
+    done
+    if [[ $key != ";" ]]; then
+        return 1
+    fi
+
+    local lhex rhex thex
+    IFS=: read -r lhex rhex thex <<< "$payload"
+    __clui_unhex "$lhex"; left=$REPLY
+    __clui_unhex "$rhex"; right=$REPLY
+    __clui_unhex "$thex"; text=$REPLY
+
+    lbuffer=${READLINE_LINE:0:READLINE_POINT}
+    rbuffer=${READLINE_LINE:READLINE_POINT}
+    if [[ $lbuffer != *"$left" || $rbuffer != "$right"* ]]; then
+        return 1
+    fi
+    lbuffer=${lbuffer%"$left"}$text
+    rbuffer=${rbuffer#"$right"}
+    READLINE_LINE=$lbuffer$rbuffer
+    READLINE_POINT=${#lbuffer}
+
+    if [[ -n $KEY_LISTENER_OUTPUT ]]; then
+        __clui_report
+    fi
+}
+
+bind -x '"\C-x\C-a": __clui_accept'
+
+__clui_get_pos () {
+    local pos
+    echo -ne "\033[6n" > /dev/tty
+    read -t 1 -s -d 'R' pos < /dev/tty
+    echo "${pos##*\[}"
+}
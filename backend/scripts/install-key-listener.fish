@@ -0,0 +1,101 @@
+# sourced by the interactive fish started by the fish provider, it passes in
+# CLUI_SCRIPT_DIR, KEY_LISTENER_OUTPUT and CLUI_ACCEPT_FILE
+
+# every keystroke gets a larger request id, so that stale completion results
+# can be told apart from fresh ones
+set -g __clui_request_id 0
+
+# __clui_report sends the current line to the completer through zkeylis
+function __clui_report
+    set -g __clui_request_id (math $__clui_request_id + 1)
+    set -l buffer (commandline | string collect)
+    set -l cursor (commandline -C)
+    set -l lbuffer (string sub -l $cursor -- "$buffer" | string collect)
+    set -l rbuffer (string sub -s (math $cursor + 1) -- "$buffer" | string collect)
+    $CLUI_SCRIPT_DIR/zkeylis -id $__clui_request_id -url "$KEY_LISTENER_OUTPUT" -pos (__clui_get_pos) -dir "$PWD" \
+        -buffer "$buffer" -lbuffer "$lbuffer" -rbuffer "$rbuffer"
+end
+
+# report the empty line of every new prompt too, so that suggestions for it
+# can be shown before anything is typed
+function __clui_line_init --on-event fish_prompt
+    __clui_report
+end
+
+# tell the completer that the line is run, so that it types nothing into
+# whatever the line starts until the next prompt is reported
+function __clui_preexec --on-event fish_preexec
+    set -g __clui_request_id (math $__clui_request_id + 1)
+    $CLUI_SCRIPT_DIR/zkeylis -exec -id $__clui_request_id -url "$KEY_LISTENER_OUTPUT" -dir "$PWD"
+end
+
+# decode a hex string
+function __clui_unhex
+    if test -n "$argv[1]"
+        string unescape --style=url -- (string replace -ra '(..)' '%$1' -- $argv[1])
+    end
+end
+
+function __clui_has_prefix -a str prefix
+    set -l head (string sub -l (string length -- "$prefix") -- "$str" | string collect)
+    test "$head" = "$prefix"
+end
+
+function __clui_has_suffix -a str suffix
+    set -l n (string length -- "$suffix")
+    test $n -eq 0; and return 0
+    test (string length -- "$str") -ge $n; or return 1
+    set -l tail (string sub -s -$n -- "$str" | string collect)
+    test "$tail" = "$suffix"
+end
+
+# __clui_accept is typed by the completer when an entry is accepted on the
+# frontend, it leaves <left>:<right>:<text> hex encoded in CLUI_ACCEPT_FILE
+# beforehand as fish reads ahead of its bindings. The word parts left and
+# right around the cursor are replaced by text, unless the line has been
+# edited since the entry was offered.
+function __clui_accept
+    test -r "$CLUI_ACCEPT_FILE"; or return 1
+    set -l payload (string collect < "$CLUI_ACCEPT_FILE")
+    set -l fields (string split : -- "$payload")
+    rm -f "$CLUI_ACCEPT_FILE"
+    test (count $fields) -eq 3; or return 1
+    set -l left (__clui_unhex $fields[1] | string collect)
+    set -l right (__clui_unhex $fields[2] | string collect)
+    set -l text (__clui_unhex $fields[3] | string collect)
+
+    set -l buffer (commandline | string collect)
+    set -l cursor (commandline -C)
+    set -l lbuffer (string sub -l $cursor -- "$buffer" | string collect)
+    set -l rbuffer (string sub -s (math $cursor + 1) -- "$buffer" | string collect)
+    __clui_has_suffix "$lbuffer" "$left"; and __clui_has_prefix "$rbuffer" "$right"
+    or return 1
+
+    set -l head (string sub -l (math (string length -- "$lbuffer") - (string length -- "$left")) -- "$lbuffer" | string collect)
+    set lbuffer "$head$text"
+    set rbuffer (string sub -s (math (string length -- "$right") + 1) -- "$rbuffer" | string collect)
+    commandline -r -- "$lbuffer$rbuffer"
+    commandline -C (string length -- "$lbuffer")
+
+    __clui_report
+end
+
+# printable keys are reported after they are inserted, in vi mode only those
+# typed in insert mode
+if test -n "$KEY_LISTENER_OUTPUT"
+    set -l mode default
+    if test "$fish_key_bindings" = fish_vi_key_bindings
+        set mode insert
+    end
+    bind -M $mode '' self-insert __clui_report
+    bind -M $mode \cx\ca __clui_accept
+end
+
+function __clui_get_pos
+    set -l saved (stty -g </dev/tty)
+    stty raw -echo min 0 time 10 </dev/tty
+    printf '\e[6n' >/dev/tty
+    set -l reply (dd bs=32 count=1 </dev/tty 2>/dev/null | string collect)
+    stty $saved </dev/tty
+    string replace -rf '.*\[(\d+;\d+)R.*' '$1' -- "$reply"; or echo '0;0'
+end